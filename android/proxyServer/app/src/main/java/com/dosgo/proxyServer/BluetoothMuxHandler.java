@@ -13,6 +13,15 @@ import java.util.concurrent.ConcurrentHashMap;
  * 使用 4 字节头部：[ID(2 bytes)][Length(2 bytes)]
  */
 public class BluetoothMuxHandler {
+    // 握手帧使用的保留 ID，见 Go 端 proto.HelloID
+    private static final int HELLO_ID = 0xFFFF;
+    private static final byte[] HELLO_MAGIC = {'B', 'T', 'P', 'X'};
+    private static final int PROTOCOL_VERSION = 1;
+    // 本端尚未实现 FIN/RST、打开回复、流控等可选特性
+    private static final int FEATURES = 0;
+    // 本端能接收的最大帧负载，与 start() 中的 payload 缓冲区一致
+    private static final int MAX_FRAME = 1024 * 33;
+
     private final InputStream btIn;
     private final OutputStream btOut;
     // 用于管理逻辑流 ID (端口) 与本地 Socket 的映射
@@ -32,7 +41,7 @@ public class BluetoothMuxHandler {
         new Thread(() -> {
             try {
                 byte[] header = new byte[4];
-                byte[] payload = new byte[1024*33];
+                byte[] payload = new byte[MAX_FRAME];
                 while (true) {
                     // 1. 读取 4 字节头部
                     readFull(btIn, header,4);
@@ -47,6 +56,10 @@ public class BluetoothMuxHandler {
                     }
 
                     // 3. 分发数据
+                    if (id == HELLO_ID) {
+                        handleHello(payload, len);
+                        continue;
+                    }
                     handleStreamData(id, payload,len);
                 }
             } catch (IOException e) {
@@ -56,6 +69,37 @@ public class BluetoothMuxHandler {
         }).start();
     }
 
+    /**
+     * 握手：[魔数(4)][版本(1)][特性位(4)][最大帧负载(4)]，回复本端的版本和特性
+     */
+    private void handleHello(byte[] data, int len) throws IOException {
+        ByteBuffer bb = ByteBuffer.wrap(data, 0, len);
+        if (len < 13) {
+            System.out.println("无效的握手帧, len:" + len);
+            return;
+        }
+        byte[] magic = new byte[4];
+        bb.get(magic);
+        if (!java.util.Arrays.equals(magic, HELLO_MAGIC)) {
+            System.out.println("无效的握手魔数");
+            return;
+        }
+        int version = bb.get() & 0xFF;
+        int features = bb.getInt();
+        int maxFrame = bb.getInt();
+        if (version != PROTOCOL_VERSION) {
+            System.out.println("警告: 协议版本不一致，本端 " + PROTOCOL_VERSION + "，客户端 " + version);
+        }
+        System.out.println("握手完成: 客户端版本 " + version + ", 特性 " + Integer.toHexString(features) + ", 最大帧 " + maxFrame);
+
+        ByteBuffer reply = ByteBuffer.allocate(13);
+        reply.put(HELLO_MAGIC);
+        reply.put((byte) PROTOCOL_VERSION);
+        reply.putInt(FEATURES);
+        reply.putInt(MAX_FRAME);
+        sendFrame(HELLO_ID, reply.array(), reply.position());
+    }
+
     private void handleStreamData(int id, byte[] data,int len) {
         //控制命令
         if(id==0){
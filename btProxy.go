@@ -20,6 +20,9 @@ import (
 type MappingRow struct {
 	LocalPortEntry  *widget.Entry
 	RemoteAddrEntry *widget.Entry
+	PriorityEntry   *widget.Entry
+	TypeSelect      *widget.Select
+	CompressCheck   *widget.Check
 	Container       *fyne.Container
 }
 
@@ -96,12 +99,16 @@ func (ui *AppUI) createUI() fyne.CanvasObject {
 	// 如果配置中有历史数据，加载它们
 	if len(ui.config.Mappings) > 0 {
 		for _, m := range ui.config.Mappings {
-			ui.addMappingRow(strconv.Itoa(m.LocalPort), m.RemoteAddr)
+			priority := ""
+			if m.Priority > 0 {
+				priority = strconv.Itoa(m.Priority)
+			}
+			ui.addMappingRow(strconv.Itoa(m.LocalPort), m.RemoteAddr, priority, m.Type, m.Compress)
 		}
 	}
 
 	addBtn := widget.NewButtonWithIcon("添加映射行", theme.ContentAddIcon(), func() {
-		ui.addMappingRow("", "")
+		ui.addMappingRow("", "", "", comm.MappingTCP, false)
 	})
 
 	// 自动启动复选框
@@ -145,7 +152,7 @@ func (ui *AppUI) createUI() fyne.CanvasObject {
 		widget.NewLabelWithStyle("蓝牙配置", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 		ui.macEntry,
 		widget.NewSeparator(),
-		widget.NewLabelWithStyle("转发映射 (本地端口 -> 远程地址)", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		widget.NewLabelWithStyle("转发映射 (本地端口 -> 远程地址, 权重)", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 		scrollArea,
 		addBtn,
 		ui.autoStart,
@@ -162,10 +169,13 @@ func (ui *AppUI) createUI() fyne.CanvasObject {
 	return container.NewPadded(form)
 }
 
-func (ui *AppUI) createMappingRow(localPort, remoteAddr string) *MappingRow {
+func (ui *AppUI) createMappingRow(localPort, remoteAddr, priority, mappingType string, compress bool) *MappingRow {
 	row := &MappingRow{
 		LocalPortEntry:  widget.NewEntry(),
 		RemoteAddrEntry: widget.NewEntry(),
+		PriorityEntry:   widget.NewEntry(),
+		TypeSelect:      widget.NewSelect(comm.MappingTypes, nil),
+		CompressCheck:   widget.NewCheck("压缩", nil),
 	}
 
 	row.LocalPortEntry.SetText(localPort)
@@ -174,6 +184,24 @@ func (ui *AppUI) createMappingRow(localPort, remoteAddr string) *MappingRow {
 	row.RemoteAddrEntry.SetText(remoteAddr)
 	row.RemoteAddrEntry.SetPlaceHolder("远程地址 (IP:Port)")
 
+	row.PriorityEntry.SetText(priority)
+	row.PriorityEntry.SetPlaceHolder("权重")
+
+	// 映射类型，透明代理不需要远程地址
+	if mappingType == "" {
+		mappingType = comm.MappingTCP
+	}
+	row.TypeSelect.SetSelected(mappingType)
+	row.TypeSelect.OnChanged = func(string) {
+		ui.syncConf()
+	}
+
+	// 压缩文本类流量，对已加密的流量会自动放弃
+	row.CompressCheck.SetChecked(compress)
+	row.CompressCheck.OnChanged = func(bool) {
+		ui.syncConf()
+	}
+
 	// 删除按钮
 	delBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
 		ui.removeMappingRow(row)
@@ -186,8 +214,13 @@ func (ui *AppUI) createMappingRow(localPort, remoteAddr string) *MappingRow {
 	// 设置端口输入框的宽度（例如 80 像素）
 	portBox := container.NewHBox(container.NewGridWrap(fyne.NewSize(80, 36), portContainer))
 
-	// 使用 Border 布局：左侧放端口，中间放地址（自动拉伸），右侧放删除按钮
-	row.Container = container.NewBorder(nil, nil, portBox, delBtn, row.RemoteAddrEntry)
+	// 权重输入框同样固定宽度，放在删除按钮左侧
+	priorityBox := container.NewGridWrap(fyne.NewSize(60, 36), container.NewStack(row.PriorityEntry))
+
+	typeBox := container.NewGridWrap(fyne.NewSize(100, 36), row.TypeSelect)
+
+	// 使用 Border 布局：左侧放端口，中间放地址（自动拉伸），右侧放类型、压缩、权重和删除按钮
+	row.Container = container.NewBorder(nil, nil, portBox, container.NewHBox(typeBox, row.CompressCheck, priorityBox, delBtn), row.RemoteAddrEntry)
 
 	return row
 }
@@ -205,10 +238,11 @@ func (ui *AppUI) removeMappingRow(row *MappingRow) {
 	ui.mappingsContainer.Refresh()
 	//同步配置
 	ui.syncConf()
-	comm.StopProxy(fmt.Sprintf(":%d", row.LocalPortEntry.Text))
+	lp, _ := strconv.Atoi(row.LocalPortEntry.Text)
+	comm.StopMappingProxy(comm.ProxyMapping{LocalPort: lp, Type: row.TypeSelect.Selected})
 }
-func (ui *AppUI) addMappingRow(port, addr string) {
-	row := ui.createMappingRow(port, addr)
+func (ui *AppUI) addMappingRow(port, addr, priority, mappingType string, compress bool) {
+	row := ui.createMappingRow(port, addr, priority, mappingType, compress)
 	ui.mappingRows = append(ui.mappingRows, row)
 	ui.mappingsContainer.Add(row.Container)
 	ui.mappingsContainer.Refresh()
@@ -219,10 +253,24 @@ func (ui *AppUI) addMappingRow(port, addr string) {
 func (ui *AppUI) stopProxy() error {
 	for _, m := range ui.config.Mappings {
 		if m.LocalPort > 0 {
-			// 每个端口启动一个协程，共用一个 mux
-			comm.StopProxy(fmt.Sprintf(":%d", m.LocalPort))
+			comm.StopMappingProxy(m)
 		}
 	}
+	if ui.config.SocksAddr != "" {
+		comm.StopProxy(ui.config.SocksAddr)
+	}
+	if ui.config.HTTPAddr != "" {
+		comm.StopProxy(ui.config.HTTPAddr)
+	}
+	if ui.config.MixedAddr != "" {
+		comm.StopProxy(ui.config.MixedAddr)
+	}
+	if ui.config.DNSAddr != "" {
+		comm.StopProxy(ui.config.DNSAddr)
+	}
+	if ui.config.Tun != nil {
+		comm.StopProxy(ui.config.Tun.DeviceName())
+	}
 	ui.startBtn.Text = "启动代理"
 	ui.startBtn.Refresh()
 	return nil
@@ -234,11 +282,19 @@ func (ui *AppUI) syncConf() {
 	var newMappings []comm.ProxyMapping
 	for _, row := range ui.mappingRows {
 		lp, _ := strconv.Atoi(row.LocalPortEntry.Text)
-		if lp > 0 && row.RemoteAddrEntry.Text != "" {
-			newMappings = append(newMappings, comm.ProxyMapping{
-				LocalPort:  lp,
-				RemoteAddr: row.RemoteAddrEntry.Text,
-			})
+		priority, _ := strconv.Atoi(row.PriorityEntry.Text)
+		m := comm.ProxyMapping{
+			LocalPort:  lp,
+			RemoteAddr: row.RemoteAddrEntry.Text,
+			Priority:   priority,
+			Type:       row.TypeSelect.Selected,
+			Compress:   row.CompressCheck.Checked,
+		}
+		if m.Type == comm.MappingTCP {
+			m.Type = ""
+		}
+		if lp > 0 && (m.RemoteAddr != "" || !m.NeedsRemote()) {
+			newMappings = append(newMappings, m)
 		}
 	}
 	ui.config.Mappings = newMappings
@@ -247,26 +303,51 @@ func (ui *AppUI) syncConf() {
 
 // startProxy 启动蓝牙代理
 func (ui *AppUI) startProxy() error {
-	// 验证输入
-	if err := ui.macEntry.Validate(); err != nil {
-		return fmt.Errorf("MAC 地址无效: %v", err)
+	// 验证输入，配置了其他链路时不需要 MAC
+	if ui.config.Transport == "" {
+		if err := ui.macEntry.Validate(); err != nil {
+			return fmt.Errorf("MAC 地址无效: %v", err)
+		}
 	}
 	//同步配置
 	ui.syncConf()
 
-	btRaw := comm.NewConnectBT(ui.config.BluetoothMAC)
+	link, err := ui.config.NewTransport()
+	if err != nil {
+		return err
+	}
 	//多路复用
-	mux := comm.NewMuxManager(btRaw)
+	mux := comm.NewMuxManager(link)
+	mux.SetKeepalive(ui.config.Keepalive())
+
+	// TUN 模式最容易失败（需要 root），先启动，失败时不再启动其他代理
+	if ui.config.Tun != nil {
+		if err := comm.StartTun(mux, *ui.config.Tun); err != nil {
+			return fmt.Errorf("TUN 模式启动失败: %v", err)
+		}
+	}
 
 	for _, m := range ui.config.Mappings {
 		if m.LocalPort > 0 {
 			// 每个端口启动一个协程，共用一个 mux
-			go comm.StartPortProxy(mux, fmt.Sprintf(":%d", m.LocalPort), m.RemoteAddr)
+			go comm.StartMappingProxy(mux, m)
 		}
 	}
+	if ui.config.SocksAddr != "" {
+		go comm.StartSocksProxyAuth(mux, ui.config.SocksAddr, ui.config.ProxyUsers)
+	}
+	if ui.config.HTTPAddr != "" {
+		go comm.StartHTTPProxyAuth(mux, ui.config.HTTPAddr, ui.config.ProxyUsers)
+	}
+	if ui.config.MixedAddr != "" {
+		go comm.StartMixedProxy(mux, ui.config.MixedAddr, ui.config.ProxyUsers)
+	}
+	if ui.config.DNSAddr != "" {
+		go comm.StartDNSProxy(mux, ui.config.DNSAddr)
+	}
 
-	fmt.Printf("启动蓝牙代理: MAC=%s, AutoStart=%v\n",
-		ui.config.BluetoothMAC, ui.config.AutoStart)
+	fmt.Printf("启动蓝牙代理: 链路=%s, AutoStart=%v\n",
+		link.Name(), ui.config.AutoStart)
 	ui.startBtn.Text = "停止代理"
 	ui.startBtn.Refresh()
 	return nil
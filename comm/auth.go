@@ -0,0 +1,164 @@
+package comm
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ProxyUser 代理用户，SOCKS5 用户名/密码认证使用
+type ProxyUser struct {
+	Username string `json:"username"`
+	// 密码哈希，由 HashPassword 生成；配置文件中填写明文时加载后自动替换为哈希
+	Password string `json:"password"`
+	// 允许访问的目的地址，为空表示不限制，格式为 主机[:端口]：
+	// 主机可以是 *、IP、CIDR 或域名通配符（*.example.com），
+	// 端口可以是 *、单个端口或范围（8000-8100），省略表示任意端口。
+	// 客户端不做域名解析，以域名访问的目的地址只匹配域名规则和 *
+	Allow []string `json:"allow,omitempty"`
+}
+
+// 密码哈希格式：pbkdf2-sha256$迭代次数$盐$哈希，盐和哈希为无填充的 base64
+const (
+	passwordScheme = "pbkdf2-sha256"
+	passwordIter   = 10000
+)
+
+// HashPassword 生成密码哈希
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIter, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIter, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// isPasswordHash 判断是否为 HashPassword 生成的格式
+func isPasswordHash(s string) bool {
+	return strings.HasPrefix(s, passwordScheme+"$")
+}
+
+// CheckPassword 校验密码
+func (u *ProxyUser) CheckPassword(password string) bool {
+	parts := strings.Split(u.Password, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err1 := enc.DecodeString(parts[2])
+	want, err2 := enc.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || len(want) == 0 {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// Allowed 判断用户能否访问目的地址 host:port
+func (u *ProxyUser) Allowed(target string) bool {
+	if len(u.Allow) == 0 {
+		return true
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+	for _, rule := range u.Allow {
+		if matchDest(rule, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDest 判断目的地址是否符合一条 Allow 规则
+func matchDest(rule, host string, port int) bool {
+	ruleHost, rulePort := rule, ""
+	if h, p, err := net.SplitHostPort(rule); err == nil {
+		ruleHost, rulePort = h, p
+	}
+	if !matchPort(rulePort, port) {
+		return false
+	}
+	if ruleHost == "*" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if _, cidr, err := net.ParseCIDR(ruleHost); err == nil {
+		return ip != nil && cidr.Contains(ip)
+	}
+	if ruleIP := net.ParseIP(ruleHost); ruleIP != nil {
+		return ip != nil && ruleIP.Equal(ip)
+	}
+	if ip != nil {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(ruleHost), strings.ToLower(strings.TrimSuffix(host, ".")))
+	return ok
+}
+
+// matchPort 匹配端口规则：空或 * 为任意端口，支持 a-b 范围
+func matchPort(rule string, port int) bool {
+	if rule == "" || rule == "*" {
+		return true
+	}
+	lo, hi, isRange := strings.Cut(rule, "-")
+	from, err := strconv.Atoi(lo)
+	if err != nil {
+		return false
+	}
+	to := from
+	if isRange {
+		if to, err = strconv.Atoi(hi); err != nil {
+			return false
+		}
+	}
+	return port >= from && port <= to
+}
+
+// lookupUser 按用户名查找用户
+func lookupUser(users []ProxyUser, name string) *ProxyUser {
+	for i := range users {
+		if users[i].Username == name {
+			return &users[i]
+		}
+	}
+	return nil
+}
+
+// hashPasswords 把配置中的明文密码替换为哈希，返回是否有改动
+func (c *Config) hashPasswords() bool {
+	changed := false
+	for i := range c.ProxyUsers {
+		u := &c.ProxyUsers[i]
+		if u.Password == "" || isPasswordHash(u.Password) {
+			continue
+		}
+		hash, err := HashPassword(u.Password)
+		if err != nil {
+			fmt.Printf("用户 %s 的密码哈希失败: %v\n", u.Username, err)
+			continue
+		}
+		u.Password = hash
+		changed = true
+	}
+	return changed
+}
@@ -1,11 +1,8 @@
 package comm
 
 import (
-	"errors"
 	"io"
-	"log"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/tarm/serial"
@@ -43,91 +40,11 @@ func connectByCom(comName string, baud int) (io.ReadWriteCloser, error) {
 	return serialPort, nil
 }
 
-func NewConnectBT(macAddrStr string) *ConnectBT {
-	return &ConnectBT{macAddrStr: macAddrStr}
-}
-
-type ConnectBT struct {
-	macAddrStr string
-	conn       ReadWriteCloseWithDeadline
-	mu         sync.Mutex // 保护 conn 的并发访问和重连过程
-}
-
-// 你的原始连接逻辑封装
-func (a *ConnectBT) connect() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if a.conn != nil {
-		return nil
-	}
-	btRaw, err := connectByAddr(a.macAddrStr)
-	if err != nil {
-		return err
-	}
-	a.conn = btRaw
-	return nil
-}
-
-// 实现 io.Reader
-func (a *ConnectBT) Read(p []byte) (n int, err error) {
-
-	a.mu.Lock()
-	currConn := a.conn
-	a.mu.Unlock()
-	if currConn != nil {
-		n, err = currConn.Read(p)
-		if err != nil {
-			log.Printf("蓝牙读取失败: %v, 准备重连...", err)
-			currConn.Close()
-			a.mu.Lock()
-			a.conn = nil
-			a.mu.Unlock()
-		}
-		return n, err
-	}
-	a.reconnect()
-	return 0, errors.New("蓝牙未连接，读取失败")
+// ConnectBT 经典蓝牙 RFCOMM 链路，断开后在下一次读写时自动重连
+type ConnectBT = Link
 
-}
-
-// 实现 io.Writer
-func (a *ConnectBT) Write(p []byte) (n int, err error) {
-	a.mu.Lock()
-	currConn := a.conn
-	a.mu.Unlock()
-	if currConn != nil {
-		currConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		n, err = currConn.Write(p)
-		if err != nil {
-			log.Printf("蓝牙写入失败: %v, 准备重连...", err)
-			currConn.Close()
-			a.mu.Lock()
-			a.conn = nil
-			a.mu.Unlock()
-		}
-		return n, err
-	}
-	a.reconnect()
-	return 0, errors.New("蓝牙未连接，写入失败")
-}
-
-// 内部重连方法
-func (a *ConnectBT) reconnect() error {
-	log.Printf("正在尝试重连到蓝牙: %s", a.macAddrStr)
-	err := a.connect()
-	if err != nil {
-		log.Printf("重连失败: %v", err)
-		return err
-	}
-	log.Println("蓝牙重连成功")
-	return nil
-}
-
-func (a *ConnectBT) Close() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if a.conn != nil {
-		return a.conn.Close()
-	}
-	return nil
+func NewConnectBT(macAddrStr string) *ConnectBT {
+	return NewLink("rfcomm://"+macAddrStr, func() (io.ReadWriteCloser, error) {
+		return connectByAddr(macAddrStr)
+	})
 }
@@ -1,24 +1,198 @@
 package comm
 
 import (
+	"dosgo/btProxy/comm/framing"
+	"dosgo/btProxy/comm/peerauth"
+	"dosgo/btProxy/comm/tlslink"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"time"
 )
 
 type ProxyMapping struct {
 	LocalPort  int    `json:"local_port"`
 	RemoteAddr string `json:"remote_addr"`
+	Priority   int    `json:"priority,omitempty"` // 发送权重，越大越优先，0 表示默认值 1
+	Type       string `json:"type,omitempty"`     // 映射类型，见 MappingTypes，空为 tcp
+	Compress   bool   `json:"compress,omitempty"` // 压缩该映射的流，适合文本流量，仅 tcp 映射有效
+}
+
+// 映射类型
+const (
+	MappingTCP      = "tcp"      // 本地端口转发到 RemoteAddr
+	MappingUDP      = "udp"      // 本地 UDP 端口转发到 RemoteAddr，可以与 TCP 映射使用同一个端口
+	MappingRedirect = "redirect" // 透明代理，接收 iptables REDIRECT 的 TCP 连接，目的地址取自 SO_ORIGINAL_DST，仅 Linux
+	MappingTProxy   = "tproxy"   // 透明代理，接收 iptables TPROXY 的 TCP 连接和 UDP 数据报，仅 Linux
+	MappingReverse  = "reverse"  // 反向转发，服务端监听 RemoteAddr，连接转发到本机的 LocalPort
+)
+
+// MappingTypes 所有映射类型，供界面选择
+var MappingTypes = []string{MappingTCP, MappingUDP, MappingRedirect, MappingTProxy, MappingReverse}
+
+// NeedsRemote 判断该映射是否需要配置远程地址，透明代理的目的地址来自每个连接
+func (m ProxyMapping) NeedsRemote() bool {
+	switch m.Type {
+	case "", MappingTCP, MappingUDP, MappingReverse:
+		return true
+	}
+	return false
 }
 
 type Config struct {
 	BluetoothMAC string
 	Mappings     []ProxyMapping `json:"mappings"` // 支持多行配置
 	AutoStart    bool
+	// 物理链路地址，例如 rfcomm://94:d3:31:d3:04:f3、serial:///dev/ttyUSB0?baud=115200、
+	// tcp://127.0.0.1:9000，为空时使用 BluetoothMAC
+	Transport string `json:"transport,omitempty"`
+	// 心跳间隔（秒），0 使用默认值，负数关闭心跳
+	KeepaliveInterval int `json:"keepalive_interval,omitempty"`
+	// 连续多少个心跳周期收不到数据后强制重连，0 使用默认值
+	KeepaliveMisses int `json:"keepalive_misses,omitempty"`
+	// 物理链路的分帧方式：空为原始字节流，"cobs" 为 COBS 分帧加 CRC-32 校验，
+	// 适合 HC-05 等串口链路，服务端需同时开启
+	Framing string `json:"framing,omitempty"`
+	// SOCKS5 代理监听地址，例如 127.0.0.1:1080，为空不启动
+	SocksAddr string `json:"socks_addr,omitempty"`
+	// HTTP 代理监听地址，为空不启动
+	HTTPAddr string `json:"http_addr,omitempty"`
+	// 混合代理监听地址，同一端口自动识别 SOCKS5、SOCKS4/4a 和 HTTP，为空不启动
+	MixedAddr string `json:"mixed_addr,omitempty"`
+	// 本地 DNS 服务监听地址，例如 127.0.0.1:53，查询经 Mux 由服务端解析，为空不启动
+	DNSAddr string `json:"dns_addr,omitempty"`
+	// 代理用户，非空时 SOCKS5 和 HTTP 代理都要求用户名/密码认证，SOCKS4 被拒绝
+	ProxyUsers []ProxyUser `json:"proxy_users,omitempty"`
+	// TUN 模式配置，非空时接管整机流量（仅 Linux）
+	Tun *TunConfig `json:"tun,omitempty"`
+	// 链路认证的密钥 ID 和密钥（base64），由服务端 -add-key 生成，
+	// 非空时每次连接先与服务端双向认证，认证失败不建立链路
+	AuthID  string `json:"auth_id,omitempty"`
+	AuthKey string `json:"auth_key,omitempty"`
+	// 链路加密：每次连接先与服务端建立 TLS 1.3 会话，双方用公钥指纹互相校验
+	Encrypt bool `json:"encrypt,omitempty"`
+	// 本端私钥（base64），开启加密后首次加载配置时自动生成
+	TLSKey string `json:"tls_key,omitempty"`
+	// 服务端公钥指纹，服务端启动时打印
+	TLSServerPin string `json:"tls_server_pin,omitempty"`
 }
 
 const configFileName = "_config.json"
 
+// Keepalive 返回心跳间隔和允许丢失的周期数，未配置的项使用默认值
+func (c *Config) Keepalive() (time.Duration, int) {
+	interval := DefaultKeepaliveInterval
+	if c.KeepaliveInterval != 0 {
+		interval = time.Duration(c.KeepaliveInterval) * time.Second
+	}
+	misses := DefaultKeepaliveMisses
+	if c.KeepaliveMisses > 0 {
+		misses = c.KeepaliveMisses
+	}
+	return interval, misses
+}
+
+// NewTransport 按配置创建物理链路，开启了分帧、加密或认证时每次连接后先套上对应的层
+func (c *Config) NewTransport() (Transport, error) {
+	addr := c.Transport
+	if addr == "" {
+		addr = c.BluetoothMAC
+	}
+	t, err := NewTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := c.linkHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if fn == nil {
+		return t, nil
+	}
+	h, ok := t.(handshaker)
+	if !ok {
+		return nil, fmt.Errorf("链路 %s 不支持分帧、加密和认证", t.Name())
+	}
+	h.SetHandshake(fn)
+	return t, nil
+}
+
+// handshaker 由支持在拨号后握手的链路实现，例如 Link
+type handshaker interface {
+	SetHandshake(fn func(io.ReadWriteCloser) (io.ReadWriteCloser, error))
+}
+
+// linkHandshake 按配置组合每次连接后的握手，层次与服务端相同：
+// 物理链路之上先分帧，再建立加密会话，最后在其中认证，都未开启时返回 nil
+func (c *Config) linkHandshake() (func(io.ReadWriteCloser) (io.ReadWriteCloser, error), error) {
+	var cobs bool
+	switch c.Framing {
+	case "":
+	case "cobs":
+		cobs = true
+	default:
+		fmt.Printf("未知的分帧方式 %q，按原始字节流处理\n", c.Framing)
+	}
+	var id *tlslink.Identity
+	if c.Encrypt {
+		if c.TLSServerPin == "" {
+			return nil, fmt.Errorf("开启了链路加密，但未配置服务端公钥指纹 tls_server_pin")
+		}
+		var err error
+		if id, err = tlslink.NewIdentity(c.TLSKey); err != nil {
+			return nil, err
+		}
+		log.Printf("链路加密已开启，本端公钥指纹: %s", id.Fingerprint)
+	}
+	var key []byte
+	if c.AuthKey != "" {
+		var err error
+		if key, err = peerauth.ParseKey(c.AuthKey); err != nil {
+			return nil, err
+		}
+	}
+	if !cobs && id == nil && key == nil {
+		return nil, nil
+	}
+	pin, authID := c.TLSServerPin, c.AuthID
+	return func(rw io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+		if cobs {
+			// 分帧直接位于物理链路之上，误码只会损坏单个帧
+			rw = framing.NewConn(rw)
+		}
+		if id != nil {
+			conn, err := tlslink.Client(rw, id, pin)
+			if err != nil {
+				log.Printf("链路加密失败，关闭连接: %v", err)
+				return nil, err
+			}
+			rw = conn
+		}
+		if key != nil {
+			if err := peerauth.Client(rw, authID, key); err != nil {
+				log.Printf("链路认证失败，关闭连接: %v", err)
+				return nil, err
+			}
+			log.Printf("链路认证成功: %s", authID)
+		}
+		return rw, nil
+	}, nil
+}
+
+// ensureTLSKey 开启了链路加密但还没有私钥时生成一个，返回是否有改动
+func (c *Config) ensureTLSKey() bool {
+	if !c.Encrypt || c.TLSKey != "" {
+		return false
+	}
+	c.TLSKey = tlslink.GenerateKey()
+	if id, err := tlslink.NewIdentity(c.TLSKey); err == nil {
+		fmt.Printf("已生成链路加密私钥，本端公钥指纹（加入服务端 -tls-peers 文件）: %s\n", id.Fingerprint)
+	}
+	return true
+}
+
 // 2. 保存配置到 JSON 文件
 func SaveConfig(cfg *Config) {
 	data, err := json.MarshalIndent(cfg, "", "  ") // 格式化输出，方便阅读
@@ -47,6 +221,12 @@ func LoadConfig() *Config {
 	err = json.Unmarshal(data, &cfg)
 	if err != nil {
 		fmt.Println("Error parsing config file:", err)
+		return &cfg
+	}
+	// 不在配置文件里保留明文密码，开启加密时补上私钥
+	hashed := cfg.hashPasswords()
+	if cfg.ensureTLSKey() || hashed {
+		SaveConfig(&cfg)
 	}
 	return &cfg
 }
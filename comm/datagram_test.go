@@ -0,0 +1,185 @@
+package comm
+
+import (
+	"bytes"
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"dosgo/btProxy/comm/server"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeSizes 记录每次写入物理链路的字节数，调度器每帧写一次
+type writeSizes struct {
+	net.Conn
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (w *writeSizes) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.sizes = append(w.sizes, len(p))
+	w.mu.Unlock()
+	return w.Conn.Write(p)
+}
+
+// atLeast 返回不小于 n 字节的写入次数
+func (w *writeSizes) atLeast(n int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	count := 0
+	for _, s := range w.sizes {
+		if s >= n {
+			count++
+		}
+	}
+	return count
+}
+
+// datagramMux 启动服务端，返回客户端的 Mux 和两个方向上各自的写入记录
+func datagramMux(t *testing.T) (*MuxManager, *writeSizes, *writeSizes) {
+	var srvWrites writeSizes
+	addr := listen(t, func(c net.Conn) {
+		srvWrites.Conn = c
+		h := server.NewBluetoothMuxHandler(&srvWrites)
+		h.SetKeepalive(0, 0)
+		h.Start()
+		<-h.Done()
+		c.Close()
+	})
+	var cliWrites writeSizes
+	link := NewLink("tcp://"+addr, func() (io.ReadWriteCloser, error) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		cliWrites.Conn = c
+		return &cliWrites, nil
+	})
+	m := NewMuxManager(link)
+	t.Cleanup(m.CloseBt)
+	return m, &cliWrites, &srvWrites
+}
+
+// TestDatagramBoundaries 超过普通数据帧上限的数据报整帧发出，两个方向都逐个原样收到
+func TestDatagramBoundaries(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	m, cliWrites, srvWrites := datagramMux(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dc, err := m.OpenDatagramConn(ctx, echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+
+	sizes := []int{1, maxWritePayload - 1, maxWritePayload, maxWritePayload + 100, 3 * maxWritePayload, 0xFFFF - 64}
+	buf := make([]byte, proto.MaxDatagram)
+	for i, size := range sizes {
+		msg := bytes.Repeat([]byte{byte(i + 1)}, size)
+		if _, err := dc.WriteTo(msg, echo.LocalAddr()); err != nil {
+			t.Fatalf("发送 %d 字节: %v", size, err)
+		}
+		dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, from, err := dc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("等待 %d 字节的回包: %v", size, err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("发出 %d 字节，收到 %d 字节", size, n)
+		}
+		if from.String() != echo.LocalAddr().String() {
+			t.Fatalf("回包来源 %s", from)
+		}
+	}
+
+	// 明显超过 maxWritePayload 的数据报在两个方向上都没有被拆成多帧
+	// 按普通数据拆分时每帧最多 maxWritePayload 加上包头，留出包头和消息头的余量
+	threshold := maxWritePayload + 64
+	big := 0
+	for _, size := range sizes {
+		if size > threshold {
+			big++
+		}
+	}
+	if n := cliWrites.atLeast(threshold); n != big {
+		t.Errorf("客户端有 %d 帧超过 %d 字节，期望 %d", n, threshold, big)
+	}
+	if n := srvWrites.atLeast(threshold); n != big {
+		t.Errorf("服务端有 %d 帧超过 %d 字节，期望 %d", n, threshold, big)
+	}
+
+	// 放不进一帧的消息被拒绝，而不是拆开
+	if _, err := dc.WriteTo(make([]byte, proto.MaxDatagram+1), echo.LocalAddr()); err != proto.ErrDatagramTooLarge {
+		t.Fatalf("超过 MaxDatagram: %v", err)
+	}
+	stream, err := m.OpenDatagramContext(ctx, echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write(make([]byte, m.messageLimit()+1)); err != proto.ErrDatagramTooLarge {
+		t.Fatalf("超过单帧上限的消息: %v", err)
+	}
+}
+
+// TestDatagramDropsWhenWindowFull 发送额度不够整条消息时丢弃数据报，不阻塞也不拆开
+func TestDatagramDropsWhenWindowFull(t *testing.T) {
+	m, cliWrites, _ := datagramMux(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := m.OpenDatagramContext(ctx, "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	stream.sendWin.Set(100)
+	msg := proto.AppendDatagram(nil, "127.0.0.1", 9, make([]byte, 200))
+	done := make(chan error, 1)
+	go func() {
+		n, err := stream.Write(msg)
+		if err == nil && n != len(msg) {
+			err = io.ErrShortWrite
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("额度不够时发送阻塞")
+	}
+	if n := cliWrites.atLeast(100); n != 0 {
+		t.Fatalf("额度不够的数据报仍然发出了 %d 帧", n)
+	}
+
+	// 额度足够的小数据报照常发出，额度相应减少
+	small := proto.AppendDatagram(nil, "127.0.0.1", 9, make([]byte, 50))
+	if _, err := stream.Write(small); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := stream.sendWin.TryAcquire(100 - len(small) + 1); ok {
+		t.Fatal("发出的数据报没有扣除额度")
+	}
+}
@@ -0,0 +1,294 @@
+package comm
+
+import (
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQueryTimeout 本地查询等待服务端回复的时长
+const dnsQueryTimeout = 8 * time.Second
+
+// StartDNSProxy 在 addr 上同时监听 UDP 和 TCP 的 DNS 查询，经 Mux 交给服务端解析，回复按 TTL 缓存
+func StartDNSProxy(mux *MuxManager, addr string) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Fatalf("DNS 代理 UDP 监听失败: %v", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		log.Fatalf("DNS 代理 TCP 监听失败: %v", err)
+	}
+	log.Printf("DNS 代理启动在 %s", addr)
+	c := newDNSClient(mux)
+	stopChans.Store(addr, &dnsListener{Listener: listener, udp: pc, client: c})
+
+	go c.serveUDP(pc)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go c.serveTCP(conn)
+	}
+}
+
+// dnsListener 同时持有 DNS 代理的 TCP 监听、UDP 套接字和解析流
+type dnsListener struct {
+	net.Listener
+	udp    net.PacketConn
+	client *dnsClient
+}
+
+func (l *dnsListener) Close() error {
+	l.udp.Close()
+	l.client.Close()
+	return l.Listener.Close()
+}
+
+// dnsClient 把查询写入同一个 DNS 解析流，查询 ID 改写为流内唯一的 ID，按 ID 取回回复
+type dnsClient struct {
+	mux   *MuxManager
+	cache *dnsCache
+
+	mu      sync.Mutex
+	stream  *VirtualConn
+	pending map[uint16]chan []byte // 流内 ID -> 等待回复的查询
+	nextID  uint16
+	closed  bool
+}
+
+func newDNSClient(mux *MuxManager) *dnsClient {
+	return &dnsClient{mux: mux, cache: newDNSCache(), pending: make(map[uint16]chan []byte)}
+}
+
+// exchange 解析一个查询报文，先查缓存
+func (c *dnsClient) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := dnsKey(q)
+	if reply, ok := c.cache.get(key, hdr.ID); ok {
+		return reply, nil
+	}
+	reply, err := c.roundTrip(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(key, reply)
+	return reply, nil
+}
+
+// roundTrip 经解析流发送查询并等待回复
+func (c *dnsClient) roundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	msg, err := proto.AppendDNSMessage(nil, query)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	stream, err := c.streamLocked(ctx)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	id := c.nextID
+	for _, used := c.pending[id]; used; _, used = c.pending[id] {
+		id++
+	}
+	c.nextID = id + 1
+	c.pending[id] = ch
+	binary.BigEndian.PutUint16(msg[2:4], id)
+	// 持锁写入，保证一个查询的字节不会与其他查询交错
+	_, err = stream.Write(msg)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.pending[id] == ch {
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+	}()
+	if err != nil {
+		c.drop(stream)
+		return nil, err
+	}
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, ErrStreamClosed
+		}
+		// 换回客户端的查询 ID
+		copy(reply[:2], query[:2])
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// streamLocked 返回当前的解析流，没有时新建，调用方需持有 mu
+func (c *dnsClient) streamLocked(ctx context.Context) (*VirtualConn, error) {
+	if c.closed {
+		return nil, ErrStreamClosed
+	}
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	stream, err := c.mux.OpenDNSContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.stream = stream
+	go c.readLoop(stream)
+	return stream, nil
+}
+
+// readLoop 把回复交给对应 ID 的查询，流出错后让所有等待中的查询失败
+func (c *dnsClient) readLoop(stream *VirtualConn) {
+	defer c.drop(stream)
+	for {
+		reply, err := proto.ReadDNSMessage(stream)
+		if err != nil {
+			return
+		}
+		if len(reply) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(reply)
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- reply
+		}
+	}
+}
+
+// drop 丢弃出错的解析流，下一个查询会重新打开
+func (c *dnsClient) drop(stream *VirtualConn) {
+	c.mu.Lock()
+	if c.stream == stream {
+		c.stream = nil
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+	}
+	c.mu.Unlock()
+	stream.Close()
+}
+
+func (c *dnsClient) Close() {
+	c.mu.Lock()
+	c.closed = true
+	stream := c.stream
+	c.mu.Unlock()
+	if stream != nil {
+		c.drop(stream)
+	}
+}
+
+// serveUDP 处理 UDP 查询，回复超过客户端能接收的长度时截断并置 TC 位，让客户端改用 TCP
+func (c *dnsClient) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("DNS 代理 UDP 读取失败: %v", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			reply := c.answer(query)
+			if reply == nil {
+				return
+			}
+			pc.WriteTo(truncateDNS(query, reply), from)
+		}()
+	}
+}
+
+// serveTCP 处理 TCP 查询，同一连接上的查询依次回答
+func (c *dnsClient) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		query, err := proto.ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		reply := c.answer(query)
+		if reply == nil {
+			continue
+		}
+		msg, err := proto.AppendDNSMessage(nil, reply)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// answer 解析查询，失败时回复 SERVFAIL，查询本身无法解析时返回 nil
+func (c *dnsClient) answer(query []byte) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+	defer cancel()
+	reply, err := c.exchange(ctx, query)
+	if err != nil {
+		log.Printf("DNS 查询失败: %v", err)
+		return proto.DNSErrorReply(query, dnsmessage.RCodeServerFailure)
+	}
+	return reply
+}
+
+// truncateDNS 按查询的 EDNS0 UDP 长度（默认 512）截断过长的回复，只保留问题部分
+func truncateDNS(query, reply []byte) []byte {
+	limit := 512
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err == nil && p.SkipAllQuestions() == nil &&
+		p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		for {
+			h, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if h.Type == dnsmessage.TypeOPT {
+				limit = max(limit, int(h.Class))
+				break
+			}
+			p.SkipAdditional()
+		}
+	}
+	if len(reply) <= limit {
+		return reply
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil {
+		return reply
+	}
+	msg.Truncated = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+	if b, err := msg.Pack(); err == nil {
+		return b
+	}
+	return reply
+}
@@ -0,0 +1,132 @@
+package comm
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsCacheSize 缓存的最大条目数
+const dnsCacheSize = 4096
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache 按 (名字, 类型, 类) 缓存 DNS 回复，按记录的 TTL 过期，取出时扣减已经过去的时间
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[dnsCacheKey]*dnsCacheEntry)}
+}
+
+func dnsKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+// get 取出未过期的回复，ID 换成查询的 ID
+func (c *dnsCache) get(key dnsCacheKey, id uint16) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	msg := e.msg
+	msg.ID = id
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// agedResources 复制记录并扣减 TTL，OPT 记录的 TTL 字段另有含义，保持不变
+func agedResources(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	out := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			r.Header.TTL -= min(r.Header.TTL, elapsed)
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// put 缓存一个回复，截断、出错或 TTL 为 0 的回复不缓存
+func (c *dnsCache) put(key dnsCacheKey, reply []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil || msg.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(&msg)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 仍然满了就随便淘汰一条
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// cacheTTL 返回回复可以缓存的时长：肯定回复取应答记录中最小的 TTL，
+// 否定回复（NXDOMAIN 或没有记录）按 RFC 2308 取 SOA 的 TTL 与 MINIMUM 中较小者
+func cacheTTL(msg *dnsmessage.Message) (uint32, bool) {
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	if msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0 {
+		for _, r := range msg.Answers {
+			if !found || r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+				found = true
+			}
+		}
+	} else {
+		for _, r := range msg.Authorities {
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+				ttl = min(r.Header.TTL, soa.MinTTL)
+				found = true
+				break
+			}
+		}
+	}
+	return ttl, found && ttl > 0
+}
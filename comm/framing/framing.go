@@ -0,0 +1,219 @@
+// Package framing 为串口等会出错的链路提供分帧和校验：
+// 每次 Write 作为一帧，追加 CRC-32 后做 COBS 编码，以 0x00 作为帧分隔符。
+// 损坏的帧被丢弃，接收方在下一个分隔符处重新同步。
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCorruptFrame 丢弃了一个损坏的帧，之后的读取从下一帧开始，上层可据此发起重传
+var ErrCorruptFrame = errors.New("帧校验失败，已丢弃")
+
+// ErrFrameTooLarge 要写出的帧超过 MaxFrame，对端会把它当作损坏的帧丢弃
+var ErrFrameTooLarge = errors.New("帧超过最大长度")
+
+// MaxFrame 单帧解码后的最大长度（不含校验），超过的帧视为损坏
+// 需容纳最大的 Mux 帧：256 KiB 负载加包头
+const MaxFrame = 256*1024 + 16
+
+// Stats 链路上的帧统计
+type Stats struct {
+	Frames    uint64 // 校验通过的帧
+	BadCRC    uint64 // 校验失败
+	Malformed uint64 // COBS 编码错误或过短
+	Oversize  uint64 // 等不到分隔符、超出 MaxFrame
+	BytesIn   uint64 // 从底层读取的原始字节数
+	BytesOut  uint64 // 写入底层的原始字节数
+}
+
+// Conn 在底层连接上按帧收发，实现 io.ReadWriteCloser
+type Conn struct {
+	rw io.ReadWriteCloser
+
+	rmu     sync.Mutex
+	raw     []byte // 尚未遇到分隔符的原始字节
+	pending []byte // 已解码、尚未被读走的数据
+	skip    bool   // 当前帧已超长，丢弃到下一个分隔符
+	rbuf    []byte
+
+	wmu   sync.Mutex
+	fresh bool // 下一次写入前先补一个分隔符，冲掉对端残留的半帧
+
+	frames, badCRC, malformed, oversize, bytesIn, bytesOut atomic.Uint64
+}
+
+// NewConn 包装底层连接，两端必须同时启用
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	return &Conn{rw: rw, rbuf: make([]byte, 4096), fresh: true}
+}
+
+// Write 把 p 作为一帧发出，返回 len(p)，超过 MaxFrame 时不写出并返回 ErrFrameTooLarge
+func (c *Conn) Write(p []byte) (int, error) {
+	if len(p) > MaxFrame {
+		return 0, ErrFrameTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, 0, len(p)+len(p)/254+8)
+	if c.fresh {
+		buf = append(buf, 0)
+	}
+	buf = encode(buf, p)
+	buf = append(buf, 0)
+	n, err := c.rw.Write(buf)
+	c.bytesOut.Add(uint64(n))
+	if err != nil {
+		// 对端可能收到了半帧，下一帧前补分隔符
+		c.fresh = true
+		return 0, err
+	}
+	c.fresh = false
+	return len(p), nil
+}
+
+// Read 读取解码后的数据，一次只返回同一帧内的数据
+// 丢弃损坏的帧时返回 ErrCorruptFrame，连接仍然可用
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		if i := indexZero(c.raw); i >= 0 {
+			frame := c.raw[:i]
+			c.raw = c.raw[i+1:]
+			if c.skip {
+				c.skip = false
+				continue
+			}
+			if len(frame) == 0 {
+				continue
+			}
+			data, err := c.check(frame)
+			if err != nil {
+				return 0, err
+			}
+			c.pending = data
+			break
+		}
+		if len(c.raw) > MaxFrame+MaxFrame/254+8 {
+			// 一直等不到分隔符，丢掉已缓存的部分
+			c.raw = nil
+			c.skip = true
+			c.oversize.Add(1)
+			return 0, ErrCorruptFrame
+		}
+		n, err := c.rw.Read(c.rbuf)
+		c.bytesIn.Add(uint64(n))
+		c.raw = append(c.raw, c.rbuf[:n]...)
+		if err != nil {
+			// 底层断开（例如 ConnectBT 重连），残留的半帧作废
+			c.raw = nil
+			c.skip = false
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// check 解码并校验一帧
+func (c *Conn) check(frame []byte) ([]byte, error) {
+	data, ok := decode(frame)
+	if !ok || len(data) < 4 {
+		c.malformed.Add(1)
+		return nil, ErrCorruptFrame
+	}
+	body := data[:len(data)-4]
+	if len(body) > MaxFrame {
+		c.oversize.Add(1)
+		return nil, ErrCorruptFrame
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(body):]) {
+		c.badCRC.Add(1)
+		return nil, ErrCorruptFrame
+	}
+	c.frames.Add(1)
+	return body, nil
+}
+
+// Stats 返回当前的帧统计
+func (c *Conn) Stats() Stats {
+	return Stats{
+		Frames:    c.frames.Load(),
+		BadCRC:    c.badCRC.Load(),
+		Malformed: c.malformed.Load(),
+		Oversize:  c.oversize.Load(),
+		BytesIn:   c.bytesIn.Load(),
+		BytesOut:  c.bytesOut.Load(),
+	}
+}
+
+// Errors 返回丢弃的帧总数
+func (s Stats) Errors() uint64 {
+	return s.BadCRC + s.Malformed + s.Oversize
+}
+
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
+
+func indexZero(b []byte) int {
+	for i, v := range b {
+		if v == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// encode 对 p+CRC32 做 COBS 编码后追加到 dst，结果中不含 0x00
+func encode(dst, p []byte) []byte {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(p))
+	codeAt := len(dst)
+	dst = append(dst, 0)
+	code := byte(1)
+	put := func(b byte) {
+		if b != 0 {
+			dst = append(dst, b)
+			code++
+		}
+		if b == 0 || code == 0xFF {
+			dst[codeAt] = code
+			codeAt = len(dst)
+			dst = append(dst, 0)
+			code = 1
+		}
+	}
+	for _, b := range p {
+		put(b)
+	}
+	for _, b := range sum {
+		put(b)
+	}
+	dst[codeAt] = code
+	return dst
+}
+
+// decode 还原 COBS 编码的一帧
+func decode(src []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(src))
+	for i := 0; i < len(src); {
+		code := int(src[i])
+		if code == 0 || i+code > len(src) {
+			return nil, false
+		}
+		out = append(out, src[i+1:i+code]...)
+		i += code
+		if code < 0xFF && i < len(src) {
+			out = append(out, 0)
+		}
+	}
+	return out, true
+}
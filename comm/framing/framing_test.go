@@ -0,0 +1,155 @@
+package framing
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// wire 把写出的原始字节缓存起来，供另一个 Conn 读取，读完返回 io.EOF
+type wire struct{ bytes.Buffer }
+
+func (w *wire) Close() error { return nil }
+
+// readFrame 读取一帧，Read 一次只返回同一帧内的数据
+func readFrame(t *testing.T, c *Conn) ([]byte, error) {
+	t.Helper()
+	buf := make([]byte, MaxFrame+1)
+	n, err := c.Read(buf)
+	return buf[:n], err
+}
+
+func TestRoundTrip(t *testing.T) {
+	run := func(b byte, n int) []byte { return bytes.Repeat([]byte{b}, n) }
+	random := make([]byte, 100000)
+	rand.Read(random)
+	frames := [][]byte{
+		{0},
+		{0, 0, 0},
+		[]byte("hello"),
+		run(0xAA, 253),
+		run(0xAA, 254), // 恰好一个满的 COBS 块
+		run(0xAA, 255),
+		append(run(0xAA, 254), 0),
+		run(0, 1000),
+		random,
+		run(0x55, MaxFrame),
+	}
+	var link wire
+	w := NewConn(&link)
+	for _, f := range frames {
+		if n, err := w.Write(f); err != nil || n != len(f) {
+			t.Fatalf("写入 %d 字节: %d %v", len(f), n, err)
+		}
+	}
+	// 分隔符只出现在帧之间
+	raw := link.Bytes()
+	if zeros := bytes.Count(raw, []byte{0}); zeros != len(frames)+1 {
+		t.Fatalf("编码后有 %d 个 0x00，期望 %d", zeros, len(frames)+1)
+	}
+
+	r := NewConn(&link)
+	for i, want := range frames {
+		got, err := readFrame(t, r)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("第 %d 帧: %d 字节 %v，期望 %d 字节", i, len(got), err, len(want))
+		}
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("期望 io.EOF，得到 %v", err)
+	}
+	if s := r.Stats(); s.Frames != uint64(len(frames)) || s.Errors() != 0 {
+		t.Fatalf("统计 %+v", s)
+	}
+}
+
+// TestCorruptionResync 损坏的帧被丢弃并计数，之后的帧照常收到
+func TestCorruptionResync(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt 修改中间一帧的编码，frame 不含两端的分隔符
+		corrupt  func(frame []byte) []byte
+		badCRC   uint64
+		malform  uint64
+		oversize uint64
+	}{
+		{"翻转数据", func(f []byte) []byte { f[len(f)/2] ^= 0x01; return f }, 1, 0, 0},
+		{"翻转校验", func(f []byte) []byte { f[len(f)-1] ^= 0x80; return f }, 1, 0, 0},
+		{"数据变成分隔符", func(f []byte) []byte { f[len(f)/2] = 0; return f }, 0, 2, 0},
+		{"截断", func(f []byte) []byte { return f[:len(f)-3] }, 0, 1, 0},
+		{"COBS 长度越界", func(f []byte) []byte { f[0] = 0xFE; return f }, 0, 1, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var a, b, c wire
+			for link, msg := range map[*wire]string{&a: "first frame", &b: "second frame, will be damaged", &c: "third frame"} {
+				NewConn(link).Write([]byte(msg))
+			}
+			// 去掉每帧开头补的分隔符，只在帧之间保留一个
+			damaged := tc.corrupt(bytes.Trim(b.Bytes(), "\x00"))
+			var link wire
+			link.Write(a.Bytes())
+			link.Write(damaged)
+			link.Write(c.Bytes())
+
+			r := NewConn(&link)
+			if got, err := readFrame(t, r); err != nil || string(got) != "first frame" {
+				t.Fatalf("第一帧 %q %v", got, err)
+			}
+			errs := 0
+			for {
+				got, err := readFrame(t, r)
+				if err == ErrCorruptFrame {
+					errs++
+					continue
+				}
+				if err != nil || string(got) != "third frame" {
+					t.Fatalf("损坏之后的帧 %q %v", got, err)
+				}
+				break
+			}
+			s := r.Stats()
+			if errs == 0 || s.Errors() != uint64(errs) {
+				t.Fatalf("返回了 %d 次 ErrCorruptFrame，统计 %+v", errs, s)
+			}
+			if s.BadCRC != tc.badCRC || s.Malformed != tc.malform || s.Oversize != tc.oversize || s.Frames != 2 {
+				t.Fatalf("统计 %+v", s)
+			}
+		})
+	}
+}
+
+// TestOversizeFrame 超过 MaxFrame 的帧不写出；收到的超长帧被丢弃，之后的帧照常收到
+func TestOversizeFrame(t *testing.T) {
+	var link wire
+	w := NewConn(&link)
+	if n, err := w.Write(make([]byte, MaxFrame+1)); err != ErrFrameTooLarge || n != 0 {
+		t.Fatalf("写入超长帧: %d %v", n, err)
+	}
+	if link.Len() != 0 {
+		t.Fatalf("超长帧写出了 %d 字节", link.Len())
+	}
+
+	// 对端绕过写入检查发来的超长帧：编码后仍在原始缓存的上限之内
+	link.WriteByte(0)
+	link.Write(encode(nil, bytes.Repeat([]byte{0x55}, MaxFrame+1)))
+	link.WriteByte(0)
+	// 一直没有分隔符的噪声
+	link.Write(bytes.Repeat([]byte{0x55}, 2*MaxFrame))
+	link.WriteByte(0)
+	w.Write([]byte("after"))
+
+	r := NewConn(&link)
+	for i := 0; i < 2; i++ {
+		if got, err := readFrame(t, r); err != ErrCorruptFrame {
+			t.Fatalf("第 %d 个超长帧: %d 字节 %v", i, len(got), err)
+		}
+	}
+	if got, err := readFrame(t, r); err != nil || string(got) != "after" {
+		t.Fatalf("超长帧之后 %q %v", got, err)
+	}
+	if s := r.Stats(); s.Oversize != 2 || s.Frames != 1 || s.Errors() != 2 {
+		t.Fatalf("统计 %+v", s)
+	}
+}
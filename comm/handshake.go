@@ -0,0 +1,135 @@
+package comm
+
+import (
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"fmt"
+	"time"
+)
+
+// helloTimeout 等待对端握手回复的时长，超时视为旧版本对端
+const helloTimeout = 3 * time.Second
+
+// startHandshake 在连接建立或重连后发起握手，已有握手进行中时直接返回
+func (m *MuxManager) startHandshake() {
+	m.mu.Lock()
+	if m.handshaking {
+		m.mu.Unlock()
+		return
+	}
+	m.handshaking = true
+	ready := make(chan struct{})
+	m.ready = ready
+	m.mu.Unlock()
+	go m.handshake(ready)
+}
+
+// handshake 发送握手并等待对端回复，超时则回退到旧版帧格式
+// 握手期间暂停普通帧，保证重连后对端收到的第一帧是握手
+func (m *MuxManager) handshake(ready chan struct{}) {
+	defer func() {
+		m.discarding.Store(false)
+		m.mu.Lock()
+		m.handshaking = false
+		again := m.rehello
+		m.rehello = false
+		m.mu.Unlock()
+		m.sched.setPaused(false)
+		close(ready)
+		if again {
+			m.startHandshake()
+		}
+	}()
+	m.sched.setPaused(true)
+
+	hello := proto.Hello{Version: proto.Version, Features: proto.Features, MaxFrame: maxReadPayload, SessionID: m.sessionID}
+	for {
+		// 丢弃上一次握手残留的回复
+		select {
+		case <-m.helloCh:
+		default:
+		}
+		select {
+		case <-m.resumeCh:
+		default:
+		}
+		errs := m.linkErrs.Load()
+		// ConnectBT 在未连接时第一次写入会触发重连并返回错误，这里重试直到写成功
+		if err := m.sched.sendUrgent(proto.HelloID, raw(hello.Marshal())); err != nil {
+			time.Sleep(time.Second * 2)
+			continue
+		}
+
+		select {
+		case peer := <-m.helloCh:
+			m.features.Store(proto.Features & peer.Features)
+			m.peerMaxFrame.Store(peer.MaxFrame)
+			if peer.Version != proto.Version {
+				fmt.Printf("警告: 协议版本不一致，本端 %d，对端 %d，按双方共同支持的特性工作\n", proto.Version, peer.Version)
+			}
+			fmt.Printf("握手完成: 对端版本 %d, 特性 %#x, 最大帧 %d, 帧格式 %v\n", peer.Version, m.features.Load(), peer.MaxFrame, m.wire())
+			if m.has(proto.FeatResume) && peer.Flags&proto.HelloResumed != 0 && peer.SessionID == m.sessionID {
+				if !m.resume(errs) {
+					// 恢复过程中链路出错或帧损坏，重新握手
+					continue
+				}
+			} else {
+				m.dropStreams()
+				// 对端是全新的会话，之前的监听也不存在了
+				m.relisten()
+			}
+			return
+		case <-time.After(helloTimeout):
+			if m.linkErrs.Load() != errs {
+				// 握手期间链路又断了，重连后再来一次
+				continue
+			}
+			m.features.Store(0)
+			m.peerMaxFrame.Store(0)
+			fmt.Printf("警告: 对端未响应握手，可能是旧版本，回退到旧版帧格式\n")
+			m.dropStreams()
+			return
+		}
+	}
+}
+
+// waitReady 等待当前握手完成
+func (m *MuxManager) waitReady(ctx context.Context) error {
+	m.mu.RLock()
+	ready := m.ready
+	m.mu.RUnlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// has 判断握手是否协商出了某个特性
+func (m *MuxManager) has(feature uint32) bool {
+	return m.features.Load()&feature != 0
+}
+
+// Features 返回协商出的特性位，未握手或旧版本对端为 0
+func (m *MuxManager) Features() uint32 {
+	return m.features.Load()
+}
+
+// messageLimit 返回数据报流单帧的最大负载：一条消息整帧发出，不受 maxWritePayload 限制
+func (m *MuxManager) messageLimit() int {
+	limit := m.wire().MaxPayload()
+	if peer := int(m.peerMaxFrame.Load()); peer > 0 && peer < limit {
+		return peer
+	}
+	return limit
+}
+
+// frameLimit 返回发往对端的单帧最大负载
+func (m *MuxManager) frameLimit() int {
+	limit := min(maxWritePayload, m.wire().MaxPayload())
+	if peer := int(m.peerMaxFrame.Load()); peer > 0 && peer < limit {
+		return peer
+	}
+	return limit
+}
@@ -0,0 +1,196 @@
+package comm
+
+import (
+	"bufio"
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// StartHTTPProxy 启动 HTTP 代理，支持 CONNECT 隧道和绝对 URI 的普通 HTTP 请求
+func StartHTTPProxy(mux *MuxManager, addr string) {
+	StartHTTPProxyAuth(mux, addr, nil)
+}
+
+// StartHTTPProxyAuth 启动 HTTP 代理，users 非空时要求 Proxy-Authorization (Basic) 认证
+func StartHTTPProxyAuth(mux *MuxManager, addr string, users []ProxyUser) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("HTTP 代理监听失败: %v", err)
+	}
+	log.Printf("HTTP 代理服务器启动在 %s", addr)
+	stopChans.Store(addr, listener)
+	if err := newHTTPServer(mux, users).Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("HTTP 代理退出: %v", err)
+	}
+}
+
+func newHTTPServer(mux *MuxManager, users []ProxyUser) *http.Server {
+	return &http.Server{
+		Handler:           newHTTPProxy(mux, users),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// httpProxy 处理代理请求，与目标的连接都经由 Mux 流建立
+type httpProxy struct {
+	mux   *MuxManager
+	users []ProxyUser
+	// 普通 HTTP 请求的转发器，会去掉逐跳头部并复用到同一目标的流
+	forward *httputil.ReverseProxy
+}
+
+func newHTTPProxy(mux *MuxManager, users []ProxyUser) *httpProxy {
+	p := &httpProxy{mux: mux, users: users}
+	transport := &http.Transport{
+		// 不能再套用环境变量里的代理
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, openTimeout)
+			defer cancel()
+			v, err := mux.OpenStreamContext(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newStreamConn(v, addr), nil
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	p.forward = &httputil.ReverseProxy{
+		// 请求本身就是绝对 URI，原样转发；Rewrite 不会添加 X-Forwarded-For
+		Rewrite:   func(r *httputil.ProxyRequest) {},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("HTTP 代理请求 %s 失败: %v", r.URL, err)
+			w.WriteHeader(httpStatus(err))
+		},
+	}
+	return p
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="btProxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+			// 不是发给代理的请求，https 需要走 CONNECT
+			http.Error(w, "absolute http:// URI required", http.StatusBadRequest)
+			return
+		}
+		target = r.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		if r.Method == http.MethodConnect {
+			http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+			return
+		}
+		target = net.JoinHostPort(strings.Trim(target, "[]"), "80")
+	}
+	if user != nil && !user.Allowed(target) {
+		log.Printf("HTTP 代理用户 %s 不允许访问 %s", user.Username, target)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.connect(w, r, target)
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+// authenticate 校验 Proxy-Authorization，未配置用户时直接通过
+func (p *httpProxy) authenticate(r *http.Request) (*ProxyUser, bool) {
+	if len(p.users) == 0 {
+		return nil, true
+	}
+	scheme, encoded, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, false
+	}
+	name, password, _ := strings.Cut(string(decoded), ":")
+	user := lookupUser(p.users, name)
+	if user == nil || !user.CheckPassword(password) {
+		log.Printf("HTTP 代理用户 %q 认证失败: %s", name, r.RemoteAddr)
+		return nil, false
+	}
+	return user, true
+}
+
+// connect 建立 CONNECT 隧道，拿到服务端拨号结果后才回复客户端
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request, target string) {
+	ctx, cancel := context.WithTimeout(r.Context(), openTimeout)
+	stream, err := p.mux.OpenStreamContext(ctx, target)
+	cancel()
+	if err != nil {
+		log.Printf("HTTP CONNECT %s 失败: %v", target, err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	defer stream.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("HTTP CONNECT 接管连接失败: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	relay(&bufferedConn{Conn: conn, r: rw.Reader}, stream)
+	log.Printf("HTTP CONNECT 隧道关闭: %s -> %s", r.RemoteAddr, target)
+}
+
+// httpStatus 把打开流的错误转换为 HTTP 状态码
+func httpStatus(err error) int {
+	var openErr *OpenError
+	if errors.As(err, &openErr) && openErr.Code == proto.OpenDenied {
+		return http.StatusForbidden
+	}
+	if errors.As(err, &openErr) && openErr.Code == proto.OpenTimeout || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// bufferedConn 接管连接后先读出 http.Server 已经缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package comm
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"fmt"
+	"time"
+)
+
+// 心跳默认参数：每 15 秒一次，连续 3 个周期收不到任何数据视为链路已死
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultKeepaliveMisses   = 3
+)
+
+// reconnecter 由支持主动重连的物理连接实现，例如 Transport
+type reconnecter interface {
+	Reconnect()
+}
+
+// SetKeepalive 设置心跳间隔和允许连续丢失的次数，interval <= 0 表示关闭心跳
+func (m *MuxManager) SetKeepalive(interval time.Duration, misses int) {
+	if misses <= 0 {
+		misses = DefaultKeepaliveMisses
+	}
+	m.keepaliveInterval.Store(int64(interval))
+	m.keepaliveMisses.Store(int32(misses))
+}
+
+// RTT 返回最近一次心跳测得的往返时延，尚未测得时为 0
+func (m *MuxManager) RTT() time.Duration {
+	return time.Duration(m.rtt.Load())
+}
+
+// keepaliveLoop 空闲时定期 PING，对端长时间没有任何回应时强制重连
+func (m *MuxManager) keepaliveLoop() {
+	for {
+		interval := time.Duration(m.keepaliveInterval.Load())
+		if interval <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(interval)
+		// 旧版本对端不会回复 PONG，握手中也不发送
+		if !m.has(proto.FeatKeepalive) {
+			continue
+		}
+		m.mu.RLock()
+		handshaking := m.handshaking
+		m.mu.RUnlock()
+		if handshaking {
+			continue
+		}
+
+		misses := time.Duration(m.keepaliveMisses.Load())
+		idle := time.Since(time.Unix(0, m.lastRecv.Load()))
+		if idle > interval*misses {
+			fmt.Printf("警告: %v 未收到对端任何数据，链路可能已断开，强制重连\n", idle.Round(time.Second))
+			m.lastRecv.Store(time.Now().UnixNano())
+			if r, ok := m.physical.(reconnecter); ok {
+				r.Reconnect()
+			} else {
+				m.physical.Close()
+			}
+			continue
+		}
+		sent := time.Now().UnixNano()
+		m.writePacket(func(w proto.Wire) []byte { return w.PingFrame(sent) })
+	}
+}
+
+// handlePing 回复对端的 PING，或用 PONG 计算往返时延
+func (m *MuxManager) handlePing(cmd byte, args []byte) {
+	switch cmd {
+	case proto.CmdPing:
+		m.sched.postControl(control(0, proto.CmdPong, args...))
+	case proto.CmdPong:
+		if sent, ok := proto.ParsePong(args); ok {
+			m.rtt.Store(time.Now().UnixNano() - sent)
+		}
+	}
+}
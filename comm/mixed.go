@@ -0,0 +1,91 @@
+package comm
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// StartMixedProxy 在一个端口上同时提供 SOCKS5、SOCKS4/4a 和 HTTP 代理，按每个连接的第一个字节区分
+// users 非空时 SOCKS5 和 HTTP 要求认证，SOCKS4 无法认证因而被拒绝
+func StartMixedProxy(mux *MuxManager, addr string, users []ProxyUser) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("混合代理监听失败: %v", err)
+	}
+	log.Printf("混合代理服务器启动在 %s (SOCKS5/SOCKS4/HTTP)", addr)
+	stopChans.Store(addr, listener)
+
+	// HTTP 连接交给同一个 http.Server，以便复用保活和逐跳头部处理
+	httpConns := newConnListener(listener.Addr())
+	defer httpConns.Close()
+	go newHTTPServer(mux, users).Serve(httpConns)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("接受连接失败: %v", err)
+			continue
+		}
+		go func() {
+			br := bufio.NewReader(conn)
+			first, err := br.Peek(1)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			c := &bufferedConn{Conn: conn, r: br}
+			switch first[0] {
+			case 0x05:
+				handleSocksConnection(c, mux, users)
+			case 0x04:
+				handleSocks4Connection(c, mux, users)
+			default:
+				httpConns.push(c)
+			}
+		}()
+	}
+}
+
+// connListener 把外部接受的连接交给 http.Server
+type connListener struct {
+	addr net.Addr
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, ch: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.ch <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
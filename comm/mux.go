@@ -2,69 +2,166 @@ package comm
 
 import (
 	"bytes"
+	"context"
+	"dosgo/btProxy/comm/framing"
+	"dosgo/btProxy/comm/proto"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrStreamReset  = errors.New("流已被对端重置")
+	ErrStreamClosed = errors.New("流已关闭")
+
+	ErrDatagramUnsupported = errors.New("对端不支持 UDP 数据报流")
+	ErrDNSUnsupported      = errors.New("对端不支持 DNS 解析流")
+	ErrNoStreamID          = errors.New("流ID 已用完")
+)
+
+// openTimeout 是 OpenStream 等待服务端拨号结果的默认时长
+const openTimeout = 10 * time.Second
+
+// OpenError 表示服务端拨号失败，Code 为 proto.Open* 结果码
+type OpenError struct {
+	Addr string
+	Code byte
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("打开 %s 失败: %s", e.Addr, proto.OpenCodeText(e.Code))
+}
+
 var writeBufferPool = sync.Pool{
 	New: func() interface{} {
-		// 预分配一个足够大的缓冲区（例如 16KB）
-		return make([]byte, 33*1024)
+		// 预分配一个能容纳包头和 maxWritePayload 负载的缓冲区，更大的控制帧临时分配
+		return make([]byte, maxWritePayload+16)
 	},
 }
 
+// maxWritePayload 单个数据帧的最大负载，超过的写入会被拆成多帧
+// 帧越小，调度器在大流量流之间插入交互式流的粒度越细
+const maxWritePayload = 8 * 1024
+
+// maxReadPayload 本端能接收的最大帧负载，握手时告知对端
+// 对端还受帧格式的限制，v1 的长度字段最大 0xFFFF
+const maxReadPayload = 256 * 1024
+
+// legacyRecvLimit 旧版本对端不遵守流控时每个流最多缓存的数据量
+const legacyRecvLimit = 16 * 1024 * 1024
+
 var readPool = sync.Pool{
-	New: func() interface{} { return make([]byte, 10*1024) }, // 预设最大包大小
+	New: func() interface{} { return make([]byte, maxReadPayload) }, // 预设最大包大小
 }
 
 // MuxManager 负责管理那个唯一的蓝牙物理连接
 type MuxManager struct {
 	physical        io.ReadWriteCloser
-	streams         map[uint16]chan []byte // 每个ID对应一个数据管道
+	streams         map[uint32]*VirtualConn // 每个ID对应一个虚拟连接
 	streamsLastTime sync.Map
 	mu              sync.RWMutex
-	writeMu         sync.Mutex // 物理写锁，保证Header和Data不被拆散
-	lastID          uint16
+	sched           *writeScheduler // 唯一的物理写端，保证Header和Data不被拆散
+	lastID          uint32
+	listeners       map[uint32]*RemoteListener // 反向转发监听，监听ID -> 监听，由 mu 保护
+	lastListenerID  uint16
+
+	features     atomic.Uint32    // 握手协商出的特性位
+	peerMaxFrame atomic.Uint32    // 对端能接收的最大帧负载，0 表示未知
+	helloCh      chan proto.Hello // readLoop 收到的握手回复
+	ready        chan struct{}    // 当前握手完成后关闭，由 mu 保护
+	handshaking  bool             // 由 mu 保护
+
+	keepaliveInterval atomic.Int64 // 心跳间隔，time.Duration
+	keepaliveMisses   atomic.Int32 // 允许连续丢失的心跳周期数
+	lastRecv          atomic.Int64 // 最近一次收到任意帧的时间，UnixNano
+	rtt               atomic.Int64 // 最近一次心跳往返时延，time.Duration
+
+	sessionID  uint64                   // 本会话的随机ID，重连后凭它接回服务端保留的流
+	resumeCh   chan []proto.ResumeEntry // readLoop 收齐的对端恢复报告
+	resumeBuf  []proto.ResumeEntry      // 拼接中的恢复报告，只在 readLoop 中访问
+	linkErrs   atomic.Uint32            // 链路出错次数，握手据此判断是否需要重来
+	rehello    bool                     // 握手期间又要求重新同步，结束后再握手一次，由 mu 保护
+	discarding atomic.Bool              // 收到损坏的帧后丢弃数据帧和 FIN，直到收到对端握手回复
 }
 
 func NewMuxManager(p io.ReadWriteCloser) *MuxManager {
 	m := &MuxManager{
-		physical: p,
-		streams:  make(map[uint16]chan []byte),
+		physical:  p,
+		streams:   make(map[uint32]*VirtualConn),
+		listeners: make(map[uint32]*RemoteListener),
+		helloCh:   make(chan proto.Hello, 1),
+		sessionID: newSessionID(),
+		resumeCh:  make(chan []proto.ResumeEntry, 1),
 	}
+	m.sched = newWriteScheduler(p, m.wire, m.writeFailed)
+	m.SetKeepalive(DefaultKeepaliveInterval, DefaultKeepaliveMisses)
+	m.lastRecv.Store(time.Now().UnixNano())
+	m.startHandshake()
 	go m.readLoop() // 启动后台“拆包”协程
 	go m.checkActive()
+	go m.keepaliveLoop()
 	return m
 }
 
-func (m *MuxManager) nextID() uint16 {
+// addStream 为 v 分配一个未使用的流ID 并登记，ID 回绕后跳过仍在使用的流
+func (m *MuxManager) addStream(v *VirtualConn) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.lastID++
-	if m.lastID == 0 { // 绕过 0，通常 0 保留给控制帧
-		m.lastID = 1
+	w := m.wire()
+	limit := w.IDLimit()
+	if m.has(proto.FeatReverse) {
+		// 不小于 ServerStreamBase 的ID 留给服务端打开的反向转发流
+		limit = w.ServerStreamBase()
+	}
+	for i := uint32(1); i < limit; i++ {
+		m.lastID++
+		if m.lastID == 0 || m.lastID >= limit { // 绕过 0，通常 0 保留给控制帧
+			m.lastID = 1
+		}
+		if _, used := m.streams[m.lastID]; used || m.lastID == proto.HelloID {
+			continue
+		}
+		v.id = m.lastID
+		m.streams[v.id] = v
+		return nil
 	}
-	return m.lastID
+	return ErrNoStreamID
 }
 
 // readLoop 在底层做手脚：解析 ID，把数据塞进正确的通道
 func (m *MuxManager) readLoop() {
-	header := make([]byte, 4) // 1字节ID + 2字节长度
+	header := make([]byte, 4)
+	// 收到对端的握手回复后按协商出的格式解析之后的帧，重连后的链路从 v1 开始
+	wire := proto.WireV1
 	for {
-		if _, err := io.ReadFull(m.physical, header); err != nil {
+		id, dataLen, err := wire.ReadHeader(m.physical, header)
+		if err != nil {
+			if errors.Is(err, framing.ErrCorruptFrame) {
+				m.corrupted()
+				continue
+			}
+			if err == proto.ErrFrameTooLarge {
+				fmt.Printf("数据帧长度错误\n")
+				m.physical.Close()
+				time.Sleep(time.Second * 1)
+				continue
+			}
 			fmt.Printf("Mux读取头部失败: %v，等待重试...\n", err)
+			// 重连后需要重新握手，可恢复时接回原有会话
+			wire = proto.WireV1
+			m.linkErrs.Add(1)
+			m.startHandshake()
 			time.Sleep(time.Second * 2)
 			continue // 不要 return，继续循环等待 ConnectBT 重连成功
 		}
-
-		id := binary.BigEndian.Uint16(header[0:2])
-		dataLen := binary.BigEndian.Uint16(header[2:4])
-		if dataLen > 1024*10 {
+		if dataLen > maxReadPayload {
 			fmt.Printf("数据帧长度错误: %d\n", dataLen)
 			m.physical.Close()
 			time.Sleep(time.Second * 1)
@@ -76,111 +173,347 @@ func (m *MuxManager) readLoop() {
 
 		//fmt.Printf("id:%d dataLen:%d payloadLen:%d\r\n", id, dataLen, len(payload))
 		if _, err := io.ReadFull(m.physical, payload[:dataLen]); err != nil {
+			readPool.Put(payload)
+			if errors.Is(err, framing.ErrCorruptFrame) {
+				m.corrupted()
+				continue
+			}
 			fmt.Printf("Mux读取载荷失败: %v\n", err)
+			wire = proto.WireV1
+			m.linkErrs.Add(1)
+			m.startHandshake()
 			continue
 		}
+		m.lastRecv.Store(time.Now().UnixNano())
 
-		m.mu.RLock()
-		if ch, ok := m.streams[id]; ok {
-			m.streamsLastTime.Store(id, time.Now().Unix())
-			select {
-			case ch <- payload[:dataLen]:
-				// 成功
-			case <-time.After(time.Millisecond * 200):
-				// 半秒钟还没发进去，说明这个流彻底堵死了，关闭或记录错误
-				fmt.Printf("警告: 流 %d 阻塞超时，丢弃数据包\r\n", id)
+		if m.discarding.Load() && id != proto.HelloID && discardable(wire, id, payload[:dataLen]) {
+			readPool.Put(payload)
+			continue
+		}
+		if id == 0 {
+			m.handleControl(wire, payload[:dataLen])
+			readPool.Put(payload)
+			continue
+		}
+		if id == proto.HelloID {
+			// 对端的握手回复之后才是按恢复报告重传的数据
+			m.discarding.Store(false)
+			if hello, ok := proto.ParseHello(payload[:dataLen]); ok {
+				// 对端从回复之后的下一帧起使用新格式，必须在读下一帧前切换
+				wire = proto.WireFor(proto.Features & hello.Features)
+				select {
+				case m.helloCh <- hello:
+				default:
+				}
 			}
+			readPool.Put(payload)
+			continue
 		}
+
+		m.mu.RLock()
+		v, ok := m.streams[id]
 		m.mu.RUnlock()
+		if !ok {
+			// 本地已经没有这个流了，通知对端关闭对应的连接
+			readPool.Put(payload)
+			if m.has(proto.FeatStreamClose) {
+				m.sched.postControl(control(id, proto.CmdRst))
+			}
+			continue
+		}
+		m.streamsLastTime.Store(id, time.Now().Unix())
+		// 对端遵守接收窗口时缓冲区不会溢出，这里永不阻塞，慢速的流不会拖住其他流
+		if !v.recv.Push(payload[:dataLen]) {
+			fmt.Printf("流 %d 超出接收窗口，重置\n", id)
+			m.resetStream(v)
+		} else {
+			v.received.Add(uint64(dataLen))
+		}
+		readPool.Put(payload)
 	}
 }
 
-// OpenStream 是关键：它返回一个类似流的对象，侵入性极小
-func (m *MuxManager) OpenStream(remoteAddr string) io.ReadWriteCloser {
-	id := m.nextID()
-	ch := make(chan []byte, 1024)
+// resetStream 本地重置流并通知对端，在 readLoop 中调用，不等待发送完成
+func (m *MuxManager) resetStream(v *VirtualConn) {
 	m.mu.Lock()
-	m.streams[id] = ch
+	if m.streams[v.id] != v {
+		m.mu.Unlock()
+		return
+	}
+	v.abortLocked(ErrStreamReset)
+	delete(m.streams, v.id)
 	m.mu.Unlock()
-	host, portStr, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		return nil
+	m.sched.release(v.id, ErrStreamReset)
+	if m.has(proto.FeatStreamClose) {
+		m.sched.postControl(control(v.id, proto.CmdRst))
 	}
-	port, _ := strconv.Atoi(portStr)
+}
 
-	payload := new(bytes.Buffer)
-	binary.Write(payload, binary.BigEndian, id)
-	// 解析 IP 地址
-	ip := net.ParseIP(host)
-	if ip != nil {
-		//id
-		// 判断是 IPv4 还是 IPv6
-		if ip4 := ip.To4(); ip4 != nil {
-			payload.WriteByte(0x01)
-			// IPv4: 2(id) + 4(ip) + 2(port) = 8 bytes
-			payload.Write(ip4)
-		} else {
-			// IPv6: 2(id) + 16(ip) + 2(port) = 20 bytes (注：有些协议习惯对齐，这里按实长 20 字节)
-			payload.WriteByte(0x02)
-			payload.Write(ip.To16())
+// handleControl 处理对端发来的 FIN/RST/打开结果/窗口更新等控制命令
+func (m *MuxManager) handleControl(w proto.Wire, data []byte) {
+	id, cmd, args, ok := w.ParseControl(data)
+	if !ok {
+		fmt.Printf("未知的控制帧: %x\n", data)
+		return
+	}
+	switch cmd {
+	case proto.CmdPing, proto.CmdPong:
+		m.handlePing(cmd, args)
+		return
+	case proto.CmdResume:
+		m.handleResume(w, args)
+		return
+	case proto.CmdResync:
+		fmt.Printf("对端丢弃了损坏的帧，重新同步\n")
+		m.requestResync()
+		return
+	case proto.CmdListenReply:
+		m.handleListenReply(id, args)
+		return
+	case proto.CmdAccept:
+		m.handleAccept(w, id, args)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.streams[id]
+	if !ok {
+		return
+	}
+	switch cmd {
+	case proto.CmdFin:
+		// 对端不会再发数据，读完缓冲后收到 EOF，写端保持可用
+		v.readClosed = true
+		v.recv.CloseWrite()
+		if v.writeClosed {
+			delete(m.streams, id)
+			m.sched.release(id, nil)
+		}
+	case proto.CmdRst:
+		v.reset = true
+		v.abortLocked(ErrStreamReset)
+		delete(m.streams, id)
+		m.sched.release(id, ErrStreamReset)
+		select {
+		case v.openCh <- proto.OpenFailure:
+		default:
+		}
+	case proto.CmdOpenReply:
+		code := proto.OpenFailure
+		if len(args) > 0 {
+			code = args[0]
+		}
+		if code != proto.OpenSuccess {
+			// 拨号失败，服务端不会再保留这个流
+			v.abortLocked(ErrStreamReset)
+			delete(m.streams, id)
+			m.sched.release(id, ErrStreamReset)
+		}
+		select {
+		case v.openCh <- code:
+		default:
+		}
+	case proto.CmdWindowUpdate:
+		if delta, ok := proto.ParseWindowUpdate(args); ok {
+			v.sendWin.Add(delta)
+			// 对端已消费的数据不会再需要重传
+			v.replay.Ack(v.peerGranted.Add(uint64(delta)) - proto.InitialWindow)
 		}
-	} else {
-		//域名
-		payload.WriteByte(0x03)
-		payload.Write([]byte(host))
 	}
-	//port
-	binary.Write(payload, binary.BigEndian, uint16(port))
+}
 
-	//包头的id是0表示新连接
-	if _, err := m.writePacket(0, payload.Bytes()); err != nil {
+func (m *MuxManager) sendControl(id uint32, cmd byte) error {
+	return m.writePacket(control(id, cmd))
+}
+
+// OpenStream 是关键：它返回一个类似流的对象，侵入性极小
+// 失败时返回 nil，需要具体原因请使用 OpenStreamContext
+func (m *MuxManager) OpenStream(remoteAddr string) *VirtualConn {
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	defer cancel()
+	v, err := m.OpenStreamContext(ctx, remoteAddr)
+	if err != nil {
+		fmt.Printf("打开流失败: %v\n", err)
 		return nil
 	}
-	return &VirtualConn{id: id, manager: m, readCh: ch}
+	return v
+}
+
+// OpenStreamContext 发送打开请求并阻塞到服务端回复拨号结果或 ctx 结束
+// 服务端拨号失败时返回 *OpenError
+func (m *MuxManager) OpenStreamContext(ctx context.Context, remoteAddr string) (*VirtualConn, error) {
+	return m.openStream(ctx, remoteAddr, 0)
+}
+
+// OpenCompressedStreamContext 与 OpenStreamContext 相同，但请求压缩该流的两个方向，
+// 适合 HTTP 接口、日志、串口控制台等文本流量；对端不支持时退回不压缩
+func (m *MuxManager) OpenCompressedStreamContext(ctx context.Context, remoteAddr string) (*VirtualConn, error) {
+	if err := m.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	if !m.has(proto.FeatCompress) {
+		return m.openStream(ctx, remoteAddr, 0)
+	}
+	return m.openStream(ctx, remoteAddr, proto.OpenCompress)
 }
 
-func (m *MuxManager) writePacket(id uint16, data []byte) (int, error) {
-	m.writeMu.Lock()
-	defer m.writeMu.Unlock()
+// OpenDatagramContext 打开一个承载 UDP 数据报的流，读写的内容是 proto.WriteDatagram 格式的消息
+// 每次 Write 必须是一条完整的消息，作为一个数据帧发出
+// 服务端为每个这样的流分配一个 UDP 端口，remoteAddr 只是提示，每条消息自带目的地址
+func (m *MuxManager) OpenDatagramContext(ctx context.Context, remoteAddr string) (*VirtualConn, error) {
+	if err := m.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	if !m.has(proto.FeatDatagram) {
+		return nil, ErrDatagramUnsupported
+	}
+	return m.openStream(ctx, remoteAddr, proto.OpenDatagram)
+}
 
-	// 高性能优化：使用固定数组减少内存分配
-	dataLen := len(data)
-	//buf := make([]byte, 4+dataLen)
+// OpenDatagramConn 打开数据报流并包装成 net.PacketConn，每次读写一个完整的数据报
+func (m *MuxManager) OpenDatagramConn(ctx context.Context, remoteAddr string) (*proto.DatagramConn, error) {
+	v, err := m.OpenDatagramContext(ctx, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	return proto.NewDatagramConn(v, muxAddr("local")), nil
+}
 
-	buf := writeBufferPool.Get().([]byte)
-	defer writeBufferPool.Put(buf) // 发完记得还回去
+// OpenDNSContext 打开一个由服务端解析 DNS 查询的流，格式见 proto.OpenDNS
+func (m *MuxManager) OpenDNSContext(ctx context.Context) (*VirtualConn, error) {
+	if err := m.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	if !m.has(proto.FeatDNS) {
+		return nil, ErrDNSUnsupported
+	}
+	return m.openStream(ctx, "dns:53", proto.OpenDNS)
+}
 
-	binary.BigEndian.PutUint16(buf[0:2], id)
-	binary.BigEndian.PutUint16(buf[2:4], uint16(dataLen))
-	copy(buf[4:], data)
-	m.streamsLastTime.Store(id, time.Now().Unix())
-	_, err := m.physical.Write(buf[:4+dataLen])
+// openStream 发送打开请求，kind 为打开帧地址类型上的标志位
+func (m *MuxManager) openStream(ctx context.Context, remoteAddr string, kind byte) (*VirtualConn, error) {
+	host, portStr, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	// 握手完成前不发送任何数据
+	if err := m.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	v := m.newVirtualConn(0)
+	v.datagram = kind&proto.OpenDatagram != 0
+	if kind&proto.OpenCompress != 0 {
+		v.enableCompression()
+	}
+	if err := m.addStream(v); err != nil {
+		return nil, err
+	}
+	id := v.id
+	port, _ := strconv.Atoi(portStr)
+
+	open := func(w proto.Wire) []byte {
+		payload := bytes.NewBuffer(w.AppendID(nil, id))
+		// 解析 IP 地址
+		ip := net.ParseIP(host)
+		if ip != nil {
+			// 判断是 IPv4 还是 IPv6
+			if ip4 := ip.To4(); ip4 != nil {
+				// IPv4: id + 4(ip) + 2(port)
+				payload.WriteByte(proto.AddrIPv4 | kind)
+				payload.Write(ip4)
+			} else {
+				// IPv6: id + 16(ip) + 2(port)
+				payload.WriteByte(proto.AddrIPv6 | kind)
+				payload.Write(ip.To16())
+			}
+		} else {
+			//域名
+			payload.WriteByte(proto.AddrDomain | kind)
+			payload.Write([]byte(host))
+		}
+		//port
+		binary.Write(payload, binary.BigEndian, uint16(port))
+		return payload.Bytes()
+	}
+
+	//包头的id是0表示新连接
+	if err := m.writePacket(open); err != nil {
+		m.mu.Lock()
+		delete(m.streams, id)
+		m.mu.Unlock()
+		return nil, err
+	}
+	if !m.has(proto.FeatOpenReply) {
+		// 旧版本对端不会回复拨号结果
+		return v, nil
+	}
+
+	select {
+	case code := <-v.openCh:
+		if code != proto.OpenSuccess {
+			return nil, &OpenError{Addr: remoteAddr, Code: code}
+		}
+		return v, nil
+	case <-ctx.Done():
+		// 放弃等待，通知服务端拨号完成后立即关闭
+		v.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// newVirtualConn 按协商出的特性创建流的本地状态，调用方负责登记到 streams
+func (m *MuxManager) newVirtualConn(id uint32) *VirtualConn {
+	v := &VirtualConn{
+		id:      id,
+		manager: m,
+		openCh:  make(chan byte, 1),
+	}
+	v.granted.Store(proto.InitialWindow)
+	v.peerGranted.Store(proto.InitialWindow)
+	if m.has(proto.FeatFlowControl) {
+		v.recv = proto.NewRecvBuffer(proto.InitialWindow)
+		v.sendWin = proto.NewWindow(proto.InitialWindow)
+	} else {
+		// 旧版本对端没有流控，发送不设限
+		v.recv = proto.NewRecvBuffer(legacyRecvLimit)
+		v.sendWin = proto.NewWindow(math.MaxInt)
 	}
+	return v
+}
+
+// writePacket 发送控制帧，优先于所有数据帧
+func (m *MuxManager) writePacket(data payload) error {
+	return m.sched.sendControl(data, nil)
+}
 
-	// 3. 关键点：返回调用方期望的长度，即 data 的原始长度
-	// 这样上层 (如 io.Copy) 才会认为这批数据已完整处理
-	return dataLen, nil
+// wire 返回当前协商出的帧格式，握手完成后才会改变
+func (m *MuxManager) wire() proto.Wire {
+	return proto.WireFor(m.features.Load())
 }
 
 func (m *MuxManager) checkActive() {
 
 	for {
+		var expired []uint32
 		m.mu.Lock()
-		for id := range m.streams {
+		for id, v := range m.streams {
 			if value, ok := m.streamsLastTime.Load(id); ok {
 				lastTime := value.(int64)
 				if lastTime+120 < time.Now().Unix() && lastTime > 0 {
-					if ch, ok := m.streams[id]; ok {
-						fmt.Printf("close id:%d\r\n", id)
-						close(ch)
-						delete(m.streams, id)
-					}
+					fmt.Printf("close id:%d\r\n", id)
+					v.abortLocked(ErrStreamClosed)
+					delete(m.streams, id)
+					m.sched.release(id, ErrStreamClosed)
+					expired = append(expired, id)
 				}
 			}
 		}
 		m.mu.Unlock()
+		if m.has(proto.FeatStreamClose) {
+			for _, id := range expired {
+				m.sendControl(id, proto.CmdRst)
+			}
+		}
 		time.Sleep(time.Second * 30)
 	}
 }
@@ -193,50 +526,267 @@ func (m *MuxManager) CloseBt() {
 }
 
 // VirtualConn 实现了 io.ReadWriteCloser，业务代码可以直接 io.Copy 它
+// 以下状态字段均由 manager.mu 保护
 type VirtualConn struct {
-	id       uint16
-	manager  *MuxManager
-	readCh   chan []byte
-	cacheBuf []byte // 新增：用于暂存未读完的数据
+	id          uint32
+	manager     *MuxManager
+	recv        *proto.RecvBuffer // 对端发来的数据，大小受接收窗口约束
+	sendWin     *proto.Window     // 对端给出的发送额度
+	openCh      chan byte         // 服务端回复的打开结果码
+	readClosed  bool              // 已收到 FIN/RST 或本地已关闭
+	writeClosed bool              // 已发送 FIN/RST，不能再写
+	reset       bool              // 被对端 RST
+	priority    atomic.Int32      // 发送调度权重
+	datagram    bool              // 数据报流，每次 Write 是一条完整的消息，见 writeDatagram
+
+	wmu sync.Mutex // 保证本流的数据帧与 FIN 按顺序进入发送队列
+
+	ackMu   sync.Mutex
+	unacked int // 已被读取、尚未通过 WINDOW_UPDATE 归还给对端的字节数
+
+	// 会话恢复用的序号：字节偏移即序号，均在帧真正写出或收到时更新
+	replay      proto.Replay  // 已写出、对端尚未确认消费的数据
+	received    atomic.Uint64 // 已收到的对端数据总字节数
+	granted     atomic.Uint64 // 已授予对端的额度总数
+	peerGranted atomic.Uint64 // 对端授予本端的额度总数
+	finWritten  atomic.Bool   // FIN 已写出
+
+	// 压缩流的两个方向，未压缩的流为 nil，见 proto.Compressor
+	deflate *proto.Compressor
+	inflate *proto.Decompressor
+	cmu     sync.Mutex // 保证压缩的顺序与发送的顺序一致
+}
+
+// abortLocked 立即终止两个方向，调用方需持有 manager.mu 写锁
+func (v *VirtualConn) abortLocked(err error) {
+	v.readClosed = true
+	v.writeClosed = true
+	v.recv.Reset(err)
+	v.sendWin.Close()
+	if v.deflate != nil {
+		v.deflate.Close()
+	}
+}
+
+// enableCompression 按 OpenCompress 协商的结果压缩本流，需在收发数据之前调用
+func (v *VirtualConn) enableCompression() {
+	v.deflate = new(proto.Compressor)
+	v.inflate = proto.NewDecompressor(rawStream{v})
+}
+
+// rawStream 读取本流收到的原始字节，供解压使用
+type rawStream struct {
+	v *VirtualConn
+}
+
+func (r rawStream) Read(p []byte) (int, error) {
+	return r.v.readRaw(p)
+}
+
+// writeErr 返回当前不可写的原因
+func (v *VirtualConn) writeErr() error {
+	v.manager.mu.RLock()
+	defer v.manager.mu.RUnlock()
+	if v.reset {
+		return ErrStreamReset
+	}
+	if v.writeClosed {
+		return ErrStreamClosed
+	}
+	return nil
 }
 
 func (v *VirtualConn) Write(p []byte) (int, error) {
+	if v.datagram {
+		return v.writeDatagram(p)
+	}
+	if v.deflate == nil {
+		return v.writeRaw(p)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	v.cmu.Lock()
+	defer v.cmu.Unlock()
+	if _, err := v.writeRaw(v.deflate.Compress(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeRaw 按额度把 p 拆成数据帧发出，压缩流的 p 是压缩后的字节
+func (v *VirtualConn) writeRaw(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		// 额度用完时在这里阻塞，直到对端读走数据并归还额度
+		n := v.sendWin.Acquire(min(len(p)-written, v.manager.frameLimit()))
+		if n == 0 {
+			return written, v.writeErr()
+		}
+		if err := v.sendData(p[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// writeDatagram 把一条数据报消息作为一个数据帧发出，超过单帧上限时返回 proto.ErrDatagramTooLarge
+// 发送额度不够整条消息时像 UDP 一样丢弃，不等待对端归还额度
+func (v *VirtualConn) writeDatagram(p []byte) (int, error) {
+	if len(p) > v.manager.messageLimit() {
+		return 0, proto.ErrDatagramTooLarge
+	}
+	ok, err := v.sendWin.TryAcquire(len(p))
+	if err != nil {
+		return 0, v.writeErr()
+	}
+	if !ok {
+		return len(p), nil
+	}
+	if err := v.sendData(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sendData 经由本流的发送队列写出一个数据帧
+func (v *VirtualConn) sendData(data []byte) error {
+	// 持有写锁再检查状态，保证 FIN/RST 之后不会再有数据帧发出
+	v.wmu.Lock()
+	defer v.wmu.Unlock()
+	if err := v.writeErr(); err != nil {
+		return err
+	}
+	v.manager.streamsLastTime.Store(v.id, time.Now().Unix())
+	// 调度器不等帧写出就返回，调用方随后可能复用 p，这里复制一份
+	data = append([]byte(nil), data...)
 	//包头id大于0表示是数据包
-	return v.manager.writePacket(v.id, p)
+	return v.manager.sched.sendStream(v.id, v.Priority(), data, func() {
+		if v.manager.has(proto.FeatResume) {
+			v.replay.Append(data)
+		}
+	})
+}
+
+// SetPriority 设置本流的发送权重，权重越大每轮可发送的数据越多，例如让 SSH 优先于文件同步
+func (v *VirtualConn) SetPriority(weight int) {
+	v.priority.Store(int32(weight))
+}
+
+// Priority 返回本流的发送权重
+func (v *VirtualConn) Priority() int {
+	if p := v.priority.Load(); p > 0 {
+		return int(p)
+	}
+	return DefaultPriority
+}
+
+// CompressionRatio 返回压缩流已发送数据压缩前后的字节数，未压缩的流返回 0, 0
+func (v *VirtualConn) CompressionRatio() (in, out int) {
+	if v.deflate == nil {
+		return 0, 0
+	}
+	return v.deflate.Ratio()
 }
 
 func (v *VirtualConn) Read(p []byte) (int, error) {
-	// 1. 如果上次还有残留数据，先读残留的
-	if len(v.cacheBuf) > 0 {
-		n := copy(p, v.cacheBuf)
-		v.cacheBuf = v.cacheBuf[n:]
-		fmt.Printf("read last\r\n")
-		return n, nil
+	if v.inflate != nil {
+		return v.inflate.Read(p)
 	}
+	return v.readRaw(p)
+}
 
-	// 2. 阻塞等待新数据
-	data, ok := <-v.readCh
-	if !ok {
-		return 0, io.EOF
+// readRaw 读取收到的原始字节并归还额度
+func (v *VirtualConn) readRaw(p []byte) (int, error) {
+	n, err := v.recv.Read(p)
+	if n > 0 {
+		v.ackRead(n)
+	}
+	return n, err
+}
+
+// ackRead 累计已读取的字节数，超过半个窗口时一次性归还给对端
+func (v *VirtualConn) ackRead(n int) {
+	if !v.manager.has(proto.FeatFlowControl) {
+		return
+	}
+	v.ackMu.Lock()
+	v.unacked += n
+	delta := 0
+	if v.unacked >= proto.InitialWindow/2 {
+		delta = v.unacked
+		v.unacked = 0
+	}
+	v.ackMu.Unlock()
+	if delta > 0 {
+		update := func(w proto.Wire) []byte { return w.WindowUpdateFrame(v.id, delta) }
+		v.manager.sched.sendControl(update, func() {
+			v.granted.Add(uint64(delta))
+		})
 	}
+}
 
-	// 3. 拷贝数据
-	n := copy(p, data)
-	readPool.Put(data[:cap(data)])
-	// 4. 如果 p 装不下，把剩下的存入 v.buf
-	if n < len(data) {
-		v.cacheBuf = append(v.cacheBuf, data[n:]...)
-		fmt.Printf("read overflow\r\n")
+// CloseWrite 半关闭：通知对端本端不会再写数据，仍可继续读取
+func (v *VirtualConn) CloseWrite() error {
+	m := v.manager
+	m.mu.Lock()
+	if v.reset {
+		m.mu.Unlock()
+		return ErrStreamReset
 	}
-	return n, nil
+	if v.writeClosed {
+		m.mu.Unlock()
+		return nil
+	}
+	v.writeClosed = true
+	v.sendWin.Close()
+	if v.deflate != nil {
+		v.deflate.Close()
+	}
+	removed := v.readClosed && m.streams[v.id] == v
+	if removed {
+		delete(m.streams, v.id)
+	}
+	m.mu.Unlock()
+	if removed {
+		defer m.sched.release(v.id, nil)
+	}
+	if !m.has(proto.FeatStreamClose) {
+		// 旧版本对端无法感知半关闭
+		return nil
+	}
+	// FIN 走本流的队列，排在已经写入的数据之后
+	v.wmu.Lock()
+	defer v.wmu.Unlock()
+	return m.sched.sendStreamControl(v.id, v.Priority(), control(v.id, proto.CmdFin), func() {
+		v.finWritten.Store(true)
+	})
 }
 
+// Close 完全关闭流：若对端已经半关闭则回 FIN 完成四次挥手，否则发 RST 让对端立即断开
 func (v *VirtualConn) Close() error {
-	v.manager.mu.Lock()
-	if _, ok := v.manager.streams[v.id]; ok {
-		delete(v.manager.streams, v.id)
-		close(v.readCh)
+	m := v.manager
+	m.mu.Lock()
+	if m.streams[v.id] != v {
+		// 已经被 RST 或双向 FIN 清理过
+		v.abortLocked(ErrStreamClosed)
+		m.mu.Unlock()
+		return nil
 	}
-	v.manager.mu.Unlock()
-	return nil
+	cmd := proto.CmdRst
+	if v.readClosed && !v.reset {
+		cmd = proto.CmdFin
+	}
+	v.abortLocked(ErrStreamClosed)
+	delete(m.streams, v.id)
+	m.mu.Unlock()
+	defer m.sched.release(v.id, nil)
+	if !m.has(proto.FeatStreamClose) {
+		return nil
+	}
+	// FIN 和 RST 都走本流的队列，排在已经交给调度器的数据之后
+	v.wmu.Lock()
+	defer v.wmu.Unlock()
+	return m.sched.sendStreamControl(v.id, v.Priority(), control(v.id, cmd), nil)
 }
@@ -0,0 +1,29 @@
+package comm
+
+import (
+	"net"
+	"time"
+)
+
+// muxAddr 流的地址，Network 固定为 "mux"
+type muxAddr string
+
+func (a muxAddr) Network() string { return "mux" }
+func (a muxAddr) String() string  { return string(a) }
+
+// streamConn 把 VirtualConn 包装成 net.Conn，供 net/http 等需要 net.Conn 的库使用
+// 流不支持超时，SetDeadline 系列方法不起作用，由调用方的 context 负责取消
+type streamConn struct {
+	*VirtualConn
+	remote string
+}
+
+func newStreamConn(v *VirtualConn, remote string) net.Conn {
+	return &streamConn{VirtualConn: v, remote: remote}
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return muxAddr("local") }
+func (c *streamConn) RemoteAddr() net.Addr               { return muxAddr(c.remote) }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,317 @@
+// Package peerauth 在物理链路建立后、Mux 开始工作前做一次双向认证：
+// 双方持有同一个预共享密钥，各自用 HMAC-SHA256 证明自己知道密钥，
+// 认证不通过的连接直接关闭，不会收到任何流的数据。
+//
+// 消息格式（都在原始链路上，位于分帧层之下）：
+//
+//	客户端 -> 服务端: "BTPA" 版本(1) ID长度(1) ID 客户端随机数(32)
+//	服务端 -> 客户端: 服务端随机数(32) 服务端MAC(32)
+//	客户端 -> 服务端: 客户端MAC(32)
+//	服务端 -> 客户端: 0x00，认证通过
+//
+// 服务端MAC = HMAC(key, "server" 版本 ID 客户端随机数 服务端随机数)，客户端MAC 的标签为 "client"，
+// 标签不同，对端的 MAC 无法被反射回去冒充
+package peerauth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAuthFailed 认证未通过，具体原因见包装它的错误
+var ErrAuthFailed = errors.New("认证失败")
+
+// Timeout 整个认证过程的时限，超时关闭连接
+var Timeout = 10 * time.Second
+
+const (
+	version   = 1
+	nonceSize = 32
+	macSize   = sha256.Size
+	// MinKeySize 密钥的最小长度（字节）
+	MinKeySize = 16
+)
+
+var magic = []byte("BTPA")
+
+// KeyStore 按ID查找预共享密钥
+type KeyStore interface {
+	Key(id string) ([]byte, bool)
+}
+
+// StaticKey 只有一个密钥的 KeyStore
+type StaticKey struct {
+	ID     string
+	Secret []byte
+}
+
+func (s StaticKey) Key(id string) ([]byte, bool) {
+	if id != s.ID {
+		return nil, false
+	}
+	return s.Secret, true
+}
+
+// Client 以 id 的身份向服务端认证，并确认服务端持有同一个密钥
+func Client(rw io.ReadWriteCloser, id string, key []byte) error {
+	if len(id) == 0 || len(id) > 0xFF {
+		return fmt.Errorf("%w: 无效的密钥 ID %q", ErrAuthFailed, id)
+	}
+	stop, timedOut := watchdog(rw)
+	defer stop()
+	fail := func(reason string, err error) error {
+		if timedOut.Load() {
+			return fmt.Errorf("%w: %s超时", ErrAuthFailed, reason)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrAuthFailed, reason, err)
+		}
+		return fmt.Errorf("%w: %s", ErrAuthFailed, reason)
+	}
+
+	nonceC := randomNonce()
+	hello := append([]byte{}, magic...)
+	hello = append(hello, version, byte(len(id)))
+	hello = append(hello, id...)
+	hello = append(hello, nonceC...)
+	if _, err := rw.Write(hello); err != nil {
+		return fail("发送认证请求", err)
+	}
+
+	buf := make([]byte, nonceSize+macSize)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return fail("等待服务端应答（服务端可能未开启认证）", err)
+	}
+	nonceS, macS := buf[:nonceSize], buf[nonceSize:]
+	if !hmac.Equal(macS, transcript(key, "server", id, nonceC, nonceS)) {
+		return fail("服务端未能证明持有密钥，密钥不一致或 ID 未登记", nil)
+	}
+	if _, err := rw.Write(transcript(key, "client", id, nonceS, nonceC)); err != nil {
+		return fail("发送认证应答", err)
+	}
+	var ok [1]byte
+	if _, err := io.ReadFull(rw, ok[:]); err != nil || ok[0] != 0 {
+		return fail("服务端拒绝了密钥", err)
+	}
+	return nil
+}
+
+// Server 等待客户端认证，返回客户端使用的密钥 ID
+// 认证失败时也尽量返回客户端声称的 ID，供审计记录
+func Server(rw io.ReadWriteCloser, store KeyStore) (string, error) {
+	stop, timedOut := watchdog(rw)
+	defer stop()
+	var id string
+	fail := func(reason string, err error) (string, error) {
+		if timedOut.Load() {
+			return id, fmt.Errorf("%w: %s超时", ErrAuthFailed, reason)
+		}
+		if err != nil {
+			return id, fmt.Errorf("%w: %s: %v", ErrAuthFailed, reason, err)
+		}
+		return id, fmt.Errorf("%w: %s", ErrAuthFailed, reason)
+	}
+
+	head := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(rw, head); err != nil {
+		return fail("读取认证请求", err)
+	}
+	if string(head[:len(magic)]) != string(magic) {
+		return fail("对端未进行认证", nil)
+	}
+	if head[len(magic)] != version {
+		return fail(fmt.Sprintf("不支持的认证版本 %d", head[len(magic)]), nil)
+	}
+	rest := make([]byte, int(head[len(magic)+1])+nonceSize)
+	if _, err := io.ReadFull(rw, rest); err != nil {
+		return fail("读取认证请求", err)
+	}
+	id = string(rest[:len(rest)-nonceSize])
+	nonceC := rest[len(rest)-nonceSize:]
+
+	key, known := store.Key(id)
+	if !known {
+		// 不直接断开，用随机密钥继续，避免对端据此探测哪些 ID 存在
+		key = randomNonce()
+	}
+	nonceS := randomNonce()
+	if _, err := rw.Write(append(nonceS, transcript(key, "server", id, nonceC, nonceS)...)); err != nil {
+		return fail("发送认证应答", err)
+	}
+	macC := make([]byte, macSize)
+	_, err := io.ReadFull(rw, macC)
+	if !known {
+		return fail("未知或已吊销的密钥 ID", nil)
+	}
+	if err != nil {
+		return fail("客户端未完成认证", err)
+	}
+	if !hmac.Equal(macC, transcript(key, "client", id, nonceS, nonceC)) {
+		return fail("客户端密钥不匹配", nil)
+	}
+	if _, err := rw.Write([]byte{0}); err != nil {
+		return fail("发送认证结果", err)
+	}
+	return id, nil
+}
+
+// watchdog 超时后关闭连接，打断阻塞中的读写；蓝牙连接的 deadline 不一定可用
+func watchdog(rw io.Closer) (stop func() bool, timedOut *atomic.Bool) {
+	timedOut = new(atomic.Bool)
+	t := time.AfterFunc(Timeout, func() {
+		timedOut.Store(true)
+		rw.Close()
+	})
+	return t.Stop, timedOut
+}
+
+func transcript(key []byte, label, id string, first, second []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	h.Write([]byte{version, byte(len(id))})
+	h.Write([]byte(id))
+	h.Write(first)
+	h.Write(second)
+	return h.Sum(nil)
+}
+
+func randomNonce() []byte {
+	b := make([]byte, nonceSize)
+	rand.Read(b)
+	return b
+}
+
+// GenerateKey 生成一个新的随机密钥，返回 base64 文本
+func GenerateKey() string {
+	return base64.StdEncoding.EncodeToString(randomNonce())
+}
+
+// ParseKey 解析 base64 文本形式的密钥
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("密钥不是有效的 base64: %v", err)
+	}
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("密钥太短，至少需要 %d 字节", MinKeySize)
+	}
+	return key, nil
+}
+
+// FileStore 从文本文件读取密钥，每行 "ID 密钥"，# 开头为注释
+// 文件修改后在下一次查找时重新加载，删掉一行即吊销对应的密钥，无需重启
+type FileStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[string][]byte
+}
+
+// NewFileStore 加载密钥文件，文件格式错误时返回错误
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) Key(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		// 文件损坏时拒绝所有密钥，宁可误拒也不放行已吊销的密钥
+		fmt.Printf("重新加载密钥文件失败，拒绝所有认证: %v\n", err)
+		s.keys = nil
+		s.modTime = time.Time{}
+		return nil, false
+	}
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+// IDs 返回当前有效的密钥 ID
+func (s *FileStore) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// reload 文件有变化时重新读取，调用方持有 mu 或在构造期间调用
+func (s *FileStore) reload() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.keys != nil && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := make(map[string][]byte)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) > 0xFF {
+			return fmt.Errorf("%s 第 %d 行格式错误，应为 \"ID 密钥\"", s.path, line)
+		}
+		key, err := ParseKey(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s 第 %d 行: %v", s.path, line, err)
+		}
+		keys[fields[0]] = key
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	s.keys, s.modTime, s.size = keys, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// AddKey 为 id 生成新密钥并追加到密钥文件，文件不存在时创建，返回生成的密钥
+func AddKey(path, id string) (string, error) {
+	if id == "" || len(id) > 0xFF || strings.ContainsAny(id, " \t\r\n#") {
+		return "", fmt.Errorf("无效的密钥 ID %q", id)
+	}
+	if s, err := NewFileStore(path); err == nil {
+		if _, exists := s.Key(id); exists {
+			return "", fmt.Errorf("密钥 ID %q 已存在", id)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key := GenerateKey()
+	if _, err := fmt.Fprintf(f, "%s %s\n", id, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
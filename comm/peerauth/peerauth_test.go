@@ -0,0 +1,302 @@
+package peerauth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder 记录客户端发出的原始字节，用于重放
+type recorder struct {
+	net.Conn
+	sent bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.sent.Write(p)
+	return r.Conn.Write(p)
+}
+
+type result struct {
+	id  string
+	err error
+}
+
+// serve 在管道的一端运行服务端认证，结束后关闭该端，避免客户端一直阻塞
+func serve(store KeyStore) (net.Conn, <-chan result) {
+	client, srv := net.Pipe()
+	done := make(chan result, 1)
+	go func() {
+		id, err := Server(srv, store)
+		srv.Close()
+		done <- result{id, err}
+	}()
+	return client, done
+}
+
+func mustKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := ParseKey(GenerateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHandshake(t *testing.T) {
+	key := mustKey(t)
+	conn, done := serve(StaticKey{ID: "phone", Secret: key})
+	if err := Client(conn, "phone", key); err != nil {
+		t.Fatalf("客户端: %v", err)
+	}
+	if r := <-done; r.err != nil || r.id != "phone" {
+		t.Fatalf("服务端: %q %v", r.id, r.err)
+	}
+}
+
+// TestBadMAC 任何一方不持有密钥都无法通过，双方都能发现
+func TestBadMAC(t *testing.T) {
+	key := mustKey(t)
+	store := StaticKey{ID: "phone", Secret: key}
+
+	// 客户端密钥错误：客户端先发现服务端的 MAC 对不上，不会发出自己的 MAC
+	conn, done := serve(store)
+	if err := Client(conn, "phone", mustKey(t)); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("客户端用错误的密钥: %v", err)
+	}
+	conn.Close()
+	if r := <-done; !errors.Is(r.err, ErrAuthFailed) || r.id != "phone" {
+		t.Fatalf("服务端: %q %v", r.id, r.err)
+	}
+
+	// 不验证服务端、直接发出错误 MAC 的客户端
+	conn, done = serve(store)
+	hello := append(append([]byte("BTPA"), version, 5), "phone"...)
+	conn.Write(append(hello, randomNonce()...))
+	io.ReadFull(conn, make([]byte, nonceSize+macSize))
+	conn.Write(make([]byte, macSize))
+	if r := <-done; !errors.Is(r.err, ErrAuthFailed) || !strings.Contains(r.err.Error(), "不匹配") {
+		t.Fatalf("服务端接受了错误的 MAC: %v", r.err)
+	}
+
+	// 服务端不持有密钥
+	client, srv := net.Pipe()
+	go func() {
+		head := make([]byte, 4+2+5+nonceSize)
+		io.ReadFull(srv, head)
+		srv.Write(make([]byte, nonceSize+macSize))
+		srv.Close()
+	}()
+	if err := Client(client, "phone", key); !errors.Is(err, ErrAuthFailed) || !strings.Contains(err.Error(), "服务端未能证明") {
+		t.Fatalf("客户端接受了错误的服务端 MAC: %v", err)
+	}
+
+	// 不是认证请求
+	conn, done = serve(store)
+	conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	if r := <-done; !errors.Is(r.err, ErrAuthFailed) {
+		t.Fatalf("服务端: %v", r.err)
+	}
+}
+
+// TestUnknownKeyID 未登记的 ID 被拒绝，客户端看到的结果与密钥错误相同，无法探测哪些 ID 存在
+func TestUnknownKeyID(t *testing.T) {
+	key := mustKey(t)
+	store := StaticKey{ID: "phone", Secret: key}
+
+	conn, done := serve(store)
+	unknownErr := Client(conn, "ghost", key)
+	conn.Close()
+	r := <-done
+	if !errors.Is(r.err, ErrAuthFailed) || !strings.Contains(r.err.Error(), "未知") {
+		t.Fatalf("服务端: %v", r.err)
+	}
+	if r.id != "ghost" {
+		t.Fatalf("服务端应返回客户端声称的 ID 供审计，得到 %q", r.id)
+	}
+
+	conn, done = serve(store)
+	wrongKeyErr := Client(conn, "phone", mustKey(t))
+	conn.Close()
+	<-done
+	if unknownErr == nil || wrongKeyErr == nil || unknownErr.Error() != wrongKeyErr.Error() {
+		t.Fatalf("未知 ID 与密钥错误的客户端结果不同: %v / %v", unknownErr, wrongKeyErr)
+	}
+}
+
+// TestReplay 录下的握手无法重放：对端每次都换新的随机数
+func TestReplay(t *testing.T) {
+	key := mustKey(t)
+	store := StaticKey{ID: "phone", Secret: key}
+
+	conn, done := serve(store)
+	rec := &recorder{Conn: conn}
+	if err := Client(rec, "phone", key); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; r.err != nil {
+		t.Fatal(r.err)
+	}
+	recorded := rec.sent.Bytes()
+	hello, mac := recorded[:len(recorded)-macSize], recorded[len(recorded)-macSize:]
+
+	// 把录下的请求和 MAC 原样发给新的服务端
+	conn, done = serve(store)
+	conn.Write(hello)
+	io.ReadFull(conn, make([]byte, nonceSize+macSize))
+	conn.Write(mac)
+	if r := <-done; !errors.Is(r.err, ErrAuthFailed) {
+		t.Fatalf("服务端接受了重放的 MAC: %v", r.err)
+	}
+
+	// 录下服务端的应答，重放给新的客户端
+	client, srv := net.Pipe()
+	reply := make(chan []byte, 1)
+	go func() {
+		defer srv.Close()
+		s := &recorder{Conn: srv}
+		Server(s, store)
+		reply <- s.sent.Bytes()
+	}()
+	Client(client, "phone", key)
+	recordedReply := <-reply
+
+	client, srv = net.Pipe()
+	go func() {
+		io.ReadFull(srv, make([]byte, len(hello)))
+		srv.Write(recordedReply)
+		srv.Close()
+	}()
+	if err := Client(client, "phone", key); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("客户端接受了重放的服务端应答: %v", err)
+	}
+}
+
+// TestTimeout 对端不说话时在 Timeout 后关闭连接并返回超时
+func TestTimeout(t *testing.T) {
+	timeout := Timeout
+	Timeout = 100 * time.Millisecond
+	defer func() { Timeout = timeout }()
+	key := mustKey(t)
+
+	// 服务端等不到请求
+	client, srv := net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	_, err := Server(srv, StaticKey{ID: "phone", Secret: key})
+	if !errors.Is(err, ErrAuthFailed) || !strings.Contains(err.Error(), "超时") {
+		t.Fatalf("服务端: %v", err)
+	}
+	if d := time.Since(start); d < Timeout || d > Timeout+time.Second {
+		t.Fatalf("服务端用了 %v", d)
+	}
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Fatal("超时后连接没有关闭")
+	}
+
+	// 客户端等不到应答，例如服务端没有开启认证
+	client, srv = net.Pipe()
+	defer srv.Close()
+	go io.Copy(io.Discard, srv)
+	start = time.Now()
+	err = Client(client, "phone", key)
+	if !errors.Is(err, ErrAuthFailed) || !strings.Contains(err.Error(), "超时") {
+		t.Fatalf("客户端: %v", err)
+	}
+	if d := time.Since(start); d < Timeout || d > Timeout+time.Second {
+		t.Fatalf("客户端用了 %v", d)
+	}
+
+	// 认证完成后不再计时，连接留给 Mux 使用
+	client, srv = net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Server(srv, StaticKey{ID: "phone", Secret: key})
+		done <- err
+	}()
+	if err := Client(client, "phone", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * Timeout)
+	go client.Write([]byte("mux"))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(srv, buf); err != nil || string(buf) != "mux" {
+		t.Fatalf("认证完成后连接被关闭: %q %v", buf, err)
+	}
+}
+
+// TestFileStoreRotation 修改密钥文件后下一次认证即生效，无需重启
+func TestFileStoreRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	mtime := time.Now()
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// 轮换后的密钥长度相同，文件大小不变，确保修改时间也变了
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(path, mtime, mtime)
+	}
+	oldKey, newKey := GenerateKey(), GenerateKey()
+	write("# 测试密钥\nphone " + oldKey + "\nlaptop " + GenerateKey() + "\n")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := func(id, key string) error {
+		t.Helper()
+		secret, err := ParseKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, done := serve(store)
+		err = Client(conn, id, secret)
+		conn.Close()
+		if r := <-done; (r.err == nil) != (err == nil) {
+			t.Fatalf("两端结果不一致: 客户端 %v 服务端 %v", err, r.err)
+		}
+		return err
+	}
+	if err := auth("phone", oldKey); err != nil {
+		t.Fatalf("旧密钥: %v", err)
+	}
+
+	// 轮换
+	write("phone " + newKey + "\nlaptop " + GenerateKey() + "\n")
+	if err := auth("phone", oldKey); err == nil {
+		t.Fatal("轮换后旧密钥仍然有效")
+	}
+	if err := auth("phone", newKey); err != nil {
+		t.Fatalf("新密钥: %v", err)
+	}
+
+	// 吊销
+	write("laptop " + GenerateKey() + "\n")
+	if err := auth("phone", newKey); err == nil {
+		t.Fatal("吊销后密钥仍然有效")
+	}
+	if ids := store.IDs(); len(ids) != 1 || ids[0] != "laptop" {
+		t.Fatalf("IDs %v", ids)
+	}
+
+	// 文件损坏时拒绝所有密钥，修好后恢复
+	write("phone " + newKey + "\nbroken\n")
+	if _, ok := store.Key("phone"); ok {
+		t.Fatal("文件损坏时仍然接受密钥")
+	}
+	write("phone " + newKey + "\n")
+	if err := auth("phone", newKey); err != nil {
+		t.Fatalf("文件修好后: %v", err)
+	}
+}
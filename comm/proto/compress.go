@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// 流压缩：打开帧带 OpenCompress 标志时，该流两个方向的数据各是一条连续的 deflate 流，
+// 每次写入以同步刷新结束，对端收到后立即能解出全部数据。
+// 帧边界、流控额度和会话恢复的序号都按压缩后的字节计算，与不压缩的流完全一样。
+// 发送方发现数据压不动（例如 TLS）时结束 deflate 流，之后的数据原样发送，
+// 接收方读到 deflate 流的结尾后同样切换到原样读取。
+// compress/flate 对同步刷新前不足约 260 字节的写入不做匹配，只存储原文，
+// 因此逐字符交互的流同样会在观察期后放弃压缩。
+
+const (
+	compressProbe     = 64 * 1024 // 至少观察这么多输入才判断压缩比
+	compressBailRatio = 0.9       // 压缩后超过原大小的这个比例时放弃压缩
+)
+
+// flate.Writer 的内部状态有几百 KB，在流之间复用
+var flateWriters sync.Pool
+
+// Compressor 一个流的发送方向的压缩状态
+type Compressor struct {
+	mu      sync.Mutex
+	w       *flate.Writer
+	buf     bytes.Buffer
+	in, out int
+	raw     bool // 已放弃压缩或已关闭，之后原样发送
+}
+
+// Compress 压缩 p 并同步刷新，返回要发给对端的字节，在下一次调用前有效
+// 同一个流的 Compress 需按发送顺序调用
+func (c *Compressor) Compress(p []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.raw {
+		return p
+	}
+	c.buf.Reset()
+	if c.w == nil {
+		if w, ok := flateWriters.Get().(*flate.Writer); ok {
+			w.Reset(&c.buf)
+			c.w = w
+		} else {
+			c.w, _ = flate.NewWriter(&c.buf, flate.DefaultCompression)
+		}
+	}
+	c.w.Write(p)
+	c.w.Flush()
+	c.in += len(p)
+	c.out += c.buf.Len()
+	if c.in >= compressProbe && float64(c.out) > float64(c.in)*compressBailRatio {
+		// 写出 deflate 的结束块，对端据此切换到原样读取
+		c.w.Close()
+		c.release()
+	}
+	return c.buf.Bytes()
+}
+
+// Ratio 返回目前为止压缩后与压缩前的字节数
+func (c *Compressor) Ratio() (in, out int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.in, c.out
+}
+
+// Close 归还内部状态，之后的 Compress 原样返回输入
+func (c *Compressor) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w != nil {
+		c.release()
+	}
+	c.raw = true
+}
+
+func (c *Compressor) release() {
+	c.w.Reset(io.Discard)
+	flateWriters.Put(c.w)
+	c.w = nil
+	c.raw = true
+}
+
+// Decompressor 还原对端 Compressor 的输出
+type Decompressor struct {
+	src *eofReader
+	br  *bufio.Reader // flate 只从实现了 io.ByteReader 的来源按需读取，不会多读 deflate 流之后的原样数据
+	fr  io.ReadCloser
+	raw bool
+}
+
+// NewDecompressor 从 src 读取压缩后的字节，src 在流结束时返回 io.EOF
+func NewDecompressor(src io.Reader) *Decompressor {
+	e := &eofReader{r: src}
+	br := bufio.NewReaderSize(e, 4096)
+	return &Decompressor{src: e, br: br, fr: flate.NewReader(br)}
+}
+
+func (d *Decompressor) Read(p []byte) (int, error) {
+	if !d.raw {
+		n, err := d.fr.Read(p)
+		switch {
+		case err == io.EOF:
+			// 对端放弃了压缩，之后是原样数据
+			d.raw = true
+			d.fr.Close()
+			if n > 0 {
+				return n, nil
+			}
+		case err == io.ErrUnexpectedEOF && d.src.eof:
+			// 对端在两次写入之间半关闭，每次写入都已同步刷新，数据是完整的
+			return n, io.EOF
+		default:
+			return n, err
+		}
+	}
+	return d.br.Read(p)
+}
+
+// eofReader 记录来源是否正常结束，用于区分半关闭和数据被截断
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
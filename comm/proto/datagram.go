@@ -0,0 +1,111 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// 数据报流的负载是连续的消息：[长度(2)][地址类型(1)][地址][端口(2)][数据]
+// 长度不含自身；地址类型与打开帧相同，域名前多一个长度字节
+// 客户端发出的消息中地址是目的地址，服务端发回的是回包的来源地址
+//
+// 发送方把每条消息作为一个数据帧整帧发出，不拆分也不与其他消息合并：超过单帧上限的消息
+// 返回 ErrDatagramTooLarge；发送额度不够整条消息时丢弃该数据报而不是等待，与 UDP 一样可能丢包。
+// 接收方仍按长度字段切分：会话恢复时丢失的数据按字节补发，不保留原来的帧边界
+
+// MaxDatagram 单个 UDP 数据报的最大长度
+const MaxDatagram = 65507
+
+var ErrDatagramTooLarge = errors.New("数据报过大")
+
+// AppendAddr 追加 [地址类型(1)][地址][端口(2)]
+func AppendAddr(dst []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, AddrIPv4)
+			dst = append(dst, ip4...)
+		} else {
+			dst = append(dst, AddrIPv6)
+			dst = append(dst, ip.To16()...)
+		}
+	} else {
+		dst = append(dst, AddrDomain, byte(len(host)))
+		dst = append(dst, host...)
+	}
+	return binary.BigEndian.AppendUint16(dst, port)
+}
+
+// ParseAddr 解析 AppendAddr 的结果，n 为占用的字节数
+func ParseAddr(b []byte) (host string, port uint16, n int, ok bool) {
+	if len(b) < 1 {
+		return "", 0, 0, false
+	}
+	switch b[0] {
+	case AddrIPv4:
+		n = 1 + 4
+	case AddrIPv6:
+		n = 1 + 16
+	case AddrDomain:
+		if len(b) < 2 {
+			return "", 0, 0, false
+		}
+		n = 2 + int(b[1])
+	default:
+		return "", 0, 0, false
+	}
+	if len(b) < n+2 {
+		return "", 0, 0, false
+	}
+	if b[0] == AddrDomain {
+		host = string(b[2:n])
+	} else {
+		host = net.IP(b[1:n]).String()
+	}
+	return host, binary.BigEndian.Uint16(b[n : n+2]), n + 2, true
+}
+
+// AppendDatagram 追加一条数据报消息
+func AppendDatagram(dst []byte, host string, port uint16, data []byte) []byte {
+	at := len(dst)
+	dst = append(dst, 0, 0)
+	dst = AppendAddr(dst, host, port)
+	dst = append(dst, data...)
+	binary.BigEndian.PutUint16(dst[at:], uint16(len(dst)-at-2))
+	return dst
+}
+
+// WriteDatagram 把一条数据报消息一次写入 w
+func WriteDatagram(w io.Writer, host string, port uint16, data []byte) error {
+	if len(data) > MaxDatagram || len(host) > 0xFF {
+		return ErrDatagramTooLarge
+	}
+	msg := AppendDatagram(make([]byte, 0, 2+1+256+2+len(data)), host, port, data)
+	if len(msg)-2 > 0xFFFF {
+		// 长域名加上最大的数据报超出了长度字段
+		return ErrDatagramTooLarge
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// ReadDatagram 从 r 读取一条完整的数据报消息
+func ReadDatagram(r io.Reader) (host string, port uint16, data []byte, err error) {
+	var size [2]byte
+	if _, err = io.ReadFull(r, size[:]); err != nil {
+		return "", 0, nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err = io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", 0, nil, err
+	}
+	host, port, n, ok := ParseAddr(msg)
+	if !ok {
+		return "", 0, nil, errors.New("无效的数据报地址")
+	}
+	return host, port, msg[n:], nil
+}
@@ -0,0 +1,198 @@
+package proto
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DatagramConn 把数据报流包装成 net.PacketConn：每次 ReadFrom 返回一个完整的数据报，
+// 每次 WriteTo 发出一个完整的数据报，超过 MaxDatagram 或对端单帧上限的数据报返回 ErrDatagramTooLarge，不会被拆开
+// 客户端和服务端各自提供底层的流，消息格式见 AppendDatagram
+type DatagramConn struct {
+	stream io.ReadWriteCloser
+	local  net.Addr
+	in     chan datagram
+	wmu    sync.Mutex // 一条消息的字节连续写入流
+
+	mu            sync.Mutex
+	err           error         // 读协程退出的原因
+	closed        chan struct{} // Close 后关闭
+	readDeadline  time.Time
+	writeDeadline time.Time
+	deadlineCh    chan struct{} // 读超时改变时关闭，唤醒等待中的 ReadFrom
+	closeOnce     sync.Once
+}
+
+type datagram struct {
+	addr net.Addr
+	data []byte
+}
+
+// DatagramAddr 数据报的地址是域名时使用，是 IP 时 ReadFrom 返回 *net.UDPAddr
+type DatagramAddr struct {
+	Host string
+	Port uint16
+}
+
+func (a *DatagramAddr) Network() string { return "udp" }
+func (a *DatagramAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+// NewDatagramConn 在数据报流上创建 DatagramConn，local 为 LocalAddr 的返回值
+func NewDatagramConn(stream io.ReadWriteCloser, local net.Addr) *DatagramConn {
+	c := &DatagramConn{
+		stream:     stream,
+		local:      local,
+		in:         make(chan datagram, 16),
+		closed:     make(chan struct{}),
+		deadlineCh: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop 从流中逐条读出数据报，读得慢时由流控把背压传给对端
+func (c *DatagramConn) readLoop() {
+	defer close(c.in)
+	for {
+		host, port, data, err := ReadDatagram(c.stream)
+		if err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			return
+		}
+		var addr net.Addr = &DatagramAddr{Host: host, Port: port}
+		if ip := net.ParseIP(host); ip != nil {
+			addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		select {
+		case c.in <- datagram{addr, data}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// ReadFrom 读取一个数据报，p 放不下时只返回前 len(p) 字节和 io.ErrShortBuffer，其余部分丢弃
+// 流结束后返回 io.EOF 或流的错误
+func (c *DatagramConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, again, err := c.readOnce(p)
+		if !again {
+			return n, addr, err
+		}
+	}
+}
+
+// readOnce 按当前的读超时等待一个数据报，超时被修改时返回 again
+func (c *DatagramConn) readOnce(p []byte) (n int, addr net.Addr, again bool, err error) {
+	select {
+	case <-c.closed:
+		return 0, nil, false, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline, wake := c.readDeadline, c.deadlineCh
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, false, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case d, ok := <-c.in:
+		if !ok {
+			c.mu.Lock()
+			err = c.err
+			c.mu.Unlock()
+			return 0, nil, false, err
+		}
+		n = copy(p, d.data)
+		if n < len(d.data) {
+			return n, d.addr, false, io.ErrShortBuffer
+		}
+		return n, d.addr, false, nil
+	case <-c.closed:
+		return 0, nil, false, net.ErrClosed
+	case <-timeout:
+		return 0, nil, false, os.ErrDeadlineExceeded
+	case <-wake:
+		return 0, nil, true, nil
+	}
+}
+
+// WriteTo 发出一个数据报，addr 可以是任意 net.Addr，按其 String() 解析出主机和端口
+// 写超时只在开始写入前检查；底层的流整帧发出每条消息，额度不够时丢弃数据报而不阻塞
+func (c *DatagramConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := WriteDatagram(c.stream, host, uint16(port), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 关闭底层的流
+func (c *DatagramConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.stream.Close()
+	})
+	return err
+}
+
+func (c *DatagramConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *DatagramConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *DatagramConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *DatagramConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
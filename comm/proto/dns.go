@@ -0,0 +1,67 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS 解析流（见 OpenDNS）与 DNS over TCP 使用相同的格式：[长度(2)][DNS 报文]
+
+var ErrDNSMessageTooLarge = errors.New("DNS 报文过大")
+
+// ReadDNSMessage 读取一个带长度前缀的 DNS 报文
+func ReadDNSMessage(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// AppendDNSMessage 追加带长度前缀的 DNS 报文
+func AppendDNSMessage(dst, msg []byte) ([]byte, error) {
+	if len(msg) > 0xFFFF {
+		return dst, ErrDNSMessageTooLarge
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(msg)))
+	return append(dst, msg...), nil
+}
+
+// DNSErrorReply 根据查询构造只带问题部分的错误回复，查询无法解析时返回 nil
+func DNSErrorReply(query []byte, rcode dnsmessage.RCode) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			OpCode:             hdr.OpCode,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: questions,
+	}
+	b, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
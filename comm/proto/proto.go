@@ -0,0 +1,208 @@
+// Package proto 定义客户端 MuxManager 与服务端 BluetoothMuxHandler 共用的帧格式常量和流控原语
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// HelloID 握手帧使用的保留 ID，旧版本的两端都会把它当作不存在的流直接忽略
+const HelloID uint32 = 0xFFFF
+
+// Version 当前协议版本，没有握手的旧版帧格式视为版本 0
+const Version byte = 1
+
+// 特性位，握手后双方按交集工作
+const (
+	FeatStreamClose uint32 = 1 << iota // FIN/RST 控制命令
+	FeatOpenReply                      // 打开结果回复
+	FeatFlowControl                    // 基于额度的流控
+	FeatKeepalive                      // PING/PONG 心跳
+	FeatResume                         // 重连后恢复会话，依赖流控
+	FeatDatagram                       // UDP 数据报流
+	FeatDNS                            // 服务端 DNS 解析流
+	FeatReverse                        // 反向转发：服务端监听端口并向客户端打开流
+	FeatCompress                       // 按流协商的 deflate 压缩，见 OpenCompress
+	FeatWireV2                         // 4 字节流ID、变长长度的 v2 帧格式，见 Wire
+)
+
+// Features 本实现支持的全部特性
+const Features = FeatStreamClose | FeatOpenReply | FeatFlowControl | FeatKeepalive | FeatResume | FeatDatagram | FeatDNS | FeatReverse | FeatCompress | FeatWireV2
+
+var helloMagic = []byte("BTPX")
+
+// HelloResumed 服务端回复的握手标志：已接回原有会话
+const HelloResumed byte = 0x01
+
+// Hello 握手内容：[魔数(4)][版本(1)][特性位(4)][最大帧负载(4)][会话ID(8)][标志(1)]
+// 会话ID 和标志是后加的字段，只认前 13 字节的旧实现会忽略它们
+type Hello struct {
+	Version   byte
+	Features  uint32
+	MaxFrame  uint32 // 本端能接收的最大帧负载
+	SessionID uint64 // 客户端生成，重连时带上以恢复会话
+	Flags     byte
+}
+
+func (h Hello) Marshal() []byte {
+	buf := make([]byte, 22)
+	copy(buf[0:4], helloMagic)
+	buf[4] = h.Version
+	binary.BigEndian.PutUint32(buf[5:9], h.Features)
+	binary.BigEndian.PutUint32(buf[9:13], h.MaxFrame)
+	binary.BigEndian.PutUint64(buf[13:21], h.SessionID)
+	buf[21] = h.Flags
+	return buf
+}
+
+// ParseHello 解析握手内容，魔数不对或长度不足时返回 false
+func ParseHello(data []byte) (Hello, bool) {
+	if len(data) < 13 || string(data[0:4]) != string(helloMagic) {
+		return Hello{}, false
+	}
+	h := Hello{
+		Version:  data[4],
+		Features: binary.BigEndian.Uint32(data[5:9]),
+		MaxFrame: binary.BigEndian.Uint32(data[9:13]),
+	}
+	if len(data) >= 22 {
+		h.SessionID = binary.BigEndian.Uint64(data[13:21])
+		h.Flags = data[21]
+	}
+	return h, true
+}
+
+// 控制帧（包头 ID 为 0）的负载格式：[流ID][命令(1)][参数...]，流ID 的长度由帧格式决定，见 Wire
+// 命令字节与打开帧中的地址类型(0x01-0x03)位于同一位置，因此控制命令从 0x10 开始编号
+const (
+	AddrIPv4   byte = 0x01
+	AddrIPv6   byte = 0x02
+	AddrDomain byte = 0x03
+
+	// OpenDatagram 打开帧地址类型上的标志位：该流承载 UDP 数据报，见 AppendDatagram
+	// 置位后仍小于 0x10，不会被误认为控制命令
+	OpenDatagram byte = 0x08
+	// OpenDNS 打开帧地址类型上的标志位：该流承载 DNS 查询，格式与 DNS over TCP 相同
+	// （[长度(2)][DNS 报文]），可以连续发送多个查询，回复顺序不定，按报文 ID 对应；地址被忽略
+	OpenDNS byte = 0x04
+	// OpenCompress 打开帧地址类型上的标志位：该流两个方向都压缩，见 Compressor
+	// 置位后不小于 0x10，IsControl 据此排除，控制命令因此不会用到这一位
+	OpenCompress byte = 0x80
+
+	CmdFin          byte = 0x10 // 半关闭：发送方不会再写入数据
+	CmdRst          byte = 0x11 // 重置：立即关闭整个流
+	CmdOpenReply    byte = 0x12 // 打开结果：[结果码(1)]
+	CmdWindowUpdate byte = 0x13 // 归还发送额度：[增量(4)]
+	CmdPing         byte = 0x14 // 心跳请求：流ID 固定为 0，[发送时间(8)]
+	CmdPong         byte = 0x15 // 心跳回复：原样带回 PING 的参数
+	CmdResume       byte = 0x16 // 会话恢复报告：流ID 固定为 0，见 ResumeFrames
+	CmdResync       byte = 0x17 // 服务端丢弃了损坏的帧，请客户端重新握手恢复会话
+
+	// 反向转发：以下命令的流ID 位置除 ACCEPT 外都是客户端分配的监听ID
+	CmdListen      byte = 0x18 // 请求服务端监听 TCP：[地址类型(1)][地址][端口(2)]，格式见 AppendAddr
+	CmdListenReply byte = 0x19 // 监听结果：[结果码(1)]
+	CmdUnlisten    byte = 0x1A // 停止监听
+	CmdAccept      byte = 0x1B // 服务端接受了连接并打开流：[监听ID][来源地址]，客户端拨号后用 OPEN_REPLY 回复
+)
+
+// 打开结果码，由服务端拨号结果决定
+const (
+	OpenSuccess     byte = 0x00
+	OpenFailure     byte = 0x01 // 其他错误
+	OpenRefused     byte = 0x02 // 连接被拒绝
+	OpenNetUnreach  byte = 0x03 // 网络不可达
+	OpenHostUnreach byte = 0x04 // 主机不可达
+	OpenDNSFailure  byte = 0x05 // 域名解析失败
+	OpenTimeout     byte = 0x06 // 连接超时
+	OpenAddrInUse   byte = 0x07 // 监听地址已被占用
+	OpenDenied      byte = 0x08 // 目的地址被服务端的访问控制拒绝
+)
+
+// ErrDenied 目的地址被访问控制拒绝，对应 OpenDenied
+var ErrDenied = errors.New("被访问控制拒绝")
+
+// OpenCodeText 返回结果码的描述
+func OpenCodeText(code byte) string {
+	switch code {
+	case OpenSuccess:
+		return "成功"
+	case OpenRefused:
+		return "连接被拒绝"
+	case OpenNetUnreach:
+		return "网络不可达"
+	case OpenHostUnreach:
+		return "主机不可达"
+	case OpenDNSFailure:
+		return "域名解析失败"
+	case OpenTimeout:
+		return "连接超时"
+	case OpenAddrInUse:
+		return "地址已被占用"
+	case OpenDenied:
+		return "被访问控制拒绝"
+	default:
+		return "连接失败"
+	}
+}
+
+// DialErrorCode 把拨号或监听的错误转换为结果码
+func DialErrorCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrDenied):
+		return OpenDenied
+	case errors.As(err, &dnsErr):
+		return OpenDNSFailure
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return OpenTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return OpenRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return OpenNetUnreach
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return OpenHostUnreach
+	case errors.Is(err, syscall.EADDRINUSE):
+		return OpenAddrInUse
+	default:
+		return OpenFailure
+	}
+}
+
+// CommandFeature 返回发送某个控制命令所需的特性位
+func CommandFeature(cmd byte) uint32 {
+	switch cmd {
+	case CmdFin, CmdRst:
+		return FeatStreamClose
+	case CmdOpenReply:
+		return FeatOpenReply
+	case CmdWindowUpdate:
+		return FeatFlowControl
+	case CmdPing, CmdPong:
+		return FeatKeepalive
+	case CmdResume, CmdResync:
+		return FeatResume
+	case CmdListen, CmdListenReply, CmdUnlisten, CmdAccept:
+		return FeatReverse
+	default:
+		return 0
+	}
+}
+
+// ParseWindowUpdate 解析 WINDOW_UPDATE 的增量参数
+func ParseWindowUpdate(args []byte) (int, bool) {
+	if len(args) < 4 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(args)), true
+}
+
+// ParsePong 从 PONG 参数中取出对应 PING 的发送时间
+func ParsePong(args []byte) (int64, bool) {
+	if len(args) < 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(args)), true
+}
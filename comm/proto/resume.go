@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// ResumeEntry 会话恢复时本端对某个流的状态报告
+type ResumeEntry struct {
+	ID       uint32
+	Received uint64 // 已收到的对端数据总字节数，对端从这里开始重传
+	Granted  uint64 // 已授予对端的发送额度总数（初始窗口 + 已发出的增量）
+	FinRecv  bool   // 已收到对端的 FIN
+}
+
+// resumeEntrySize 单条报告的长度：[流ID][已收(8)][额度(8)][标志(1)]
+func (w Wire) resumeEntrySize() int {
+	return w.IDSize() + 17
+}
+
+// ResumeFrames 把报告拆成若干 RESUME 控制负载，每帧不超过 maxPayload
+// 负载格式：[0][CmdResume][是否最后一帧(1)][条目...]，条目为空时也会发出一帧
+func (w Wire) ResumeFrames(entries []ResumeEntry, maxPayload int) [][]byte {
+	size := w.resumeEntrySize()
+	per := (maxPayload - w.IDSize() - 2) / size
+	if per <= 0 {
+		per = 1
+	}
+	var frames [][]byte
+	for {
+		n := len(entries)
+		if n > per {
+			n = per
+		}
+		args := make([]byte, 1, 1+n*size)
+		if n == len(entries) {
+			args[0] = 1
+		}
+		for _, e := range entries[:n] {
+			args = w.AppendID(args, e.ID)
+			args = binary.BigEndian.AppendUint64(args, e.Received)
+			args = binary.BigEndian.AppendUint64(args, e.Granted)
+			if e.FinRecv {
+				args = append(args, 1)
+			} else {
+				args = append(args, 0)
+			}
+		}
+		frames = append(frames, w.ControlFrame(0, CmdResume, args...))
+		entries = entries[n:]
+		if len(entries) == 0 {
+			return frames
+		}
+	}
+}
+
+// ParseResume 解析 RESUME 参数，last 表示报告已经完整
+func (w Wire) ParseResume(args []byte) (entries []ResumeEntry, last bool, ok bool) {
+	size, n := w.resumeEntrySize(), w.IDSize()
+	if len(args) < 1 || (len(args)-1)%size != 0 {
+		return nil, false, false
+	}
+	for b := args[1:]; len(b) > 0; b = b[size:] {
+		entries = append(entries, ResumeEntry{
+			ID:       w.ID(b),
+			Received: binary.BigEndian.Uint64(b[n : n+8]),
+			Granted:  binary.BigEndian.Uint64(b[n+8 : n+16]),
+			FinRecv:  b[n+16]&1 != 0,
+		})
+	}
+	return entries, args[0] == 1, true
+}
+
+// Replay 记录一个流已写出但对端可能尚未收到的数据，重连后据此重传
+// 对端确认消费后才丢弃，因此大小不会超过 InitialWindow
+type Replay struct {
+	mu   sync.Mutex
+	base uint64 // buf[0] 在流中的偏移
+	buf  []byte
+}
+
+// Append 记录一段已写出的数据
+func (r *Replay) Append(p []byte) {
+	r.mu.Lock()
+	r.buf = append(r.buf, p...)
+	r.mu.Unlock()
+}
+
+// Sent 返回已写出的数据总字节数
+func (r *Replay) Sent() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.base + uint64(len(r.buf))
+}
+
+// Ack 丢弃偏移 upTo 之前的数据
+func (r *Replay) Ack(upTo uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if upTo <= r.base {
+		return
+	}
+	n := upTo - r.base
+	if n > uint64(len(r.buf)) {
+		n = uint64(len(r.buf))
+	}
+	r.buf = r.buf[n:]
+	if len(r.buf) == 0 {
+		r.buf = nil
+	}
+	r.base += n
+}
+
+// Since 返回从偏移 off 开始的数据副本，off 之前的数据已被丢弃时返回 false
+func (r *Replay) Since(off uint64) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off < r.base || off > r.base+uint64(len(r.buf)) {
+		return nil, false
+	}
+	return append([]byte(nil), r.buf[off-r.base:]...), true
+}
@@ -0,0 +1,107 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestReplayOffsets 按对端报告的偏移确认和重传，确认过的数据不能再取回
+func TestReplayOffsets(t *testing.T) {
+	var r Replay
+	r.Append([]byte("hello "))
+	r.Append([]byte("world"))
+	if r.Sent() != 11 {
+		t.Fatalf("Sent %d", r.Sent())
+	}
+	tests := []struct {
+		off  uint64
+		want string
+		ok   bool
+	}{
+		{0, "hello world", true},
+		{6, "world", true},
+		{11, "", true},
+		{12, "", false},
+	}
+	for _, tc := range tests {
+		got, ok := r.Since(tc.off)
+		if ok != tc.ok || string(got) != tc.want {
+			t.Errorf("Since(%d) = %q %v，期望 %q %v", tc.off, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	r.Ack(6)
+	if _, ok := r.Since(5); ok {
+		t.Error("已确认的数据仍能取回")
+	}
+	if got, ok := r.Since(6); !ok || string(got) != "world" {
+		t.Errorf("Since(6) = %q %v", got, ok)
+	}
+	// 重复或倒退的确认不影响缓冲
+	r.Ack(3)
+	if got, _ := r.Since(6); string(got) != "world" {
+		t.Errorf("倒退的确认改变了缓冲: %q", got)
+	}
+	// 超出已发送的确认只清空缓冲，偏移不越过已发送的数据
+	r.Ack(100)
+	if r.Sent() != 11 {
+		t.Fatalf("Sent %d", r.Sent())
+	}
+	r.Append([]byte("!"))
+	if got, ok := r.Since(11); !ok || string(got) != "!" {
+		t.Errorf("Since(11) = %q %v", got, ok)
+	}
+
+	// 返回的是副本，之后追加或确认不影响已取出的数据
+	got, _ := r.Since(11)
+	r.Append([]byte("?"))
+	r.Ack(12)
+	if !bytes.Equal(got, []byte("!")) {
+		t.Errorf("Since 返回的数据被修改: %q", got)
+	}
+}
+
+// TestResumeFramesRoundTrip 报告拆成多帧后按原顺序拼回，最后一帧带结束标志
+func TestResumeFramesRoundTrip(t *testing.T) {
+	for _, w := range wires {
+		var entries []ResumeEntry
+		for i := uint32(1); i <= 10; i++ {
+			entries = append(entries, ResumeEntry{ID: i, Received: uint64(i) << 33, Granted: uint64(i) * 1000, FinRecv: i%2 == 0})
+		}
+		// 每帧只放得下三条
+		frames := w.ResumeFrames(entries, w.IDSize()+2+1+3*w.resumeEntrySize())
+		if len(frames) != 4 {
+			t.Fatalf("%d 条报告拆成了 %d 帧", len(entries), len(frames))
+		}
+		var got []ResumeEntry
+		for i, frame := range frames {
+			_, cmd, args, ok := w.ParseControl(frame)
+			if !ok || cmd != CmdResume {
+				t.Fatalf("第 %d 帧不是 RESUME: %x", i, frame)
+			}
+			part, last, ok := w.ParseResume(args)
+			if !ok || last != (i == len(frames)-1) {
+				t.Fatalf("第 %d 帧 ok %v last %v", i, ok, last)
+			}
+			got = append(got, part...)
+		}
+		if len(got) != len(entries) {
+			t.Fatalf("拼回 %d 条", len(got))
+		}
+		for i := range got {
+			if got[i] != entries[i] {
+				t.Errorf("第 %d 条 %+v，期望 %+v", i, got[i], entries[i])
+			}
+		}
+
+		// 空报告也发出一帧
+		frames = w.ResumeFrames(nil, 64)
+		_, _, args, _ := w.ParseControl(frames[0])
+		if part, last, ok := w.ParseResume(args); len(frames) != 1 || !ok || !last || len(part) != 0 {
+			t.Errorf("空报告: %d 帧 %v %v %v", len(frames), part, last, ok)
+		}
+		if _, _, ok := w.ParseResume(args[:0]); ok {
+			t.Error("接受了空的 RESUME 参数")
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package proto
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// InitialWindow 每个流在每个方向上的初始接收窗口，对端发送的未确认数据不能超过它
+const InitialWindow = 256 * 1024
+
+var ErrWindowClosed = errors.New("流控窗口已关闭")
+
+// Window 发送方向的信用额度，额度用完后发送方阻塞直到对端发来 WINDOW_UPDATE
+type Window struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	avail  int
+	closed bool
+}
+
+func NewWindow(n int) *Window {
+	w := &Window{avail: n}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Acquire 阻塞直到有可用额度，返回本次可以发送的字节数（不超过 max）
+// 窗口关闭后返回 0
+func (w *Window) Acquire(max int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.avail <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+	n := max
+	if n > w.avail {
+		n = w.avail
+	}
+	w.avail -= n
+	return n
+}
+
+// TryAcquire 额度足够时一次取走 n 字节并返回 true，不够时不取、不等待，返回 false
+// 用于数据报：整条消息要么立即发出，要么丢弃。窗口关闭后返回 ErrWindowClosed
+func (w *Window) TryAcquire(n int) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false, ErrWindowClosed
+	}
+	if w.avail < n {
+		return false, nil
+	}
+	w.avail -= n
+	return true, nil
+}
+
+// Add 归还对端确认消费的额度
+func (w *Window) Add(n int) {
+	w.mu.Lock()
+	w.avail += n
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// Set 直接设定可用额度，会话恢复后按对端报告重新计算
+func (w *Window) Set(n int) {
+	w.mu.Lock()
+	w.avail = n
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// Close 唤醒所有等待额度的发送方
+func (w *Window) Close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// RecvBuffer 接收方向的缓冲区，写入永不阻塞，容量由对端遵守的窗口约束
+type RecvBuffer struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	buf   []byte
+	limit int
+	err   error // 非 nil 表示不会再有新数据，缓冲读完后返回该错误
+}
+
+func NewRecvBuffer(limit int) *RecvBuffer {
+	b := &RecvBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Push 追加对端发来的数据，超出窗口返回 false，说明对端违反了流控
+func (b *RecvBuffer) Push(p []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return true
+	}
+	if len(b.buf)+len(p) > b.limit {
+		return false
+	}
+	b.buf = append(b.buf, p...)
+	b.cond.Broadcast()
+	return true
+}
+
+// Read 阻塞读取缓冲中的数据
+func (b *RecvBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.buf) == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if len(b.buf) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	if len(b.buf) == 0 {
+		b.buf = nil
+	}
+	return n, nil
+}
+
+// CloseWrite 对端不会再发数据，已缓冲的数据读完后返回 io.EOF
+func (b *RecvBuffer) CloseWrite() {
+	b.CloseWithError(io.EOF)
+}
+
+// CloseWithError 已缓冲的数据读完后返回 err
+func (b *RecvBuffer) CloseWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Reset 丢弃已缓冲的数据，之后的读取立即返回 err
+func (b *RecvBuffer) Reset(err error) {
+	b.mu.Lock()
+	b.buf = nil
+	if b.err == nil || b.err == io.EOF {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
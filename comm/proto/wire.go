@@ -0,0 +1,175 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Wire 帧格式，握手协商出 FeatWireV2 后双方从握手回复之后的下一帧起改用 v2
+//
+//	v1: [流ID(2)][长度(2)]，控制帧、打开帧和恢复报告中的流ID 也是 2 字节
+//	v2: [流ID(4)][长度(uvarint，1-3 字节)]，负载中的流ID 也是 4 字节
+//
+// 握手帧不论哪种格式都按 v1 编码。v2 保留了高 16 位全为 1 的流ID，
+// 读到 0xFFFF 开头的包头时按 v1 解析，因此任何时候都能认出对端的握手。
+type Wire uint8
+
+const (
+	WireV1 Wire = iota
+	WireV2
+)
+
+// ErrFrameTooLarge 帧负载超出帧格式或对端能接收的长度
+var ErrFrameTooLarge = errors.New("帧负载过长")
+
+// maxVarintLen v2 长度字段最多占用的字节数
+const maxVarintLen = 3
+
+// WireFor 返回协商出的特性对应的帧格式
+func WireFor(features uint32) Wire {
+	if features&FeatWireV2 != 0 {
+		return WireV2
+	}
+	return WireV1
+}
+
+func (w Wire) String() string {
+	if w == WireV2 {
+		return "v2"
+	}
+	return "v1"
+}
+
+// MaxPayload 返回帧格式能表示的最大负载
+func (w Wire) MaxPayload() int {
+	if w == WireV2 {
+		return 1<<(7*maxVarintLen) - 1
+	}
+	return 0xFFFF
+}
+
+// IDLimit 返回流ID 的上限（不含），HelloID 及以上的ID 保留给握手
+func (w Wire) IDLimit() uint32 {
+	if w == WireV2 {
+		return 0xFFFF0000
+	}
+	return uint32(HelloID)
+}
+
+// ServerStreamBase 协商出 FeatReverse 后流ID 空间一分为二：
+// 客户端分配小于它的ID，服务端为反向转发分配不小于它且小于 IDLimit 的ID
+func (w Wire) ServerStreamBase() uint32 {
+	if w == WireV2 {
+		return 0x80000000
+	}
+	return 0x8000
+}
+
+// IDSize 返回负载中流ID 的字节数
+func (w Wire) IDSize() int {
+	if w == WireV2 {
+		return 4
+	}
+	return 2
+}
+
+// AppendID 把流ID 按本格式追加到 dst
+func (w Wire) AppendID(dst []byte, id uint32) []byte {
+	if w == WireV2 {
+		return binary.BigEndian.AppendUint32(dst, id)
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(id))
+}
+
+// ID 读取 b 开头的流ID，调用方保证 len(b) >= IDSize()
+func (w Wire) ID(b []byte) uint32 {
+	if w == WireV2 {
+		return binary.BigEndian.Uint32(b)
+	}
+	return uint32(binary.BigEndian.Uint16(b))
+}
+
+// AppendHeader 追加负载长度为 n 的包头，握手帧总是 v1 格式
+func (w Wire) AppendHeader(dst []byte, id uint32, n int) ([]byte, error) {
+	if w == WireV1 || id == HelloID {
+		if n > 0xFFFF {
+			return dst, ErrFrameTooLarge
+		}
+		dst = binary.BigEndian.AppendUint16(dst, uint16(id))
+		return binary.BigEndian.AppendUint16(dst, uint16(n)), nil
+	}
+	if n > w.MaxPayload() {
+		return dst, ErrFrameTooLarge
+	}
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	return binary.AppendUvarint(dst, uint64(n)), nil
+}
+
+// ReadHeader 从 r 读取一个包头，返回流ID 和负载长度
+// 长度字段格式错误时返回 ErrFrameTooLarge，负载是否超出本端上限由调用方检查
+func (w Wire) ReadHeader(r io.Reader, buf []byte) (id uint32, n int, err error) {
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return 0, 0, err
+	}
+	if w == WireV1 || buf[0] == 0xFF && buf[1] == 0xFF {
+		return uint32(binary.BigEndian.Uint16(buf[0:2])), int(binary.BigEndian.Uint16(buf[2:4])), nil
+	}
+	id = binary.BigEndian.Uint32(buf[0:4])
+	// 长度逐字节读取，不会多读到负载
+	var length uint64
+	for i := 0; ; i++ {
+		if i == maxVarintLen {
+			return 0, 0, ErrFrameTooLarge
+		}
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			if err == io.EOF {
+				// 包头读到一半
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, err
+		}
+		length |= uint64(buf[0]&0x7F) << (7 * i)
+		if buf[0] < 0x80 {
+			break
+		}
+	}
+	return id, int(length), nil
+}
+
+// IsControl 判断 ID 0 上的负载是控制命令还是打开新连接的请求
+func (w Wire) IsControl(data []byte) bool {
+	n := w.IDSize()
+	return len(data) > n && data[n] >= CmdFin && data[n]&OpenCompress == 0
+}
+
+// ControlFrame 构建控制命令负载：[流ID][命令(1)][参数...]
+func (w Wire) ControlFrame(id uint32, cmd byte, args ...byte) []byte {
+	frame := make([]byte, 0, w.IDSize()+1+len(args))
+	frame = w.AppendID(frame, id)
+	frame = append(frame, cmd)
+	return append(frame, args...)
+}
+
+// ParseControl 解析控制命令负载
+func (w Wire) ParseControl(data []byte) (id uint32, cmd byte, args []byte, ok bool) {
+	if !w.IsControl(data) {
+		return 0, 0, nil, false
+	}
+	n := w.IDSize()
+	return w.ID(data), data[n], data[n+1:], true
+}
+
+// WindowUpdateFrame 构建 WINDOW_UPDATE 控制负载
+func (w Wire) WindowUpdateFrame(id uint32, delta int) []byte {
+	args := make([]byte, 4)
+	binary.BigEndian.PutUint32(args, uint32(delta))
+	return w.ControlFrame(id, CmdWindowUpdate, args...)
+}
+
+// PingFrame 构建携带发送时间的 PING 负载
+func (w Wire) PingFrame(sentNano int64) []byte {
+	args := make([]byte, 8)
+	binary.BigEndian.PutUint64(args, uint64(sentNano))
+	return w.ControlFrame(0, CmdPing, args...)
+}
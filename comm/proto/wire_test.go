@@ -0,0 +1,184 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+var wires = []Wire{WireV1, WireV2}
+
+func TestHeaderEncoding(t *testing.T) {
+	tests := []struct {
+		wire Wire
+		id   uint32
+		n    int
+		want string // 十六进制，空表示应返回 ErrFrameTooLarge
+	}{
+		{WireV1, 1, 0, "00010000"},
+		{WireV1, 1, 127, "0001007f"},
+		{WireV1, 1, 128, "00010080"},
+		{WireV1, 0xFFFE, 0xFFFF, "fffeffff"},
+		{WireV1, 1, 0x10000, ""},
+		{WireV1, 1, 1<<21 - 1, ""},
+		{WireV1, HelloID, 22, "ffff0016"},
+
+		{WireV2, 1, 0, "0000000100"},
+		{WireV2, 1, 127, "000000017f"},
+		{WireV2, 1, 128, "000000018001"},
+		{WireV2, 1, 1<<14 - 1, "00000001ff7f"},
+		{WireV2, 1, 1 << 14, "00000001808001"},
+		{WireV2, 1, 1<<21 - 1, "00000001ffff7f"},
+		{WireV2, 1, 1 << 21, ""},
+		{WireV2, 0x10000, 5, "0001000005"},
+		{WireV2, WireV2.IDLimit() - 1, 5, "fffeffff05"},
+		// 握手帧不论格式都是 v1 包头
+		{WireV2, HelloID, 22, "ffff0016"},
+	}
+	for _, tc := range tests {
+		got, err := tc.wire.AppendHeader(nil, tc.id, tc.n)
+		if tc.want == "" {
+			if err != ErrFrameTooLarge {
+				t.Errorf("%v id %x 长度 %d: 期望 ErrFrameTooLarge，得到 %x %v", tc.wire, tc.id, tc.n, got, err)
+			}
+			continue
+		}
+		if err != nil || hex.EncodeToString(got) != tc.want {
+			t.Errorf("%v id %x 长度 %d: %x %v，期望 %s", tc.wire, tc.id, tc.n, got, err, tc.want)
+			continue
+		}
+
+		// 解码后只消耗包头，负载原样留在流中
+		r := bytes.NewReader(append(got, "payload"...))
+		id, n, err := tc.wire.ReadHeader(r, make([]byte, 4))
+		if err != nil || id != tc.id || n != tc.n {
+			t.Errorf("%v 解码 %s: id %x 长度 %d %v", tc.wire, tc.want, id, n, err)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%v 解码 %s 后剩余 %q", tc.wire, tc.want, rest)
+		}
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		wire  Wire
+		input string
+		err   error
+	}{
+		{"v2 长度超过 3 字节", WireV2, "00000001ffffff01", ErrFrameTooLarge},
+		{"v2 第三字节仍有延续位", WireV2, "00000001808080", ErrFrameTooLarge},
+		{"v2 长度截断", WireV2, "0000000180", io.ErrUnexpectedEOF},
+		{"v2 缺少长度", WireV2, "00000001", io.ErrUnexpectedEOF},
+		{"包头截断", WireV1, "000100", io.ErrUnexpectedEOF},
+		{"空输入", WireV2, "", io.EOF},
+	}
+	for _, tc := range tests {
+		raw, _ := hex.DecodeString(tc.input)
+		_, _, err := tc.wire.ReadHeader(bytes.NewReader(raw), make([]byte, 4))
+		if err != tc.err {
+			t.Errorf("%s: 得到 %v，期望 %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+// TestHelloAlwaysV1 v2 连接上也能认出对端的握手，握手之后的帧不受影响
+func TestHelloAlwaysV1(t *testing.T) {
+	hello := Hello{Version: Version, Features: Features, MaxFrame: 1 << 18, SessionID: 42}.Marshal()
+	var stream []byte
+	stream, _ = WireV2.AppendHeader(stream, HelloID, len(hello))
+	stream = append(stream, hello...)
+	stream, _ = WireV2.AppendHeader(stream, 7, 3)
+	stream = append(stream, "abc"...)
+
+	r := bytes.NewReader(stream)
+	buf := make([]byte, 4)
+	id, n, err := WireV2.ReadHeader(r, buf)
+	if err != nil || id != HelloID || n != len(hello) {
+		t.Fatalf("握手包头: id %x 长度 %d %v", id, n, err)
+	}
+	payload := make([]byte, n)
+	io.ReadFull(r, payload)
+	if h, ok := ParseHello(payload); !ok || h.SessionID != 42 {
+		t.Fatalf("握手内容 %+v %v", h, ok)
+	}
+	if id, n, err := WireV2.ReadHeader(r, buf); err != nil || id != 7 || n != 3 {
+		t.Fatalf("握手之后的帧: id %x 长度 %d %v", id, n, err)
+	}
+}
+
+// TestIDSpace 可分配的ID 都在握手保留的范围之外，反向转发的ID 在两者之间
+func TestIDSpace(t *testing.T) {
+	for _, w := range wires {
+		limit, base := w.IDLimit(), w.ServerStreamBase()
+		if !(0 < base && base < limit) {
+			t.Errorf("%v: ServerStreamBase %x 应在 (0, IDLimit %x) 之间", w, base, limit)
+		}
+		for _, id := range []uint32{1, base - 1, base, limit - 1} {
+			b := w.AppendID(nil, id)
+			if len(b) != w.IDSize() || w.ID(b) != id {
+				t.Errorf("%v: 流ID %x 编码为 %x", w, id, b)
+			}
+			header, _ := w.AppendHeader(nil, id, 0)
+			if header[0] == 0xFF && header[1] == 0xFF {
+				t.Errorf("%v: 流ID %x 的包头会被当作握手: %x", w, id, header)
+			}
+		}
+	}
+	if WireV1.IDLimit() != HelloID {
+		t.Errorf("v1 的ID 上限 %x 应为 HelloID", WireV1.IDLimit())
+	}
+	// IDLimit 本身已经落在保留范围内
+	header, _ := WireV2.AppendHeader(nil, WireV2.IDLimit(), 0)
+	if id, _, _ := WireV2.ReadHeader(bytes.NewReader(append(header, 0, 0)), make([]byte, 4)); id != HelloID {
+		t.Errorf("v2 流ID %x 的包头解析为 %x，期望按握手解析", WireV2.IDLimit(), id)
+	}
+}
+
+// TestIsControl 控制命令与打开帧共用 ID 0，按第一个字节区分，压缩标志位 0x80 不会被当作命令
+func TestIsControl(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   byte // 流ID 之后的第一个字节
+		control bool
+	}{
+		{"IPv4 打开帧", AddrIPv4, false},
+		{"域名打开帧", AddrDomain, false},
+		{"UDP 打开帧", AddrIPv4 | OpenDatagram, false},
+		{"DNS 打开帧", AddrDomain | OpenDNS, false},
+		{"压缩的 IPv4 打开帧", AddrIPv4 | OpenCompress, false},
+		{"压缩的域名打开帧", AddrDomain | OpenCompress, false},
+		{"压缩的 UDP 打开帧", AddrIPv6 | OpenDatagram | OpenCompress, false},
+		{"命令位置上的压缩位", CmdFin | OpenCompress, false},
+		{"FIN", CmdFin, true},
+		{"RESUME", CmdResume, true},
+		{"ACCEPT", CmdAccept, true},
+	}
+	for _, w := range wires {
+		for _, id := range []uint32{0, 1, w.IDLimit() - 1} {
+			for _, tc := range tests {
+				data := append(w.AppendID(nil, id), tc.first, 0xAA)
+				if got := w.IsControl(data); got != tc.control {
+					t.Errorf("%v %s 流ID %x: IsControl = %v", w, tc.name, id, got)
+				}
+				gotID, cmd, args, ok := w.ParseControl(data)
+				if ok != tc.control {
+					t.Errorf("%v %s: ParseControl ok = %v", w, tc.name, ok)
+				}
+				if ok && (gotID != id || cmd != tc.first || !bytes.Equal(args, []byte{0xAA})) {
+					t.Errorf("%v %s: 解析为 %x %x %x", w, tc.name, gotID, cmd, args)
+				}
+			}
+		}
+		// 只有流ID 没有命令
+		if w.IsControl(w.AppendID(nil, 1)) {
+			t.Errorf("%v: 缺少命令字节的负载被当作控制帧", w)
+		}
+		frame := w.ControlFrame(w.IDLimit()-1, CmdWindowUpdate, 1, 2, 3, 4)
+		if id, cmd, args, ok := w.ParseControl(frame); !ok || id != w.IDLimit()-1 || cmd != CmdWindowUpdate || len(args) != 4 {
+			t.Errorf("%v: ControlFrame 往返 %x %x %x %v", w, id, cmd, args, ok)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package comm
 
 import (
+	"bytes"
+	"context"
+	"dosgo/btProxy/comm/proto"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +16,29 @@ import (
 var stopChans sync.Map
 
 func StartPortProxy(mux *MuxManager, tcpPort string, remoteAddr string) {
+	startPortProxy(mux, tcpPort, remoteAddr, DefaultPriority, false)
+}
+
+// StartMappingProxy 按映射配置启动端口转发或透明代理，映射的 Priority 决定其流的发送权重
+func StartMappingProxy(mux *MuxManager, m ProxyMapping) {
+	port := fmt.Sprintf(":%d", m.LocalPort)
+	switch m.Type {
+	case "", MappingTCP:
+		startPortProxy(mux, port, m.RemoteAddr, m.Priority, m.Compress)
+	case MappingUDP:
+		startUDPPortProxy(mux, port, m.RemoteAddr, m.Priority)
+	case MappingRedirect:
+		startRedirectProxy(mux, port, m.Priority)
+	case MappingTProxy:
+		startTProxy(mux, port, m.Priority)
+	case MappingReverse:
+		startReverseProxy(mux, port, m.RemoteAddr, m.Priority)
+	default:
+		log.Printf("未知的映射类型 %q，端口 %d 未启动", m.Type, m.LocalPort)
+	}
+}
+
+func startPortProxy(mux *MuxManager, tcpPort string, remoteAddr string, priority int, compress bool) {
 	// 启动 TCP 服务器
 	listener, err := net.Listen("tcp", tcpPort)
 	if err != nil {
@@ -27,42 +54,83 @@ func StartPortProxy(mux *MuxManager, tcpPort string, remoteAddr string) {
 		}
 		log.Printf("%s客户端连接: %s", tcpPort, tcpConn.RemoteAddr())
 		// 处理连接
-		go handleConnection(tcpConn, mux, remoteAddr)
+		go handleConnection(tcpConn, mux, remoteAddr, priority, compress)
 	}
 }
+
+// StopMappingProxy 停止 StartMappingProxy 启动的映射
+func StopMappingProxy(m ProxyMapping) {
+	port := fmt.Sprintf(":%d", m.LocalPort)
+	if m.Type == MappingUDP {
+		// UDP 映射的端口可能同时有 TCP 映射，分开登记
+		port = "udp" + port
+	}
+	StopProxy(port)
+}
+
 func StopProxy(tcpPort string) {
 	if value, ok := stopChans.Load(tcpPort); ok {
-		if listener, ok := value.(net.Listener); ok {
-			listener.Close()
+		if closer, ok := value.(io.Closer); ok {
+			closer.Close()
 		}
 	}
 }
 
-func handleConnection(tcpConn net.Conn, mux *MuxManager, toAddr string) {
+func handleConnection(tcpConn net.Conn, mux *MuxManager, toAddr string, priority int, compress bool) {
 	defer tcpConn.Close()
-	serialPort := mux.OpenStream(toAddr)
+	var serialPort *VirtualConn
+	if compress {
+		ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+		v, err := mux.OpenCompressedStreamContext(ctx, toAddr)
+		cancel()
+		if err != nil {
+			fmt.Printf("打开流失败: %v\n", err)
+		}
+		serialPort = v
+	} else {
+		serialPort = mux.OpenStream(toAddr)
+	}
 	if serialPort == nil {
 		fmt.Println("无法打开流")
 		return
 	}
 	defer serialPort.Close()
+	serialPort.SetPriority(priority)
+	relay(tcpConn, serialPort)
+	log.Printf("连接断开: %s", tcpConn.RemoteAddr())
+}
+
+// relay 在本地连接与 Mux 流之间双向转发，一侧读到 EOF 时以半关闭的方式通知另一侧
+func relay(tcpConn net.Conn, serialPort *VirtualConn) {
+	done := make(chan struct{})
 	// TCP → 串口
 	go func() {
+		defer close(done)
 		_, err := io.Copy(serialPort, tcpConn)
 		if err != nil {
 			log.Printf("TCP→串口转发错误: %v", err)
 		}
+		serialPort.CloseWrite()
 	}()
 
 	_, err := io.Copy(tcpConn, serialPort)
 	if err != nil {
 		log.Printf("串口→TCP转发错误: %v", err)
+		// 流被重置，直接断开本地连接
+		tcpConn.Close()
+	} else if tc, ok := tcpConn.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
 	}
-	log.Printf("连接断开: %s", tcpConn.RemoteAddr())
+	<-done
 }
 
 /*socks5*/
 func StartSocksProxy(mux *MuxManager, socksPort string) {
+	StartSocksProxyAuth(mux, socksPort, nil)
+}
+
+// StartSocksProxyAuth 启动 SOCKS5 代理，users 非空时要求用户名/密码认证 (RFC 1929)
+func StartSocksProxyAuth(mux *MuxManager, socksPort string, users []ProxyUser) {
 	listener, err := net.Listen("tcp", socksPort)
 	if err != nil {
 		log.Fatalf("SOCKS5 监听失败: %v", err)
@@ -73,15 +141,19 @@ func StartSocksProxy(mux *MuxManager, socksPort string) {
 	for {
 		tcpConn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// 被 StopProxy 关闭
+				return
+			}
 			log.Printf("接受连接失败: %v", err)
 			continue
 		}
 		// 每个连接进入独立的处理逻辑
-		go handleSocksConnection(tcpConn, mux)
+		go handleSocksConnection(tcpConn, mux, users)
 	}
 }
 
-func handleSocksConnection(conn net.Conn, mux *MuxManager) {
+func handleSocksConnection(conn net.Conn, mux *MuxManager, users []ProxyUser) {
 	defer conn.Close()
 
 	// --- 1. SOCKS5 认证握手 ---
@@ -94,73 +166,204 @@ func handleSocksConnection(conn net.Conn, mux *MuxManager) {
 	if _, err := io.ReadFull(conn, buf[:nMethods]); err != nil {
 		return
 	}
-	// 回应客户端: 无需认证 (05 00)
-	conn.Write([]byte{0x05, 0x00})
+	// 配置了用户时只接受用户名/密码认证，否则只接受无需认证
+	method := socksNoAuth
+	if len(users) > 0 {
+		method = socksUserPass
+	}
+	if bytes.IndexByte(buf[:nMethods], method) < 0 {
+		// 没有可接受的认证方式 (05 FF)
+		conn.Write([]byte{0x05, socksNoAcceptable})
+		log.Printf("SOCKS5 客户端 %s 没有可接受的认证方式", conn.RemoteAddr())
+		return
+	}
+	conn.Write([]byte{0x05, method})
+	var user *ProxyUser
+	if method == socksUserPass {
+		if user = socksAuthenticate(conn, users); user == nil {
+			return
+		}
+	}
 
 	// --- 2. 解析客户端请求地址 ---
 	// 客户端发送: [VER, CMD, RSV, ATYP, ADDR, PORT]
-	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return
+	}
+	cmd := buf[1]
+	fullTarget, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case socksConnect:
+	case socksUDPAssociate:
+		handleSocksUDP(conn, mux, fullTarget, user)
+		return
+	default:
+		// BIND 等命令不支持
+		log.Printf("SOCKS5 不支持的命令: %#x", cmd)
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	if user != nil && !user.Allowed(fullTarget) {
+		log.Printf("SOCKS5 用户 %s 不允许访问 %s", user.Username, fullTarget)
+		// Connection not allowed by ruleset
+		conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 		return
 	}
 
+	// --- 3. 建立 Mux 流 ---
+	// 等待服务端拨号结果后再回复客户端
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	serialPort, err := mux.OpenStreamContext(ctx, fullTarget)
+	cancel()
+	if err != nil {
+		log.Printf("SOCKS5 打开流失败: %v", err)
+		// 告诉客户端连接失败 (SOCKS5 响应: 05 REP 00 ...)
+		conn.Write([]byte{0x05, socksReply(err), 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer serialPort.Close()
+
+	// 告诉客户端连接成功 (SOCKS5 响应: 05 00 00 01 ...)
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	// --- 4. 双向转发 ---
+	relay(conn, serialPort)
+
+	localAddr := conn.RemoteAddr().(*net.TCPAddr)
+	log.Printf("SOCKS5 代理流关闭: %s -> %s", localAddr, fullTarget)
+}
+
+// SOCKS5 认证方式
+const (
+	socksNoAuth       byte = 0x00
+	socksUserPass     byte = 0x02
+	socksNoAcceptable byte = 0xFF
+)
+
+// socksAuthenticate 完成用户名/密码子协商 (RFC 1929)，失败时返回 nil
+// 客户端发送: [VER(01), ULEN, UNAME, PLEN, PASSWD]，回应: [VER(01), STATUS]
+func socksAuthenticate(conn net.Conn, users []ProxyUser) *ProxyUser {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil
+	}
+	if buf[0] != 0x01 {
+		log.Printf("SOCKS5 认证子协议版本错误: %d", buf[0])
+		return nil
+	}
+	name := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return nil
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return nil
+	}
+	password := buf[:buf[0]]
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil
+	}
+	user := lookupUser(users, string(name))
+	if user == nil || !user.CheckPassword(string(password)) {
+		log.Printf("SOCKS5 用户 %q 认证失败: %s", name, conn.RemoteAddr())
+		conn.Write([]byte{0x01, 0x01})
+		return nil
+	}
+	conn.Write([]byte{0x01, 0x00})
+	return user
+}
+
+// SOCKS5 请求命令
+const (
+	socksConnect      byte = 0x01
+	socksBind         byte = 0x02
+	socksUDPAssociate byte = 0x03
+)
+
+// readSocksAddr 读取 [ATYP, ADDR, PORT]，返回 host:port
+func readSocksAddr(r io.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
 	var destAddr string
-	atyp := buf[3] // 地址类型
+	atyp := buf[0] // 地址类型
 
 	switch atyp {
 	case 0x01: // IPv4
-		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return "", err
 		}
 		destAddr = net.IP(buf[:4]).String()
 	case 0x03: // 域名
-		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
 		}
 		addrLen := buf[0]
-		if _, err := io.ReadFull(conn, buf[:addrLen]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:addrLen]); err != nil {
+			return "", err
 		}
 		destAddr = string(buf[:addrLen])
 	case 0x04: // IPv6
-		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return "", err
 		}
 		destAddr = net.IP(buf[:16]).String()
 	default:
-		return
+		return "", fmt.Errorf("未知的地址类型: %d", atyp)
 	}
 
 	// 读取端口 (2字节)
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
 	}
 	destPort := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(destAddr, fmt.Sprintf("%d", destPort)), nil
+}
 
-	fullTarget := net.JoinHostPort(destAddr, fmt.Sprintf("%d", destPort))
-
-	// --- 3. 建立 Mux 流 ---
-	// 这里的 portID 依然可以用本地随机端口，或者自定义逻辑
-	serialPort := mux.OpenStream(fullTarget)
-	// 注意：确保你的 mux.OpenStream 内部使用了你之前写的带有 flag 的 packPayload
-
-	if serialPort == nil {
-		// 告诉客户端连接失败 (SOCKS5 响应: 05 01 00 ...)
-		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
-		return
+// appendSocksAddr 追加 [ATYP, ADDR, PORT]
+func appendSocksAddr(dst []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, 0x01)
+			dst = append(dst, ip4...)
+		} else {
+			dst = append(dst, 0x04)
+			dst = append(dst, ip.To16()...)
+		}
+	} else {
+		dst = append(dst, 0x03, byte(len(host)))
+		dst = append(dst, host...)
 	}
-	defer serialPort.Close()
-
-	// 告诉客户端连接成功 (SOCKS5 响应: 05 00 00 01 ...)
-	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
-
-	// --- 4. 双向转发 ---
-
-	go func() {
-		io.Copy(serialPort, conn)
-	}()
-
-	io.Copy(conn, serialPort)
+	return binary.BigEndian.AppendUint16(dst, port)
+}
 
-	localAddr := conn.RemoteAddr().(*net.TCPAddr)
-	log.Printf("SOCKS5 代理流关闭: %s -> %s:%d", localAddr, destAddr, destPort)
+// socksReply 把打开流的错误转换为 SOCKS5 REP 字段
+func socksReply(err error) byte {
+	if errors.Is(err, ErrDatagramUnsupported) {
+		return 0x07 // Command not supported
+	}
+	var openErr *OpenError
+	if !errors.As(err, &openErr) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0x04 // Host unreachable
+		}
+		return 0x01 // General failure
+	}
+	switch openErr.Code {
+	case proto.OpenRefused:
+		return 0x05 // Connection refused
+	case proto.OpenNetUnreach:
+		return 0x03 // Network unreachable
+	case proto.OpenHostUnreach, proto.OpenDNSFailure, proto.OpenTimeout:
+		return 0x04 // Host unreachable
+	case proto.OpenDenied:
+		return 0x02 // Connection not allowed by ruleset
+	default:
+		return 0x01
+	}
 }
@@ -0,0 +1,209 @@
+package comm
+
+import (
+	"crypto/rand"
+	"dosgo/btProxy/comm/proto"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// newSessionID 生成非零的随机会话ID
+func newSessionID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// writeFailed 可恢复的会话写入失败时不把错误交给各个流：
+// 数据已记入重传缓冲，重新握手接回会话后按对端报告补发
+func (m *MuxManager) writeFailed(err error) bool {
+	if !m.has(proto.FeatResume) {
+		return false
+	}
+	m.linkErrs.Add(1)
+	m.startHandshake()
+	return true
+}
+
+// handleResume 拼接对端的恢复报告，收齐后交给等待中的握手
+func (m *MuxManager) handleResume(w proto.Wire, args []byte) {
+	entries, last, ok := w.ParseResume(args)
+	if !ok {
+		fmt.Printf("无效的恢复报告: %x\n", args)
+		return
+	}
+	m.resumeBuf = append(m.resumeBuf, entries...)
+	if !last {
+		return
+	}
+	entries, m.resumeBuf = m.resumeBuf, nil
+	select {
+	case m.resumeCh <- entries:
+	default:
+	}
+}
+
+// resume 服务端接回了原有会话：交换双方每个流收到的字节数，补发断开时丢失的数据
+// 期间链路出错（linkErrs 不再等于 errs）时返回 false，由调用方重新握手
+func (m *MuxManager) resume(errs uint32) bool {
+	m.mu.RLock()
+	entries := make([]proto.ResumeEntry, 0, len(m.streams))
+	for id, v := range m.streams {
+		entries = append(entries, proto.ResumeEntry{
+			ID:       id,
+			Received: v.received.Load(),
+			Granted:  v.granted.Load(),
+			// 仍在表中且读端已关闭，说明收到过对端的 FIN
+			FinRecv: v.readClosed && !v.reset,
+		})
+	}
+	m.mu.RUnlock()
+	// 握手已经切换到新协商出的格式
+	for _, frame := range m.wire().ResumeFrames(entries, m.frameLimit()) {
+		if err := m.sched.sendUrgent(0, raw(frame)); err != nil {
+			fmt.Printf("发送恢复报告失败: %v\n", err)
+			return false
+		}
+	}
+	select {
+	case peer := <-m.resumeCh:
+		m.applyResume(peer)
+	case <-time.After(helloTimeout):
+		if m.linkErrs.Load() != errs {
+			return false
+		}
+		fmt.Printf("警告: 等待对端恢复报告超时\n")
+		m.dropStreams()
+	}
+	return true
+}
+
+// corrupted 分帧层丢弃了损坏的帧：之后的数据帧与已收字节数对不上，
+// 全部丢弃并重新握手，由恢复报告补齐
+func (m *MuxManager) corrupted() {
+	if !m.has(proto.FeatResume) {
+		fmt.Printf("警告: 丢弃了损坏的帧，对端不支持会话恢复，流数据可能缺失\n")
+		return
+	}
+	if m.discarding.Swap(true) {
+		// 已在重新同步，丢的可能是握手回复或恢复报告，让等待中的握手重来而不是超时回退
+		m.linkErrs.Add(1)
+		return
+	}
+	fmt.Printf("丢弃了损坏的帧，重新同步\n")
+	m.requestResync()
+}
+
+// requestResync 在同一条链路上重新握手恢复会话，握手进行中时等它结束后再来一次
+func (m *MuxManager) requestResync() {
+	m.linkErrs.Add(1)
+	m.mu.Lock()
+	if m.handshaking {
+		m.rehello = true
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+	m.startHandshake()
+}
+
+// discardable 判断重新同步前是否丢弃该帧：数据帧和 FIN 依赖字节序号，由恢复时重传
+func discardable(w proto.Wire, id uint32, payload []byte) bool {
+	if id != 0 {
+		return true
+	}
+	_, cmd, _, ok := w.ParseControl(payload)
+	return ok && cmd == proto.CmdFin
+}
+
+// applyResume 按对端报告重传丢失的数据、校正额度，双方状态不一致的流直接重置
+func (m *MuxManager) applyResume(entries []proto.ResumeEntry) {
+	peer := make(map[uint32]proto.ResumeEntry, len(entries))
+	for _, e := range entries {
+		peer[e.ID] = e
+	}
+	type resend struct {
+		id   uint32
+		data []byte
+		fin  bool
+	}
+	var todo []resend
+	var rst []uint32
+	m.mu.Lock()
+	for id, v := range m.streams {
+		e, ok := peer[id]
+		delete(peer, id)
+		if !ok {
+			// 对端已经没有这个流了，包括丢在断开链路上的打开请求
+			m.dropLocked(v)
+			continue
+		}
+		data, ok := v.replay.Since(e.Received)
+		if !ok {
+			fmt.Printf("流 %d 需要重传的数据已丢弃，重置\n", id)
+			m.dropLocked(v)
+			rst = append(rst, id)
+			continue
+		}
+		v.replay.Ack(e.Received)
+		v.sendWin.Set(int(int64(e.Granted) - int64(v.replay.Sent())))
+		// 对端保留着这个流说明拨号已经成功，结果帧可能丢在了断开的链路上
+		select {
+		case v.openCh <- proto.OpenSuccess:
+		default:
+		}
+		todo = append(todo, resend{id, data, v.finWritten.Load() && !e.FinRecv})
+	}
+	// 本端已经没有的流
+	for id := range peer {
+		rst = append(rst, id)
+	}
+	m.mu.Unlock()
+
+	// 暂停期间只有 urgent 帧能发出，补发的数据一定排在新数据之前
+	limit := m.frameLimit()
+	for _, r := range todo {
+		for len(r.data) > 0 {
+			n := min(len(r.data), limit)
+			m.sched.sendUrgent(r.id, raw(r.data[:n]))
+			r.data = r.data[n:]
+		}
+		if r.fin {
+			m.sched.sendUrgent(0, control(r.id, proto.CmdFin))
+		}
+	}
+	for _, id := range rst {
+		m.sched.sendUrgent(0, control(id, proto.CmdRst))
+	}
+	fmt.Printf("会话已恢复: %d 个流继续传输\n", len(todo))
+}
+
+// dropStreams 对端是全新的会话，之前的流在对端都已不存在
+func (m *MuxManager) dropStreams() {
+	m.mu.Lock()
+	n := len(m.streams)
+	for _, v := range m.streams {
+		m.dropLocked(v)
+	}
+	m.mu.Unlock()
+	if n > 0 {
+		fmt.Printf("重连后无法恢复会话，重置 %d 个流\n", n)
+	}
+}
+
+// dropLocked 本地重置流但不通知对端，调用方需持有 mu 写锁
+func (m *MuxManager) dropLocked(v *VirtualConn) {
+	v.reset = true
+	v.abortLocked(ErrStreamReset)
+	delete(m.streams, v.id)
+	m.sched.release(v.id, ErrStreamReset)
+	select {
+	case v.openCh <- proto.OpenFailure:
+	default:
+	}
+}
@@ -0,0 +1,234 @@
+package comm
+
+import (
+	"bytes"
+	"dosgo/btProxy/comm/server"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowConn 限速写出，保证断开链路时还有在途数据
+type slowConn struct{ net.Conn }
+
+func (s slowConn) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(len(p)) * 100 * time.Nanosecond)
+	return s.Conn.Write(p)
+}
+
+// listen 在本机端口上接受连接，每个连接交给 serve
+// 测试结束时关闭所有连接并等 serve 返回，服务端的读协程不会延续到下一个测试
+func listen(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// resumeLink 启动服务端，返回经过限速的客户端链路，Reconnect 即模拟蓝牙断开
+func resumeLink(t *testing.T) *Link {
+	addr := listen(t, func(c net.Conn) {
+		h := server.NewBluetoothMuxHandler(slowConn{c})
+		h.SetKeepalive(0, 0)
+		h.Start()
+		<-h.Done()
+		c.Close()
+	})
+	return NewLink("tcp://"+addr, func() (io.ReadWriteCloser, error) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return slowConn{c}, nil
+	})
+}
+
+// countingWriter 记录已写入的字节数，用于在传输中途断开链路
+type countingWriter struct {
+	buf bytes.Buffer
+	n   atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return c.buf.Write(p)
+}
+
+// sameBytes 比较收到的数据，报告第一处重复或缺失的偏移
+func sameBytes(t *testing.T, what string, got, want []byte) {
+	t.Helper()
+	if bytes.Equal(got, want) {
+		return
+	}
+	i := 0
+	for i < len(got) && i < len(want) && got[i] == want[i] {
+		i++
+	}
+	t.Fatalf("%s: 收到 %d 字节，期望 %d 字节，第一处不同在偏移 %d", what, len(got), len(want), i)
+}
+
+// TestResumeBothDirections 上传和下载途中两次断开链路，接回会话后双方收到的字节完全一致
+func TestResumeBothDirections(t *testing.T) {
+	const size = 4 << 20
+	down := make([]byte, size)
+	up := make([]byte, size)
+	rand.Read(down)
+	rand.Read(up)
+
+	source := listen(t, func(c net.Conn) {
+		c.Write(down)
+		c.Close()
+	})
+	sink := &countingWriter{}
+	sunk := make(chan struct{})
+	target := listen(t, func(c net.Conn) {
+		io.Copy(sink, c)
+		c.Close()
+		close(sunk)
+	})
+
+	link := resumeLink(t)
+	m := NewMuxManager(link)
+	defer m.CloseBt()
+
+	d := m.OpenStream(source)
+	u := m.OpenStream(target)
+	if d == nil || u == nil {
+		t.Fatal("打开流失败")
+	}
+	go func() {
+		u.Write(up)
+		u.CloseWrite()
+	}()
+	got := &countingWriter{}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(got, d)
+		copied <- err
+	}()
+
+	// 两个方向都传到一定进度时断开，共断开两次
+	for _, mark := range []int64{size / 4, size / 2} {
+		deadline := time.Now().Add(20 * time.Second)
+		for got.n.Load() < mark || sink.n.Load() < mark {
+			if time.Now().After(deadline) {
+				t.Fatalf("传输停滞: 下载 %d 上传 %d", got.n.Load(), sink.n.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		link.Reconnect()
+	}
+
+	select {
+	case err := <-copied:
+		if err != nil {
+			t.Fatalf("下载出错: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("下载没有完成")
+	}
+	select {
+	case <-sunk:
+	case <-time.After(30 * time.Second):
+		t.Fatal("上传没有完成")
+	}
+	if s := link.Stats(); s.Drops < 2 {
+		t.Fatalf("链路只断开了 %d 次", s.Drops)
+	}
+	sameBytes(t, "下载", got.buf.Bytes(), down)
+	sameBytes(t, "上传", sink.buf.Bytes(), up)
+}
+
+// TestResumeExpiredSession 服务端的会话等待重连超时后，重连得到新会话：
+// 旧流被重置而不是收到错位的数据，新流可以正常使用
+func TestResumeExpiredSession(t *testing.T) {
+	grace := server.ResumeGrace
+	server.ResumeGrace = 50 * time.Millisecond
+	defer func() { server.ResumeGrace = grace }()
+
+	echo := listen(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	link := resumeLink(t)
+	m := NewMuxManager(link)
+	defer m.CloseBt()
+
+	v := m.OpenStream(echo)
+	if v == nil {
+		t.Fatal("打开流失败")
+	}
+	msg := []byte("before")
+	v.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(v, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("回显 %q %v", buf, err)
+	}
+
+	// 客户端读取出错后要过一会儿才重连，服务端的会话先过期
+	link.Reconnect()
+	read := make(chan error, 1)
+	go func() {
+		n, err := v.Read(buf)
+		if err == nil {
+			t.Errorf("会话过期后旧流仍然可读: %q", buf[:n])
+		}
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil && err != ErrStreamReset {
+			t.Fatalf("旧流应被重置，得到 %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("会话过期后旧流没有被重置")
+	}
+
+	w := m.OpenStream(echo)
+	if w == nil {
+		t.Fatal("新会话打开流失败")
+	}
+	defer w.Close()
+	msg = []byte("after")
+	w.Write(msg)
+	buf = make([]byte, len(msg))
+	if _, err := io.ReadFull(w, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("新会话回显 %q %v", buf, err)
+	}
+}
@@ -0,0 +1,236 @@
+package comm
+
+import (
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrReverseUnsupported = errors.New("对端不支持反向转发")
+
+// RemoteListener 服务端上的一个 TCP 监听，服务端接受的连接经 Mux 送回本端，由本端拨号 target
+// 重连后服务端是全新会话时自动重新监听
+type RemoteListener struct {
+	m        *MuxManager
+	id       uint32
+	addr     string // 服务端监听地址
+	target   string // 本端拨号的地址
+	priority int
+	reply    chan byte // 服务端的监听结果
+}
+
+// ListenRemote 请求服务端在 remoteAddr 上监听（类似 ssh -R），每个连接在本端拨号 target 后双向转发
+// 服务端默认只允许监听回环地址，其他地址需要服务端的访问控制允许；监听失败时返回 *OpenError
+func (m *MuxManager) ListenRemote(ctx context.Context, remoteAddr, target string, priority int) (*RemoteListener, error) {
+	host, portStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xFFFF || len(host) > 0xFF {
+		return nil, errors.New("无效的监听地址 " + remoteAddr)
+	}
+	if err := m.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	if !m.has(proto.FeatReverse) {
+		return nil, ErrReverseUnsupported
+	}
+	l := &RemoteListener{m: m, addr: remoteAddr, target: target, priority: priority, reply: make(chan byte, 1)}
+	m.mu.Lock()
+	for {
+		m.lastListenerID++
+		if _, used := m.listeners[uint32(m.lastListenerID)]; !used && m.lastListenerID != 0 {
+			break
+		}
+	}
+	l.id = uint32(m.lastListenerID)
+	m.listeners[l.id] = l
+	m.mu.Unlock()
+
+	if err := m.writePacket(l.listenFrame()); err != nil {
+		l.unregister()
+		return nil, err
+	}
+	select {
+	case code := <-l.reply:
+		if code != proto.OpenSuccess {
+			l.unregister()
+			return nil, &OpenError{Addr: remoteAddr, Code: code}
+		}
+		return l, nil
+	case <-ctx.Done():
+		l.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// listenFrame 构建 LISTEN 控制负载
+func (l *RemoteListener) listenFrame() payload {
+	host, portStr, _ := net.SplitHostPort(l.addr)
+	port, _ := strconv.Atoi(portStr)
+	return control(l.id, proto.CmdListen, proto.AppendAddr(nil, host, uint16(port))...)
+}
+
+// Addr 返回服务端的监听地址
+func (l *RemoteListener) Addr() string {
+	return l.addr
+}
+
+// Close 停止服务端的监听，已经建立的连接不受影响
+func (l *RemoteListener) Close() error {
+	if !l.unregister() {
+		return nil
+	}
+	if !l.m.has(proto.FeatReverse) {
+		return nil
+	}
+	return l.m.writePacket(control(l.id, proto.CmdUnlisten))
+}
+
+func (l *RemoteListener) unregister() bool {
+	m := l.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listeners[l.id] != l {
+		return false
+	}
+	delete(m.listeners, l.id)
+	return true
+}
+
+// relisten 对端是全新的会话时重新发出所有监听请求，在握手中调用，不等待发送完成
+func (m *MuxManager) relisten() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.listeners) == 0 {
+		return
+	}
+	if !m.has(proto.FeatReverse) {
+		log.Printf("对端不支持反向转发，%d 个监听失效", len(m.listeners))
+		return
+	}
+	for _, l := range m.listeners {
+		m.sched.postControl(l.listenFrame())
+	}
+	log.Printf("重新请求 %d 个反向转发监听", len(m.listeners))
+}
+
+// handleListenReply 把监听结果交给等待中的 ListenRemote，重新监听失败时只能记录下来
+func (m *MuxManager) handleListenReply(id uint32, args []byte) {
+	code := proto.OpenFailure
+	if len(args) > 0 {
+		code = args[0]
+	}
+	m.mu.RLock()
+	l := m.listeners[id]
+	m.mu.RUnlock()
+	if l == nil {
+		return
+	}
+	select {
+	case l.reply <- code:
+	default:
+		if code != proto.OpenSuccess {
+			log.Printf("反向转发重新监听 %s 失败: %s", l.addr, proto.OpenCodeText(code))
+		}
+	}
+}
+
+// handleAccept 服务端接受了一个连接，拨号本地目标后回复结果，在 readLoop 中调用
+func (m *MuxManager) handleAccept(w proto.Wire, id uint32, args []byte) {
+	var l *RemoteListener
+	var peer string
+	if n := w.IDSize(); len(args) >= n {
+		m.mu.RLock()
+		l = m.listeners[w.ID(args)]
+		_, used := m.streams[id]
+		m.mu.RUnlock()
+		if used || id < w.ServerStreamBase() || id >= w.IDLimit() {
+			l = nil
+		}
+		if host, port, _, ok := proto.ParseAddr(args[n:]); ok {
+			peer = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+	}
+	if l == nil {
+		m.sched.postControl(control(id, proto.CmdOpenReply, proto.OpenRefused))
+		return
+	}
+	go m.acceptReverse(id, l, peer)
+}
+
+func (m *MuxManager) acceptReverse(id uint32, l *RemoteListener, peer string) {
+	conn, err := net.DialTimeout("tcp", l.target, 5*time.Second)
+	if err != nil {
+		log.Printf("反向转发连接 %s 失败: %v", l.target, err)
+		m.writePacket(control(id, proto.CmdOpenReply, proto.DialErrorCode(err)))
+		return
+	}
+	defer conn.Close()
+	v := m.newVirtualConn(id)
+	v.SetPriority(l.priority)
+	m.mu.Lock()
+	m.streams[id] = v
+	m.mu.Unlock()
+	defer v.Close()
+	if err := m.writePacket(control(id, proto.CmdOpenReply, proto.OpenSuccess)); err != nil {
+		return
+	}
+	log.Printf("反向转发连接: %s -> %s", peer, l.target)
+	relay(conn, v)
+	log.Printf("反向转发连接断开: %s", peer)
+}
+
+// startReverseProxy 反向映射：服务端监听 remoteAddr，连接转发到本机的 port
+func startReverseProxy(mux *MuxManager, port string, remoteAddr string, priority int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopper := &reverseMapping{cancel: cancel}
+	stopChans.Store(port, stopper)
+	l, err := mux.ListenRemote(ctx, remoteAddr, "127.0.0.1"+port, priority)
+	if err != nil {
+		log.Printf("反向转发 %s 启动失败: %v", remoteAddr, err)
+		return
+	}
+	if !stopper.set(l) {
+		// 等待期间已被停止
+		l.Close()
+		return
+	}
+	log.Printf("反向转发启动: 服务端 %s -> 本机 %s", remoteAddr, port)
+}
+
+// reverseMapping 供 StopProxy 停止反向映射，监听建立前停止时取消等待
+type reverseMapping struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	listener *RemoteListener
+	stopped  bool
+}
+
+func (r *reverseMapping) set(l *RemoteListener) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.listener = l
+	return true
+}
+
+func (r *reverseMapping) Close() error {
+	r.mu.Lock()
+	r.stopped = true
+	l := r.listener
+	r.mu.Unlock()
+	r.cancel()
+	if l != nil {
+		return l.Close()
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package comm
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"io"
+	"sync"
+)
+
+// schedQuantum 每个流每轮可发送的字节数（乘以权重），即差额轮询(DRR)的量子
+const schedQuantum = 4 * 1024
+
+// DefaultPriority 流的默认权重
+const DefaultPriority = 1
+
+// streamBacklog 每个流最多排队的数据帧数，排满后写入方阻塞
+// 写入方不等每一帧写出就返回，流轮到时队列里总有帧可发，权重才能生效
+const streamBacklog = 4
+
+// payload 按写出时的帧格式构建负载：控制帧中的流ID 长度取决于协商结果，
+// 握手前排队的控制帧可能在握手之后才写出
+type payload func(w proto.Wire) []byte
+
+// raw 负载与帧格式无关，例如数据帧和握手
+func raw(data []byte) payload {
+	return func(proto.Wire) []byte { return data }
+}
+
+// control 构建控制命令负载
+func control(id uint32, cmd byte, args ...byte) payload {
+	return func(w proto.Wire) []byte { return w.ControlFrame(id, cmd, args...) }
+}
+
+type frameReq struct {
+	id      uint32 // 包头中的 ID
+	data    payload
+	size    int          // 负载的大致长度，用于轮询计费
+	onWrite func()       // 即将写入物理连接时调用，用于记录会话恢复所需的序号
+	done    chan error   // 为 nil 时写入方不等待结果，出错记在 queue 上
+	queue   *streamQueue // 所属流的队列，控制帧为 nil
+}
+
+// streamQueue 单个流的待发送队列，流关闭前一直保留，队列排空时额度清零
+type streamQueue struct {
+	key      uint32
+	weight   int
+	deficit  int
+	granted  bool // 本轮是否已经加过量子
+	inRing   bool
+	released bool  // 流已关闭，队列排空后删除
+	err      error // 不等待结果的帧写入失败或流被重置，之后的写入直接返回它
+	reqs     []*frameReq
+}
+
+// writeScheduler 独占物理连接的写端：控制帧优先，数据帧按权重做差额轮询，
+// 避免一个大流量的流把其他交互式的流饿死
+type writeScheduler struct {
+	w       io.Writer
+	mu      sync.Mutex
+	cond    *sync.Cond
+	space   *sync.Cond  // 某个流的队列有了空位
+	urgent  []*frameReq // 握手和会话恢复帧，暂停期间也会发送
+	control []*frameReq
+	queues  map[uint32]*streamQueue
+	ring    []*streamQueue // 有待发数据的流，按轮转顺序排列
+	next    int
+	paused  bool              // 重新握手期间只发送 urgent
+	wire    func() proto.Wire // 当前协商出的帧格式
+
+	// onError 普通帧写入失败时调用，返回 true 表示吞掉错误（帧会在会话恢复后补发）
+	onError func(error) bool
+}
+
+func newWriteScheduler(w io.Writer, wire func() proto.Wire, onError func(error) bool) *writeScheduler {
+	s := &writeScheduler{
+		w:       w,
+		wire:    wire,
+		queues:  make(map[uint32]*streamQueue),
+		onError: onError,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.space = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// setPaused 暂停或恢复普通帧的发送
+func (s *writeScheduler) setPaused(paused bool) {
+	s.mu.Lock()
+	s.paused = paused
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// sendUrgent 发送握手和会话恢复帧，排在所有帧之前且不受暂停影响，写入错误原样返回
+func (s *writeScheduler) sendUrgent(id uint32, data payload) error {
+	req := &frameReq{id: id, data: data, done: make(chan error, 1)}
+	s.mu.Lock()
+	s.urgent = append(s.urgent, req)
+	s.mu.Unlock()
+	s.cond.Signal()
+	return <-req.done
+}
+
+// sendControl 发送控制帧，排在所有数据帧之前，阻塞直到写入物理连接
+func (s *writeScheduler) sendControl(data payload, onWrite func()) error {
+	req := &frameReq{data: data, onWrite: onWrite, done: make(chan error, 1)}
+	s.mu.Lock()
+	s.control = append(s.control, req)
+	s.mu.Unlock()
+	s.cond.Signal()
+	return <-req.done
+}
+
+// postControl 把控制帧放入队列后立即返回，供 readLoop 使用：
+// 握手期间普通帧暂停发送，readLoop 若在这里阻塞就收不到握手回复
+func (s *writeScheduler) postControl(data payload) {
+	req := &frameReq{data: data, done: make(chan error, 1)}
+	s.mu.Lock()
+	s.control = append(s.control, req)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// sendStream 把数据帧放入流 key 的队列后返回，队列已满时阻塞到有空位，data 在写出之前不能再修改
+// 同一个流的帧（包括它的 FIN）保持先后顺序，写入错误在该流的下一次发送时返回
+func (s *writeScheduler) sendStream(key uint32, weight int, data []byte, onWrite func()) error {
+	return s.enqueue(key, weight, &frameReq{id: key, data: raw(data), size: len(data), onWrite: onWrite})
+}
+
+// sendStreamControl 把控制帧（FIN、关闭时的 RST）放入流 key 的队列，排在该流已经写入的数据之后，阻塞直到写入物理连接
+func (s *writeScheduler) sendStreamControl(key uint32, weight int, data payload, onWrite func()) error {
+	return s.enqueue(key, weight, &frameReq{data: data, onWrite: onWrite, done: make(chan error, 1)})
+}
+
+func (s *writeScheduler) enqueue(key uint32, weight int, req *frameReq) error {
+	if weight <= 0 {
+		weight = DefaultPriority
+	}
+	s.mu.Lock()
+	q, ok := s.queues[key]
+	if !ok {
+		q = &streamQueue{key: key}
+		s.queues[key] = q
+	}
+	q.weight = weight
+	q.released = false
+	for req.done == nil && q.err == nil && len(q.reqs) >= streamBacklog {
+		s.space.Wait()
+	}
+	if q.err != nil {
+		err := q.err
+		s.mu.Unlock()
+		return err
+	}
+	req.queue = q
+	q.reqs = append(q.reqs, req)
+	if !q.inRing {
+		q.inRing = true
+		s.ring = append(s.ring, q)
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+	if req.done == nil {
+		return nil
+	}
+	return <-req.done
+}
+
+// release 流已关闭，队列排空后删除；err 非 nil 时丢弃还没写出的帧，
+// 等待结果的写入方和之后的写入都收到 err，用于对端重置或本地放弃的流
+func (s *writeScheduler) release(key uint32, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[key]
+	if !ok {
+		return
+	}
+	if err != nil {
+		for _, req := range q.reqs {
+			if req.done != nil {
+				req.done <- err
+			}
+		}
+		q.reqs = nil
+		q.err = err
+		s.space.Broadcast()
+	}
+	q.released = true
+	if len(q.reqs) == 0 {
+		s.removeLocked(q)
+	}
+}
+
+// removeLocked 把队列移出轮转和索引，调用方需持有 s.mu
+func (s *writeScheduler) removeLocked(q *streamQueue) {
+	if q.inRing {
+		for i, r := range s.ring {
+			if r == q {
+				s.ring = append(s.ring[:i], s.ring[i+1:]...)
+				if i < s.next {
+					s.next--
+				}
+				break
+			}
+		}
+		q.inRing = false
+	}
+	if s.queues[q.key] == q {
+		delete(s.queues, q.key)
+	}
+}
+
+func (s *writeScheduler) run() {
+	for {
+		s.mu.Lock()
+		for len(s.urgent) == 0 && (s.paused || len(s.control) == 0 && len(s.ring) == 0) {
+			s.cond.Wait()
+		}
+		var req *frameReq
+		urgent := len(s.urgent) > 0
+		if urgent {
+			req = s.urgent[0]
+			s.urgent = s.urgent[1:]
+		} else if len(s.control) > 0 {
+			req = s.control[0]
+			s.control = s.control[1:]
+		} else {
+			req = s.pickLocked()
+		}
+		s.mu.Unlock()
+		if req.onWrite != nil {
+			req.onWrite()
+		}
+		w := s.wire()
+		err := s.writeFrame(w, req.id, req.data(w))
+		if err != nil && err != proto.ErrFrameTooLarge && !urgent && s.onError != nil && s.onError(err) {
+			err = nil
+		}
+		if req.done != nil {
+			req.done <- err
+		} else if err != nil {
+			s.mu.Lock()
+			if req.queue.err == nil {
+				req.queue.err = err
+			}
+			s.mu.Unlock()
+			s.space.Broadcast()
+		}
+	}
+}
+
+// pickLocked 按差额轮询取出下一帧，调用方需持有 s.mu 且 ring 非空
+func (s *writeScheduler) pickLocked() *frameReq {
+	for {
+		if s.next >= len(s.ring) {
+			s.next = 0
+		}
+		q := s.ring[s.next]
+		if !q.granted {
+			q.deficit += schedQuantum * q.weight
+			q.granted = true
+		}
+		head := q.reqs[0]
+		cost := 4 + head.size
+		if cost > q.deficit {
+			// 额度不够，轮到下一个流
+			q.granted = false
+			s.next++
+			continue
+		}
+		q.deficit -= cost
+		q.reqs = q.reqs[1:]
+		s.space.Broadcast()
+		if len(q.reqs) == 0 {
+			// 队列空了就退出轮转并清零额度，空闲的流不能攒下额度之后独占链路；流关闭后才删除队列
+			s.ring = append(s.ring[:s.next], s.ring[s.next+1:]...)
+			q.inRing = false
+			q.granted = false
+			q.deficit = 0
+			if q.released {
+				s.removeLocked(q)
+			}
+		}
+		return head
+	}
+}
+
+// writeFrame 包头和负载一次写出，分帧层会把每次写入当作一帧
+// 负载超出帧格式的上限时返回错误而不是截断长度字段，数据帧由调用方按 frameLimit 拆分
+func (s *writeScheduler) writeFrame(w proto.Wire, id uint32, data []byte) error {
+	buf := writeBufferPool.Get().([]byte)
+	frame, err := w.AppendHeader(buf[:0], id, len(data))
+	if err != nil {
+		writeBufferPool.Put(buf)
+		return err
+	}
+	frame = append(frame, data...)
+	_, err = s.w.Write(frame)
+	if cap(frame) == cap(buf) {
+		writeBufferPool.Put(frame)
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package comm
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingLink 按包头中的流ID 统计写出的负载字节数，达到 limit 后关闭 full
+type countingLink struct {
+	mu    sync.Mutex
+	bytes map[uint32]int
+	total int
+	limit int
+	full  chan struct{}
+}
+
+func (c *countingLink) Write(p []byte) (int, error) {
+	// 模拟物理链路的发送耗时
+	time.Sleep(20 * time.Microsecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.total >= c.limit {
+		return len(p), nil
+	}
+	c.bytes[uint32(binary.BigEndian.Uint16(p))] += len(p) - 4
+	c.total += len(p) - 4
+	if c.total >= c.limit {
+		close(c.full)
+	}
+	return len(p), nil
+}
+
+// TestSchedulerWeights 两个一直有数据要发的流按 1:4 的权重分享链路
+func TestSchedulerWeights(t *testing.T) {
+	link := &countingLink{bytes: make(map[uint32]int), limit: 8 << 20, full: make(chan struct{})}
+	s := newWriteScheduler(link, func() proto.Wire { return proto.WireV1 }, nil)
+
+	frame := make([]byte, 8*1024)
+	weights := map[uint32]int{1: 1, 2: 4}
+	var wg sync.WaitGroup
+	for id, weight := range weights {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-link.full:
+					return
+				default:
+				}
+				if err := s.sendStream(id, weight, frame, nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	link.mu.Lock()
+	low, high := link.bytes[1], link.bytes[2]
+	link.mu.Unlock()
+	ratio := float64(high) / float64(low)
+	t.Logf("权重 1: %d 字节，权重 4: %d 字节，比例 1:%.2f", low, high, ratio)
+	if ratio < 3.5 || ratio > 4.5 {
+		t.Fatalf("发送比例 1:%.2f，期望约 1:4", ratio)
+	}
+}
+
+// TestSchedulerIdleStreamSavesNoCredit 断断续续发小帧的流每次排空都清零额度，
+// 之后两个流同时满载时它只能按权重分到自己的份额，不能凭攒下的额度连续发送
+func TestSchedulerIdleStreamSavesNoCredit(t *testing.T) {
+	// 不启动 run，直接调用 pickLocked 控制出队顺序
+	s := &writeScheduler{queues: make(map[uint32]*streamQueue)}
+	s.cond = sync.NewCond(&s.mu)
+	s.space = sync.NewCond(&s.mu)
+	pick := func() uint32 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.pickLocked().id
+	}
+
+	for i := 0; i < 100; i++ {
+		s.sendStream(1, 1, make([]byte, 100), nil)
+		if id := pick(); id != 1 {
+			t.Fatalf("取出流 %d", id)
+		}
+	}
+
+	// 每帧的开销正好是一个量子，两个流都排满后应当轮流发送
+	frame := make([]byte, schedQuantum-4)
+	for i := 0; i < streamBacklog; i++ {
+		s.sendStream(1, 1, frame, nil)
+		s.sendStream(2, 1, frame, nil)
+	}
+	var order []uint32
+	for i := 0; i < 2*streamBacklog; i++ {
+		order = append(order, pick())
+	}
+	for i, id := range order {
+		if id != uint32(i%2+1) {
+			t.Fatalf("出队顺序 %v，期望两个流交替", order)
+		}
+	}
+}
+
+// TestSchedulerKeepsStreamOrder 同一个流的数据帧和随后的 FIN 按写入顺序发出，
+// 对端重置流后还没写出的帧被丢弃
+func TestSchedulerKeepsStreamOrder(t *testing.T) {
+	var mu sync.Mutex
+	var got []byte
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		got = append(got, p[4:]...)
+		mu.Unlock()
+		return len(p), nil
+	})
+	s := newWriteScheduler(w, func() proto.Wire { return proto.WireV1 }, nil)
+	var want []byte
+	for i := 0; i < 20; i++ {
+		chunk := []byte{byte(i), byte(i), byte(i)}
+		want = append(want, chunk...)
+		if err := s.sendStream(7, 1+i%3, chunk, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fin := []byte("FIN")
+	want = append(want, fin...)
+	if err := s.sendStreamControl(7, 1, raw(fin), nil); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if string(got) != string(want) {
+		t.Fatalf("顺序错误: %x", got)
+	}
+	mu.Unlock()
+
+	s.release(7, ErrStreamReset)
+	if err := s.sendStream(7, 1, []byte{1}, nil); err != nil {
+		t.Fatalf("流ID 复用后应得到新队列: %v", err)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACL 服务端的访问控制，在拨号前检查客户端要访问的地址，在反向转发监听前检查监听地址
+// 规则按顺序匹配，第一条匹配的规则决定允许还是拒绝，都不匹配时按 Default
+//
+// 示例：禁止访问手机的局域网和本机服务，只允许某台电脑访问 192.168.1.10 的 SSH，
+// 并允许它把反向转发监听在所有网卡的 8080 端口上
+//
+//	{
+//	  "default": "allow",
+//	  "rules": [
+//	    {"action": "allow", "devices": ["AA:BB:CC:DD:EE:FF"], "hosts": ["192.168.1.10"], "ports": ["22"]},
+//	    {"action": "deny", "hosts": ["127.0.0.0/8", "::1", "10.0.0.0/8", "172.16.0.0/12",
+//	      "192.168.0.0/16", "169.254.0.0/16", "fe80::/10", "fc00::/7", "*.lan"]}
+//	  ],
+//	  "listen": [
+//	    {"action": "allow", "devices": ["AA:BB:CC:DD:EE:FF"], "hosts": ["0.0.0.0"], "ports": ["8080"]}
+//	  ]
+//	}
+type ACL struct {
+	Default string    `json:"default,omitempty"` // "allow" 或 "deny"，空为 allow
+	Rules   []ACLRule `json:"rules"`
+	// Listen 反向转发的监听规则，hosts 匹配监听的 IP，不支持域名
+	// 都不匹配时只允许回环地址，与 ssh 未开启 GatewayPorts 时相同
+	Listen []ACLRule `json:"listen,omitempty"`
+
+	deny   bool
+	rules  []aclRule
+	listen []aclRule
+}
+
+// ACLRule 一条规则，各字段为空表示不限，同时满足所有字段才算匹配
+type ACLRule struct {
+	Action  string   `json:"action"`            // "allow" 或 "deny"
+	Devices []string `json:"devices,omitempty"` // 设备：蓝牙 MAC 或链路对端的 IP，见 SetDevice
+	Hosts   []string `json:"hosts,omitempty"`   // CIDR、IP 或域名通配（*.example.com，也匹配多级子域名），"*" 为所有地址
+	Ports   []string `json:"ports,omitempty"`   // 端口或端口范围，例如 "443"、"8000-9000"
+}
+
+type aclRule struct {
+	deny     bool
+	devices  []string
+	prefixes []netip.Prefix
+	globs    []string
+	anyHost  bool
+	ports    [][2]uint16
+}
+
+var (
+	aclMu     sync.RWMutex
+	serverACL *ACL
+)
+
+// lookupIP 解析域名，测试时替换以模拟解析结果
+var lookupIP = net.DefaultResolver.LookupNetIP
+
+// SetACL 设置所有连接使用的访问控制，nil 为不限制
+func SetACL(acl *ACL) {
+	aclMu.Lock()
+	serverACL = acl
+	aclMu.Unlock()
+}
+
+func currentACL() *ACL {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+	return serverACL
+}
+
+// LoadACL 从 JSON 文件读取访问控制规则
+func LoadACL(file string) (*ACL, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var acl ACL
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("解析访问控制规则失败: %v", err)
+	}
+	if err := acl.compile(); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// compile 检查并预处理规则
+func (a *ACL) compile() error {
+	switch strings.ToLower(a.Default) {
+	case "", "allow":
+	case "deny":
+		a.deny = true
+	default:
+		return fmt.Errorf("无效的默认动作 %q", a.Default)
+	}
+	var err error
+	if a.rules, err = compileRules("规则", a.Rules); err != nil {
+		return err
+	}
+	a.listen, err = compileRules("监听规则", a.Listen)
+	return err
+}
+
+func compileRules(what string, rules []ACLRule) ([]aclRule, error) {
+	var out []aclRule
+	for i, r := range rules {
+		var c aclRule
+		switch strings.ToLower(r.Action) {
+		case "allow":
+		case "deny":
+			c.deny = true
+		default:
+			return nil, fmt.Errorf("%s %d: 无效的动作 %q", what, i+1, r.Action)
+		}
+		for _, d := range r.Devices {
+			c.devices = append(c.devices, strings.ToLower(d))
+		}
+		for _, h := range r.Hosts {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if h == "*" {
+				c.anyHost = true
+			} else if p, err := netip.ParsePrefix(h); err == nil {
+				c.prefixes = append(c.prefixes, p.Masked())
+			} else if ip, err := netip.ParseAddr(h); err == nil {
+				c.prefixes = append(c.prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			} else if _, err := path.Match(h, ""); err == nil && h != "" {
+				c.globs = append(c.globs, strings.TrimSuffix(h, "."))
+			} else {
+				return nil, fmt.Errorf("%s %d: 无效的地址 %q", what, i+1, h)
+			}
+		}
+		for _, p := range r.Ports {
+			lo, hi, found := strings.Cut(p, "-")
+			if !found {
+				hi = lo
+			}
+			l, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+			h, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+			if err1 != nil || err2 != nil || l > h {
+				return nil, fmt.Errorf("%s %d: 无效的端口 %q", what, i+1, p)
+			}
+			c.ports = append(c.ports, [2]uint16{uint16(l), uint16(h)})
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// allowed 判断设备 device 能否访问 ip:port，name 为客户端请求的域名，请求的是 IP 时为空
+func (a *ACL) allowed(device, name string, ip netip.Addr, port uint16) bool {
+	ip = ip.Unmap()
+	for _, r := range a.rules {
+		if r.match(device, name, ip, port) {
+			return !r.deny
+		}
+	}
+	return !a.deny
+}
+
+// listenAllowed 判断设备 device 能否在 ip:port 上监听反向转发，没有规则匹配时只允许回环地址
+func (a *ACL) listenAllowed(device string, ip netip.Addr, port uint16) bool {
+	ip = ip.Unmap()
+	for _, r := range a.listen {
+		if r.match(device, "", ip, port) {
+			return !r.deny
+		}
+	}
+	return ip.IsLoopback()
+}
+
+func (r *aclRule) match(device, name string, ip netip.Addr, port uint16) bool {
+	if len(r.devices) > 0 && !matchDevice(r.devices, device) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		ok := false
+		for _, p := range r.ports {
+			if port >= p[0] && port <= p[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.anyHost || len(r.prefixes) == 0 && len(r.globs) == 0 {
+		return true
+	}
+	for _, p := range r.prefixes {
+		if ip.IsValid() && p.Contains(ip) {
+			return true
+		}
+	}
+	if name != "" {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		for _, g := range r.globs {
+			if ok, _ := path.Match(g, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDevice(devices []string, device string) bool {
+	device = strings.ToLower(device)
+	for _, d := range devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAllowed 解析目的地址并按访问控制过滤，返回允许拨号的地址
+// 域名解析出的每个 IP 都要检查，避免用域名绕过 CIDR 规则
+func (a *ACL) resolveAllowed(ctx context.Context, device, host string, port uint16) ([]netip.AddrPort, error) {
+	var name string
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip.Unmap()}
+	} else {
+		name = host
+		ips, err = lookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var out []netip.AddrPort
+	for _, ip := range ips {
+		if a.allowed(device, name, ip, port) {
+			out = append(out, netip.AddrPortFrom(ip.Unmap(), port))
+		}
+	}
+	if len(out) == 0 {
+		return nil, proto.ErrDenied
+	}
+	return out, nil
+}
+
+// dialTCP 拨号 TCP 目的地址，配置了访问控制时先检查，再依次尝试允许的地址
+func (h *BluetoothMuxHandler) dialTCP(host string, port uint16) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	acl := currentACL()
+	if acl == nil {
+		return net.DialTimeout("tcp", addr, 5*time.Second)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	targets, err := acl.resolveAllowed(ctx, h.device, host, port)
+	if err != nil {
+		if err == proto.ErrDenied {
+			fmt.Printf("拒绝访问 %s (设备 %s)\n", addr, h.device)
+		}
+		return nil, err
+	}
+	var d net.Dialer
+	for _, t := range targets {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "tcp", t.String())
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveUDP 解析 UDP 目的地址，配置了访问控制时取第一个允许的地址
+func (h *BluetoothMuxHandler) resolveUDP(host string, port uint16) (netip.AddrPort, error) {
+	acl := currentACL()
+	if acl == nil {
+		udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		to := udpAddr.AddrPort()
+		return netip.AddrPortFrom(to.Addr().Unmap(), to.Port()), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	targets, err := acl.resolveAllowed(ctx, h.device, host, port)
+	if err != nil {
+		if err == proto.ErrDenied {
+			fmt.Printf("拒绝 UDP 访问 %s (设备 %s)\n", net.JoinHostPort(host, strconv.Itoa(int(port))), h.device)
+		}
+		return netip.AddrPort{}, err
+	}
+	return targets[0], nil
+}
+
+// listenTCP 为反向转发监听 TCP 端口，地址为空或 localhost 时监听 127.0.0.1
+// 默认只能监听回环地址，其他地址（包括 0.0.0.0）需要访问控制的监听规则明确允许
+func (h *BluetoothMuxHandler) listenTCP(host string, port uint16) (net.Listener, error) {
+	var ip netip.Addr
+	if host == "" || strings.EqualFold(host, "localhost") {
+		ip = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	} else if addr, err := netip.ParseAddr(host); err == nil {
+		ip = addr.Unmap()
+	} else {
+		return nil, fmt.Errorf("监听地址必须是 IP: %s", host)
+	}
+	addr := netip.AddrPortFrom(ip, port).String()
+	allowed := ip.IsLoopback()
+	if acl := currentACL(); acl != nil {
+		allowed = acl.listenAllowed(h.device, ip, port)
+	}
+	if !allowed {
+		fmt.Printf("拒绝监听 %s (设备 %s)\n", addr, h.device)
+		return nil, proto.ErrDenied
+	}
+	return net.Listen("tcp", addr)
+}
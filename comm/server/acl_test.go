@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+const (
+	phone  = "AA:BB:CC:DD:EE:FF"
+	laptop = "11:22:33:44:55:66"
+)
+
+func mustACL(t *testing.T, acl ACL) *ACL {
+	t.Helper()
+	if err := acl.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return &acl
+}
+
+func TestACLAllowed(t *testing.T) {
+	acl := mustACL(t, ACL{
+		Default: "deny",
+		Rules: []ACLRule{
+			// 顺序决定结果：这台设备的 SSH 在下面的局域网拒绝规则之前放行
+			{Action: "allow", Devices: []string{"aa:bb:cc:dd:ee:ff"}, Hosts: []string{"192.168.1.10"}, Ports: []string{"22"}},
+			{Action: "deny", Hosts: []string{"127.0.0.0/8", "::1", "192.168.0.0/16", "fc00::/7", "*.lan"}},
+			{Action: "allow", Hosts: []string{"*.example.com", "example.com"}, Ports: []string{"80", "443"}},
+			{Action: "allow", Hosts: []string{"203.0.113.0/24"}, Ports: []string{"8000-9000"}},
+			{Action: "allow", Devices: []string{laptop}, Hosts: []string{"*"}},
+		},
+	})
+	ip := netip.MustParseAddr
+	tests := []struct {
+		name   string
+		device string
+		host   string // 客户端请求的域名
+		ip     string
+		port   uint16
+		want   bool
+	}{
+		{"设备规则放行", phone, "", "192.168.1.10", 22, true},
+		{"设备规则放行，MAC 大小写无关", "aa:bb:cc:dd:ee:ff", "", "192.168.1.10", 22, true},
+		{"设备规则只放行 22 端口", phone, "", "192.168.1.10", 80, false},
+		{"其他设备落到局域网拒绝", laptop, "", "192.168.1.10", 22, false},
+		{"CIDR 拒绝", phone, "", "192.168.200.1", 443, false},
+		{"IPv6 单个地址", phone, "", "::1", 443, false},
+		{"IPv4 映射的 IPv6 地址", phone, "", "::ffff:127.0.0.1", 443, false},
+		{"IPv6 CIDR", phone, "", "fd00::1", 443, false},
+		{"域名通配拒绝", laptop, "nas.lan", "198.51.100.7", 443, false},
+		{"域名末尾的点和大小写", laptop, "NAS.LAN.", "198.51.100.7", 443, false},
+		{"域名通配放行", phone, "www.example.com", "198.51.100.7", 443, true},
+		{"通配不匹配裸域名，由单独的规则放行", phone, "example.com", "198.51.100.7", 80, true},
+		{"通配匹配多级子域名", phone, "a.b.example.com", "198.51.100.7", 443, true},
+		{"多级子域名同样被拒绝", laptop, "a.nas.lan", "198.51.100.7", 443, false},
+		{"域名规则限定端口", phone, "www.example.com", "198.51.100.7", 22, false},
+		{"按 IP 请求不匹配域名规则", phone, "", "198.51.100.7", 443, false},
+		{"端口范围下界", phone, "", "203.0.113.5", 8000, true},
+		{"端口范围上界", phone, "", "203.0.113.5", 9000, true},
+		{"端口范围之外", phone, "", "203.0.113.5", 9001, false},
+		{"设备规则的任意地址", laptop, "", "198.51.100.7", 25, true},
+		{"默认拒绝", phone, "", "198.51.100.7", 25, false},
+	}
+	for _, tc := range tests {
+		if got := acl.allowed(tc.device, tc.host, ip(tc.ip), tc.port); got != tc.want {
+			t.Errorf("%s: %s %s %s:%d = %v", tc.name, tc.device, tc.host, tc.ip, tc.port, got)
+		}
+	}
+
+	open := mustACL(t, ACL{Rules: []ACLRule{{Action: "deny", Ports: []string{"25"}}}})
+	if !open.allowed(phone, "", ip("198.51.100.7"), 80) {
+		t.Error("默认动作为空时应允许")
+	}
+	if open.allowed(phone, "", ip("198.51.100.7"), 25) {
+		t.Error("只限定端口的规则应匹配所有地址")
+	}
+}
+
+func TestACLCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		acl  ACL
+	}{
+		{"默认动作", ACL{Default: "maybe"}},
+		{"规则动作", ACL{Rules: []ACLRule{{Action: "drop"}}}},
+		{"地址", ACL{Rules: []ACLRule{{Action: "deny", Hosts: []string{"[bad"}}}}},
+		{"空地址", ACL{Rules: []ACLRule{{Action: "deny", Hosts: []string{" "}}}}},
+		{"端口越界", ACL{Rules: []ACLRule{{Action: "deny", Ports: []string{"70000"}}}}},
+		{"端口范围颠倒", ACL{Rules: []ACLRule{{Action: "deny", Ports: []string{"9000-8000"}}}}},
+		{"端口不是数字", ACL{Rules: []ACLRule{{Action: "deny", Ports: []string{"http"}}}}},
+		{"监听规则", ACL{Listen: []ACLRule{{Action: "drop"}}}},
+	}
+	for _, tc := range tests {
+		if err := tc.acl.compile(); err == nil {
+			t.Errorf("%s: 应拒绝无效的规则", tc.name)
+		}
+	}
+}
+
+// TestACLResolve 域名解析出的每个地址都要检查，解析到被拒绝的地址不能绕过 CIDR 规则
+func TestACLResolve(t *testing.T) {
+	resolved := map[string][]netip.Addr{
+		"rebind.example.com": {netip.MustParseAddr("127.0.0.1")},
+		"mixed.example.com":  {netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("198.51.100.7"), netip.MustParseAddr("::ffff:10.1.2.3")},
+		"public.example.com": {netip.MustParseAddr("198.51.100.7")},
+	}
+	lookup := lookupIP
+	lookupIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if ips, ok := resolved[host]; ok {
+			return ips, nil
+		}
+		t.Fatalf("不应解析 %q", host)
+		return nil, nil
+	}
+	defer func() { lookupIP = lookup }()
+
+	acl := mustACL(t, ACL{Rules: []ACLRule{
+		{Action: "deny", Hosts: []string{"127.0.0.0/8", "10.0.0.0/8", "192.168.0.0/16"}},
+	}})
+	ctx := context.Background()
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"rebind.example.com", nil},
+		{"mixed.example.com", []string{"198.51.100.7:443"}},
+		{"public.example.com", []string{"198.51.100.7:443"}},
+		{"127.0.0.1", nil},
+		{"::ffff:192.168.1.1", nil},
+		{"198.51.100.7", []string{"198.51.100.7:443"}},
+	}
+	for _, tc := range tests {
+		got, err := acl.resolveAllowed(ctx, phone, tc.host, 443)
+		if tc.want == nil {
+			if err != proto.ErrDenied {
+				t.Errorf("%s: 期望 ErrDenied，得到 %v %v", tc.host, got, err)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tc.want) {
+			t.Errorf("%s: %v %v，期望 %v", tc.host, got, err, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tc.want[i] {
+				t.Errorf("%s: %v，期望 %v", tc.host, got, tc.want)
+			}
+		}
+	}
+
+	// 拨号路径同样拒绝
+	SetACL(acl)
+	defer SetACL(nil)
+	h := NewBluetoothMuxHandler(nil)
+	h.SetDevice(phone)
+	if _, err := h.dialTCP("rebind.example.com", 443); err != proto.ErrDenied {
+		t.Errorf("TCP 拨号: %v", err)
+	}
+	if _, err := h.resolveUDP("rebind.example.com", 53); err != proto.ErrDenied {
+		t.Errorf("UDP 解析: %v", err)
+	}
+}
+
+// TestACLListen 反向转发默认只能监听回环地址，其他地址要有监听规则明确允许
+func TestACLListen(t *testing.T) {
+	acl := mustACL(t, ACL{
+		Default: "allow",
+		Listen: []ACLRule{
+			{Action: "deny", Hosts: []string{"127.0.0.1"}, Ports: []string{"22"}},
+			{Action: "allow", Devices: []string{phone}, Hosts: []string{"0.0.0.0", "::"}, Ports: []string{"0", "8080"}},
+		},
+	})
+	ip := netip.MustParseAddr
+	tests := []struct {
+		name   string
+		device string
+		ip     string
+		port   uint16
+		want   bool
+	}{
+		{"回环地址", laptop, "127.0.0.1", 8080, true},
+		{"IPv6 回环地址", laptop, "::1", 8080, true},
+		{"监听规则拒绝回环地址", laptop, "127.0.0.1", 22, false},
+		{"规则放行所有网卡", phone, "0.0.0.0", 8080, true},
+		{"IPv6 所有网卡", phone, "::", 8080, true},
+		{"规则限定端口", phone, "0.0.0.0", 9090, false},
+		{"规则限定设备", laptop, "0.0.0.0", 8080, false},
+		{"出站的默认动作不影响监听", phone, "192.168.1.5", 8080, false},
+	}
+	for _, tc := range tests {
+		if got := acl.listenAllowed(tc.device, ip(tc.ip), tc.port); got != tc.want {
+			t.Errorf("%s: %s %s:%d = %v", tc.name, tc.device, tc.ip, tc.port, got)
+		}
+	}
+
+	// 没有访问控制时只能监听回环地址，地址为空时监听 127.0.0.1
+	h := NewBluetoothMuxHandler(nil)
+	h.SetDevice(phone)
+	ln, err := h.listenTCP("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := ln.Addr().(*net.TCPAddr); !a.IP.IsLoopback() {
+		t.Errorf("地址为空时监听在 %s", a)
+	}
+	ln.Close()
+	for _, host := range []string{"0.0.0.0", "::"} {
+		if ln, err := h.listenTCP(host, 0); err != proto.ErrDenied {
+			if ln != nil {
+				ln.Close()
+			}
+			t.Errorf("没有监听规则时监听 %s: %v", host, err)
+		}
+	}
+	if _, err := h.listenTCP("phone.lan", 0); err == nil || proto.DialErrorCode(err) != proto.OpenFailure {
+		t.Errorf("域名监听地址: %v", err)
+	}
+
+	// 监听规则放行后可以监听所有网卡
+	SetACL(acl)
+	defer SetACL(nil)
+	ln, err = h.listenTCP("0.0.0.0", 0)
+	if err != nil {
+		t.Fatalf("规则放行的地址: %v", err)
+	}
+	ln.Close()
+	h.SetDevice(laptop)
+	if _, err := h.listenTCP("0.0.0.0", 0); err != proto.ErrDenied {
+		t.Errorf("其他设备监听所有网卡: %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTimeout 单个 DNS 查询的超时
+const dnsTimeout = 5 * time.Second
+
+// systemDNSTTL 系统解析器不返回 TTL，回复中统一使用这个值
+const systemDNSTTL = 60
+
+// dnsResolver 解析一个 DNS 查询报文，返回回复报文
+type dnsResolver interface {
+	Resolve(ctx context.Context, query []byte) ([]byte, error)
+}
+
+var (
+	dnsMu       sync.RWMutex
+	dnsUpstream dnsResolver = systemResolver{}
+)
+
+// SetDNSUpstream 设置 DNS 解析流使用的上游：空为本机的系统解析器（即手机当前的网络），
+// udp://8.8.8.8:53、tcp://8.8.8.8:53 转发到指定的 DNS 服务器（端口默认 53），
+// https://dns.google/dns-query 使用 DoH (RFC 8484)
+func SetDNSUpstream(upstream string) error {
+	r, err := newDNSResolver(upstream)
+	if err != nil {
+		return err
+	}
+	dnsMu.Lock()
+	dnsUpstream = r
+	dnsMu.Unlock()
+	return nil
+}
+
+func newDNSResolver(upstream string) (dnsResolver, error) {
+	if upstream == "" {
+		return systemResolver{}, nil
+	}
+	if !strings.Contains(upstream, "://") {
+		upstream = "udp://" + upstream
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(strings.Trim(u.Host, "[]"), "53")
+		}
+		return upstreamResolver{network: u.Scheme, addr: addr}, nil
+	case "https":
+		return &dohResolver{url: u.String(), client: &http.Client{Timeout: dnsTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("不支持的 DNS 上游 %q", upstream)
+	}
+}
+
+// openDNS 建立 DNS 解析流，流没有对应的本地 Socket
+func (h *BluetoothMuxHandler) openDNS(id uint32) {
+	s := newMuxStream(nil, h.has(proto.FeatFlowControl))
+	if !h.storeOpened(id, s) {
+		return
+	}
+	h.sendControl(id, proto.CmdOpenReply, proto.OpenSuccess)
+	dnsMu.RLock()
+	resolver := dnsUpstream
+	dnsMu.RUnlock()
+	go h.serveDNS(id, s, resolver)
+}
+
+// serveDNS 并发解析客户端发来的查询，回复按完成的先后发回
+func (h *BluetoothMuxHandler) serveDNS(id uint32, s *muxStream, resolver dnsResolver) {
+	r := &ackReader{h: h, id: id, s: s}
+	var wg sync.WaitGroup
+	var wmu sync.Mutex // 一个回复的所有帧连续发出
+	for {
+		query, err := proto.ReadDNSMessage(r)
+		if err != nil {
+			if err == io.EOF {
+				// 客户端不再查询，答完已收到的查询后结束
+				wg.Wait()
+				h.sendControl(id, proto.CmdFin)
+				h.removeStream(id, s)
+			} else if h.removeStream(id, s) {
+				fmt.Printf("DNS 解析流 %d 数据错误: %v\n", id, err)
+				h.sendControl(id, proto.CmdRst)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+			reply, err := resolver.Resolve(ctx, query)
+			cancel()
+			if err != nil {
+				fmt.Printf("DNS 解析失败: %v\n", err)
+				reply = proto.DNSErrorReply(query, dnsmessage.RCodeServerFailure)
+			}
+			msg, err := proto.AppendDNSMessage(nil, reply)
+			if reply == nil || err != nil {
+				return
+			}
+			wmu.Lock()
+			defer wmu.Unlock()
+			if err := h.sendMessage(id, s, msg); err != nil {
+				h.removeStream(id, s)
+			}
+		}()
+	}
+}
+
+// sendMessage 按客户端的最大帧和发送额度把一条消息拆成数据帧发出
+func (h *BluetoothMuxHandler) sendMessage(id uint32, s *muxStream, msg []byte) error {
+	for off := 0; off < len(msg); {
+		k := s.sendWin.Acquire(min(len(msg)-off, h.frameLimit()))
+		if k == 0 {
+			return net.ErrClosed
+		}
+		if err := h.sendData(id, s, msg[off:off+k]); err != nil {
+			fmt.Printf("发送帧失败: %v\n", err)
+			return err
+		}
+		off += k
+	}
+	return nil
+}
+
+// systemResolver 用本机的系统解析器回答常见类型的查询，其他类型回复 NOTIMP
+type systemResolver struct{}
+
+func (systemResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			OpCode:             hdr.OpCode,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: systemDNSTTL}
+	add := func(body dnsmessage.ResourceBody) {
+		reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: rh, Body: body})
+	}
+	r := net.DefaultResolver
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		network := "ip4"
+		if q.Type == dnsmessage.TypeAAAA {
+			network = "ip6"
+		}
+		var ips []netip.Addr
+		ips, err = r.LookupNetIP(ctx, network, name)
+		for _, ip := range ips {
+			if q.Type == dnsmessage.TypeA {
+				add(&dnsmessage.AResource{A: ip.Unmap().As4()})
+			} else {
+				add(&dnsmessage.AAAAResource{AAAA: ip.As16()})
+			}
+		}
+	case dnsmessage.TypeCNAME:
+		var cname string
+		cname, err = r.LookupCNAME(ctx, name)
+		// 没有别名时系统解析器返回名字本身
+		if err == nil && !strings.EqualFold(strings.TrimSuffix(cname, "."), name) {
+			add(&dnsmessage.CNAMEResource{CNAME: fqdn(cname)})
+		}
+	case dnsmessage.TypeMX:
+		var mxs []*net.MX
+		mxs, err = r.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			add(&dnsmessage.MXResource{Pref: mx.Pref, MX: fqdn(mx.Host)})
+		}
+	case dnsmessage.TypeNS:
+		var nss []*net.NS
+		nss, err = r.LookupNS(ctx, name)
+		for _, ns := range nss {
+			add(&dnsmessage.NSResource{NS: fqdn(ns.Host)})
+		}
+	case dnsmessage.TypeTXT:
+		var txts []string
+		txts, err = r.LookupTXT(ctx, name)
+		for _, txt := range txts {
+			add(&dnsmessage.TXTResource{TXT: splitTXT(txt)})
+		}
+	default:
+		reply.RCode = dnsmessage.RCodeNotImplemented
+	}
+	if err != nil {
+		reply.Answers = nil
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			reply.RCode = dnsmessage.RCodeNameError
+		} else {
+			reply.RCode = dnsmessage.RCodeServerFailure
+		}
+	}
+	return reply.Pack()
+}
+
+// fqdn 把主机名转换为带结尾点的 dnsmessage.Name，名字过长时返回根域
+func fqdn(host string) dnsmessage.Name {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	n, err := dnsmessage.NewName(host)
+	if err != nil {
+		return dnsmessage.MustNewName(".")
+	}
+	return n
+}
+
+// splitTXT 把 TXT 记录拆成不超过 255 字节的字符串
+func splitTXT(txt string) []string {
+	var parts []string
+	for len(txt) > 255 {
+		parts = append(parts, txt[:255])
+		txt = txt[255:]
+	}
+	return append(parts, txt)
+}
+
+// upstreamResolver 把查询原样转发给普通 DNS 服务器，UDP 回复被截断时改用 TCP 重试
+type upstreamResolver struct {
+	network string
+	addr    string
+}
+
+func (u upstreamResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	reply, err := exchangeDNS(ctx, u.network, u.addr, query)
+	if err == nil && u.network == "udp" && len(reply) > 2 && reply[2]&0x02 != 0 {
+		// TC 位
+		return exchangeDNS(ctx, "tcp", u.addr, query)
+	}
+	return reply, err
+}
+
+func exchangeDNS(ctx context.Context, network, addr string, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("DNS 查询过短")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "tcp" {
+		msg, err := proto.AppendDNSMessage(nil, query)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		return proto.ReadDNSMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略 ID 不符的回复
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+// dohResolver 通过 DoH (RFC 8484) 的 POST 请求解析
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func (d *dohResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("DNS 查询过短")
+	}
+	// RFC 8484 建议 ID 置 0 以便 HTTP 缓存，回复时再换回原来的 ID
+	id := binary.BigEndian.Uint16(query)
+	body := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(body, 0)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH 服务器返回 %s", resp.Status)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 0xFFFF+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 || len(reply) > 0xFFFF {
+		return nil, fmt.Errorf("DoH 回复长度 %d 无效", len(reply))
+	}
+	binary.BigEndian.PutUint16(reply, id)
+	return reply, nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"dosgo/btProxy/comm/proto"
+	"testing"
+)
+
+// captureConn 记录服务端写出的帧
+type captureConn struct {
+	bytes.Buffer
+}
+
+func (c *captureConn) Close() error { return nil }
+
+var wires = []struct {
+	wire     proto.Wire
+	features uint32
+}{
+	{proto.WireV1, proto.Features &^ proto.FeatWireV2},
+	{proto.WireV2, proto.Features},
+}
+
+var openCases = []struct {
+	name    string
+	body    []byte // 流ID 之后的部分：[地址类型(1)][地址][端口(2)]
+	wantErr bool
+	host    string
+	port    uint16
+}{
+	{"ipv4", []byte{proto.AddrIPv4, 10, 0, 0, 1, 0x1F, 0x90}, false, "10.0.0.1", 8080},
+	{"ipv4 尾部多余字节", []byte{proto.AddrIPv4, 10, 0, 0, 1, 0, 80, 0xAA}, false, "10.0.0.1", 80},
+	{"ipv4 数据报", []byte{proto.AddrIPv4 | proto.OpenDatagram, 8, 8, 8, 8, 0, 53}, false, "8.8.8.8", 53},
+	{"ipv4 缺端口低字节", []byte{proto.AddrIPv4, 10, 0, 0, 1, 0}, true, "", 0},
+	{"ipv4 缺端口", []byte{proto.AddrIPv4, 10, 0, 0, 1}, true, "", 0},
+	{"ipv4 地址不完整", []byte{proto.AddrIPv4, 10, 0}, true, "", 0},
+	{"ipv4 只有类型", []byte{proto.AddrIPv4}, true, "", 0},
+	{"ipv6", append(append([]byte{proto.AddrIPv6}, make([]byte, 15)...), 1, 0x01, 0xBB), false, "::1", 443},
+	{"ipv6 缺端口低字节", append(append([]byte{proto.AddrIPv6}, make([]byte, 15)...), 1, 0x01), true, "", 0},
+	{"ipv6 地址不完整", append([]byte{proto.AddrIPv6}, make([]byte, 8)...), true, "", 0},
+	{"ipv6 只有类型", []byte{proto.AddrIPv6}, true, "", 0},
+	{"域名", append(append([]byte{proto.AddrDomain}, "example.com"...), 0, 80), false, "example.com", 80},
+	{"域名 压缩", []byte{proto.AddrDomain | proto.OpenCompress, 'a', 0, 22}, false, "a", 22},
+	{"域名为空", []byte{proto.AddrDomain, 0, 80}, true, "", 0},
+	{"域名缺端口", []byte{proto.AddrDomain, 'a'}, true, "", 0},
+	{"域名 只有类型", []byte{proto.AddrDomain}, true, "", 0},
+	{"未知地址类型", []byte{0x00, 1, 2, 3, 4, 0, 80}, true, "", 0},
+}
+
+func TestParseOpen(t *testing.T) {
+	for _, wc := range wires {
+		for _, tc := range openCases {
+			frame := append(wc.wire.AppendID(nil, 7), tc.body...)
+			open, err := parseOpen(wc.wire, frame)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%v %s: 期望错误，得到 %+v", wc.wire, tc.name, open)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%v %s: %v", wc.wire, tc.name, err)
+				continue
+			}
+			if open.host != tc.host || open.port != tc.port {
+				t.Errorf("%v %s: 得到 %s:%d，期望 %s:%d", wc.wire, tc.name, open.host, open.port, tc.host, tc.port)
+			}
+			flag := tc.body[0]
+			if open.datagram != (flag&proto.OpenDatagram != 0) || open.compress != (flag&proto.OpenCompress != 0) {
+				t.Errorf("%v %s: 标志位解析错误 %+v", wc.wire, tc.name, open)
+			}
+		}
+	}
+}
+
+// TestTruncatedOpenRejected 截断的打开帧不能让服务端崩溃，应回复打开失败
+func TestTruncatedOpenRejected(t *testing.T) {
+	const id = 0x1234
+	for _, wc := range wires {
+		for _, tc := range openCases {
+			if !tc.wantErr {
+				continue
+			}
+			conn := &captureConn{}
+			h := NewBluetoothMuxHandler(conn)
+			h.features.Store(wc.features)
+			h.handleStreamData(0, append(wc.wire.AppendID(nil, id), tc.body...))
+
+			if _, ok := h.streamMap.Load(uint32(id)); ok {
+				t.Errorf("%v %s: 无效的打开帧不应创建流", wc.wire, tc.name)
+			}
+			expectOpenFailure(t, wc.wire, conn, id, tc.name)
+		}
+	}
+}
+
+// expectOpenFailure 检查服务端写出的下一帧是流 id 的打开失败回复
+func expectOpenFailure(t *testing.T, w proto.Wire, conn *captureConn, id uint32, name string) {
+	t.Helper()
+	frameID, n, err := w.ReadHeader(conn, make([]byte, 4))
+	if err != nil {
+		t.Errorf("%v %s: 没有收到回复: %v", w, name, err)
+		return
+	}
+	payload := conn.Next(n)
+	replyID, cmd, args, ok := w.ParseControl(payload)
+	if frameID != 0 || !ok || replyID != id || cmd != proto.CmdOpenReply || len(args) != 1 || args[0] != proto.OpenFailure {
+		t.Errorf("%v %s: 回复不是打开失败: 帧 %d 负载 %x", w, name, frameID, payload)
+	}
+}
+
+// TestOpenRejectsUnusableIDs 客户端不能打开服务端反向转发的ID，也不能用新的打开帧替换还在使用的流
+func TestOpenRejectsUnusableIDs(t *testing.T) {
+	opens := []struct {
+		name string
+		body []byte
+	}{
+		{"tcp", []byte{proto.AddrIPv4, 127, 0, 0, 1, 0, 9}},
+		{"数据报", []byte{proto.AddrIPv4 | proto.OpenDatagram, 127, 0, 0, 1, 0, 9}},
+		{"dns", []byte{proto.AddrIPv4 | proto.OpenDNS, 0, 0, 0, 0, 0, 53}},
+	}
+	for _, wc := range wires {
+		for _, open := range opens {
+			conn := &captureConn{}
+			h := NewBluetoothMuxHandler(conn)
+			h.features.Store(wc.features)
+
+			reserved := wc.wire.ServerStreamBase()
+			h.handleStreamData(0, append(wc.wire.AppendID(nil, reserved), open.body...))
+			if _, ok := h.streamMap.Load(reserved); ok {
+				t.Errorf("%v %s: 客户端在服务端的ID 空间打开了流", wc.wire, open.name)
+			}
+			expectOpenFailure(t, wc.wire, conn, reserved, open.name+" 服务端的ID")
+
+			const id = 7
+			old := newMuxStream(nil, false)
+			h.streamMap.Store(uint32(id), old)
+			h.handleStreamData(0, append(wc.wire.AppendID(nil, id), open.body...))
+			if s, _ := h.streamMap.Load(uint32(id)); s != old {
+				t.Errorf("%v %s: 重复打开替换了还在使用的流", wc.wire, open.name)
+			}
+			expectOpenFailure(t, wc.wire, conn, id, open.name+" 重复打开")
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ResumeGrace 蓝牙断开后保留会话的时长，客户端在此期间重连即可接回所有流
+var ResumeGrace = 60 * time.Second
+
+// sessions 所有可恢复的会话，sessionKey -> *BluetoothMuxHandler
+var sessions sync.Map
+
+// peerIdentity 客户端在链路上的身份：设备和认证结果，会话只能被创建它的身份接回
+type peerIdentity struct {
+	device  string // 蓝牙 MAC 或链路对端的 IP
+	keyID   string // 链路认证的密钥 ID，未开启认证时为空
+	tlsName string // 客户端公钥在指纹文件中的名字，未开启加密时为空
+}
+
+// sessionKey 会话按客户端给出的ID 和创建它的身份登记，
+// 其他身份即使知道或猜中了会话ID 也只会得到一个新会话
+type sessionKey struct {
+	id  uint64
+	who peerIdentity
+}
+
+// negotiate 计算与客户端共同支持的特性，会话恢复依赖流控的字节计数
+func negotiate(peer proto.Hello) uint32 {
+	features := proto.Features & peer.Features
+	if features&proto.FeatFlowControl == 0 || peer.SessionID == 0 {
+		features &^= proto.FeatResume
+	}
+	return features
+}
+
+func lookupSession(id uint64, who peerIdentity) *BluetoothMuxHandler {
+	if v, ok := sessions.Load(sessionKey{id, who}); ok {
+		return v.(*BluetoothMuxHandler)
+	}
+	return nil
+}
+
+// register 把本处理器登记为一个新会话，记下当前链路认证得到的身份
+func (h *BluetoothMuxHandler) register(id uint64) {
+	h.writeMutex.Lock()
+	h.sessionID = id
+	h.owner = h.identity()
+	key := sessionKey{id, h.owner}
+	h.writeMutex.Unlock()
+	sessions.Store(key, h)
+}
+
+// identity 返回本连接认证得到的身份
+func (h *BluetoothMuxHandler) identity() peerIdentity {
+	return peerIdentity{device: h.device, keyID: h.keyID, tlsName: h.tlsName}
+}
+
+// resumable 判断链路断开后是否保留会话
+func (h *BluetoothMuxHandler) resumable() bool {
+	return h.has(proto.FeatResume)
+}
+
+// attach 把客户端重连的链路接入本会话：回复握手和本端的恢复报告，
+// 之后普通帧暂停发送，直到收到客户端的报告并补发完丢失的数据
+// who 是新链路认证得到的身份，与创建会话的身份不同时拒绝接回，由调用方开始新会话
+func (h *BluetoothMuxHandler) attach(conn io.ReadWriteCloser, peer proto.Hello, who peerIdentity) (uint64, bool) {
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	if h.finished {
+		return 0, false
+	}
+	if who != h.owner {
+		fmt.Printf("会话 %x 属于另一个客户端身份，拒绝接回\n", h.sessionID)
+		return 0, false
+	}
+	if h.graceTimer != nil {
+		h.graceTimer.Stop()
+		h.graceTimer = nil
+	}
+	// 先让旧链路的读协程失效，再关闭它
+	gen := h.gen.Add(1)
+	if h.btConn != conn {
+		h.btConn.Close()
+		h.btConn = conn
+	}
+	h.detached = false
+	h.resuming = true
+	h.resumeBuf = nil
+	h.features.Store(negotiate(peer))
+	h.peerMaxFrame.Store(peer.MaxFrame)
+	h.lastRecv.Store(time.Now().UnixNano())
+
+	var entries []proto.ResumeEntry
+	h.streamMap.Range(func(key, value interface{}) bool {
+		s := value.(*muxStream)
+		entries = append(entries, proto.ResumeEntry{
+			ID:       key.(uint32),
+			Received: s.received.Load(),
+			Granted:  s.granted.Load(),
+			FinRecv:  s.finSeen.Load(),
+		})
+		return true
+	})
+	fmt.Printf("会话 %x 已恢复，%d 个流等待同步\n", h.sessionID, len(entries))
+	reply := proto.Hello{Version: proto.Version, Features: proto.Features, MaxFrame: maxFramePayload,
+		SessionID: h.sessionID, Flags: proto.HelloResumed}
+	h.writeLocked(proto.HelloID, reply.Marshal())
+	// 回复之后按新协商出的帧格式写出
+	for _, frame := range h.wire().ResumeFrames(entries, h.frameLimit()) {
+		h.writeLocked(0, frame)
+	}
+	return gen, true
+}
+
+// handleResume 拼接客户端的恢复报告，收齐后补发数据
+func (h *BluetoothMuxHandler) handleResume(w proto.Wire, args []byte) {
+	entries, last, ok := w.ParseResume(args)
+	if !ok {
+		fmt.Printf("无效的恢复报告: %x\n", args)
+		return
+	}
+	h.resumeBuf = append(h.resumeBuf, entries...)
+	if last {
+		entries, h.resumeBuf = h.resumeBuf, nil
+		h.applyResume(entries)
+	}
+}
+
+// applyResume 按客户端报告的收到字节数重传丢失的数据、校正额度，双方状态不一致的流直接重置
+func (h *BluetoothMuxHandler) applyResume(entries []proto.ResumeEntry) {
+	peer := make(map[uint32]proto.ResumeEntry, len(entries))
+	for _, e := range entries {
+		peer[e.ID] = e
+	}
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	h.streamMap.Range(func(key, value interface{}) bool {
+		id, s := key.(uint32), value.(*muxStream)
+		e, ok := peer[id]
+		delete(peer, id)
+		if !ok {
+			// 客户端已经没有这个流了
+			h.removeStream(id, s)
+			return true
+		}
+		data, ok := s.replay.Since(e.Received)
+		if !ok {
+			fmt.Printf("流 %d 需要重传的数据已丢弃，重置\n", id)
+			h.removeStream(id, s)
+			h.writeLocked(0, h.wire().ControlFrame(id, proto.CmdRst))
+			return true
+		}
+		s.replay.Ack(e.Received)
+		s.sendWin.Set(int(int64(e.Granted) - int64(s.replay.Sent())))
+		for limit := h.frameLimit(); len(data) > 0; {
+			n := min(len(data), limit)
+			h.writeLocked(id, data[:n])
+			data = data[n:]
+		}
+		s.mu.Lock()
+		finSent := s.finSent
+		s.mu.Unlock()
+		if finSent && !e.FinRecv {
+			h.writeLocked(0, h.wire().ControlFrame(id, proto.CmdFin))
+		}
+		return true
+	})
+	// 本端已经没有的流
+	for id := range peer {
+		h.writeLocked(0, h.wire().ControlFrame(id, proto.CmdRst))
+	}
+	h.resuming = false
+	h.linkCond.Broadcast()
+}
+
+// messageLimit 返回数据报流单帧的最大负载：一条消息整帧发出，不受 maxWritePayload 限制
+func (h *BluetoothMuxHandler) messageLimit() int {
+	limit := h.wire().MaxPayload()
+	if peer := int(h.peerMaxFrame.Load()); peer > 0 && peer < limit {
+		return peer
+	}
+	return limit
+}
+
+// frameLimit 返回发往客户端的单帧最大负载，同时受帧格式的长度字段限制
+func (h *BluetoothMuxHandler) frameLimit() int {
+	limit := min(maxWritePayload, h.wire().MaxPayload())
+	if peer := int(h.peerMaxFrame.Load()); peer > 0 && peer < limit {
+		return peer
+	}
+	return limit
+}
+
+// waitLinkLocked 链路断开或正在恢复时等待，会话结束后返回错误，调用方需持有 writeMutex
+func (h *BluetoothMuxHandler) waitLinkLocked() error {
+	for (h.detached || h.resuming) && !h.finished {
+		h.linkCond.Wait()
+	}
+	if h.finished {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// linkLost 读协程发现链路断开：可恢复的会话保留 ResumeGrace，否则立即清理
+func (h *BluetoothMuxHandler) linkLost(gen uint64) {
+	if !h.resumable() {
+		h.finish()
+		return
+	}
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	if h.gen.Load() != gen || h.finished {
+		// 已经接回了新链路
+		return
+	}
+	h.detached = true
+	// 断开前正在恢复也没关系，下次接回时会重新交换报告
+	h.resuming = false
+	h.graceTimer = time.AfterFunc(ResumeGrace, func() { h.expire(gen) })
+	fmt.Printf("蓝牙链路断开，会话 %x 保留 %v 等待客户端重连\n", h.sessionID, ResumeGrace)
+}
+
+// expire 等待重连超时，结束会话
+func (h *BluetoothMuxHandler) expire(gen uint64) {
+	h.writeMutex.Lock()
+	stale := !h.detached || h.gen.Load() != gen
+	h.writeMutex.Unlock()
+	if stale {
+		return
+	}
+	fmt.Printf("会话 %x 等待重连超时，清理所有流\n", h.sessionID)
+	h.finish()
+}
+
+// finish 结束会话：注销、唤醒阻塞的发送方并清理所有流
+func (h *BluetoothMuxHandler) finish() {
+	h.endOnce.Do(func() {
+		h.writeMutex.Lock()
+		h.finished = true
+		key := sessionKey{h.sessionID, h.owner}
+		h.linkCond.Broadcast()
+		h.writeMutex.Unlock()
+		if key.id != 0 {
+			sessions.CompareAndDelete(key, h)
+		}
+		close(h.ended)
+		h.cleanup()
+	})
+}
+
+// corrupted 分帧层丢弃了损坏的帧：之后的数据帧与已收字节数对不上，
+// 全部丢弃并请客户端重新握手，由恢复报告补齐
+func (h *BluetoothMuxHandler) corrupted() {
+	if !h.resumable() {
+		fmt.Printf("警告: 丢弃了损坏的帧，客户端不支持会话恢复，流数据可能缺失\n")
+		return
+	}
+	// 丢的可能正是客户端的握手，每次都要提醒客户端
+	if !h.discarding {
+		fmt.Printf("丢弃了损坏的帧，请客户端重新同步\n")
+		h.discarding = true
+	}
+	// 损坏的可能正是恢复报告，因此不等待恢复完成直接发出；写入可能阻塞，不能卡住读协程
+	go func() {
+		h.writeMutex.Lock()
+		defer h.writeMutex.Unlock()
+		if !h.detached && !h.finished {
+			h.writeLocked(0, h.wire().ControlFrame(0, proto.CmdResync))
+		}
+	}()
+}
+
+// discardable 判断重新同步前是否丢弃该帧：数据帧和 FIN 依赖字节序号，由恢复时重传
+func discardable(w proto.Wire, id uint32, payload []byte) bool {
+	if id != 0 {
+		return true
+	}
+	_, cmd, _, ok := w.ParseControl(payload)
+	return ok && cmd == proto.CmdFin
+}
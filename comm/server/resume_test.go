@@ -0,0 +1,157 @@
+package server
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair 返回一对本机 TCP 连接，带内核缓冲，服务端写出时不会因为测试没读而阻塞
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// greet 在新链路上启动一个处理器并以 sessionID 握手，返回客户端一侧的连接和服务端的握手回复
+func greet(t *testing.T, sessionID uint64, device, keyID, tlsName string) (net.Conn, proto.Hello) {
+	t.Helper()
+	client, srv := tcpPair(t)
+	h := NewBluetoothMuxHandler(srv)
+	h.SetKeepalive(0, 0)
+	h.SetDevice(device)
+	h.SetPeer(keyID, tlsName)
+	h.Start()
+
+	hello := proto.Hello{Version: proto.Version, Features: proto.Features, MaxFrame: maxFramePayload, SessionID: sessionID}
+	frame, _ := proto.WireV1.AppendHeader(nil, proto.HelloID, len(hello.Marshal()))
+	if _, err := client.Write(append(frame, hello.Marshal()...)); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 4)
+	id, n, err := proto.WireV1.ReadHeader(client, header)
+	if err != nil || id != proto.HelloID {
+		t.Fatalf("没有收到握手回复: id %d err %v", id, err)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(client, payload); err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := proto.ParseHello(payload)
+	if !ok {
+		t.Fatalf("无效的握手回复: %x", payload)
+	}
+	return client, reply
+}
+
+// TestResumeRequiresSameIdentity 知道会话ID 的其他身份不能接回会话，原客户端仍能接回
+func TestResumeRequiresSameIdentity(t *testing.T) {
+	const id = 0x5e55_1d00_0000_0022
+	owner := peerIdentity{device: "AA:BB:CC:DD:EE:FF", keyID: "phone", tlsName: "phone"}
+
+	conn, reply := greet(t, id, owner.device, owner.keyID, owner.tlsName)
+	if reply.Flags&proto.HelloResumed != 0 {
+		t.Fatal("第一次握手不应是恢复")
+	}
+	h := lookupSession(id, owner)
+	if h == nil {
+		t.Fatal("会话没有登记")
+	}
+	defer h.finish()
+	conn.Close()
+
+	others := []peerIdentity{
+		{device: owner.device, keyID: "laptop", tlsName: owner.tlsName},
+		{device: owner.device, keyID: owner.keyID, tlsName: "laptop"},
+		{device: "11:22:33:44:55:66", keyID: owner.keyID, tlsName: owner.tlsName},
+	}
+	for _, who := range others {
+		_, reply := greet(t, id, who.device, who.keyID, who.tlsName)
+		if reply.Flags&proto.HelloResumed != 0 {
+			t.Errorf("身份 %+v 接回了别人的会话", who)
+		}
+		if other := lookupSession(id, who); other == nil || other == h {
+			t.Errorf("身份 %+v 应得到自己的新会话", who)
+		} else {
+			other.finish()
+		}
+		if lookupSession(id, owner) != h {
+			t.Fatalf("身份 %+v 的握手替换了原会话", who)
+		}
+	}
+
+	// 直接调用 attach 也要校验身份
+	if _, ok := h.attach(nil, proto.Hello{SessionID: id}, others[0]); ok {
+		t.Fatal("attach 接受了不同的身份")
+	}
+
+	_, reply = greet(t, id, owner.device, owner.keyID, owner.tlsName)
+	if reply.Flags&proto.HelloResumed == 0 {
+		t.Fatal("原客户端没能接回会话")
+	}
+}
+
+// TestResumeUnknownOrExpired 未登记或已过期的会话ID 得到新会话，不会误接回
+func TestResumeUnknownOrExpired(t *testing.T) {
+	grace := ResumeGrace
+	ResumeGrace = 20 * time.Millisecond
+	defer func() { ResumeGrace = grace }()
+	who := peerIdentity{device: "AA:BB:CC:DD:EE:01"}
+
+	const unknown = 0x5e55_1d00_0000_0007
+	_, reply := greet(t, unknown, who.device, "", "")
+	if reply.Flags&proto.HelloResumed != 0 {
+		t.Fatal("未登记的会话被当作恢复")
+	}
+	if reply.SessionID != unknown {
+		t.Fatalf("回复的会话ID %x", reply.SessionID)
+	}
+	h := lookupSession(unknown, who)
+	if h == nil {
+		t.Fatal("新会话没有登记")
+	}
+
+	// 断开后等待超过 ResumeGrace，会话被清理
+	h.btConn.Close()
+	select {
+	case <-h.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("会话没有过期")
+	}
+	if lookupSession(unknown, who) != nil {
+		t.Fatal("过期的会话仍在登记表中")
+	}
+	if _, ok := h.attach(nil, proto.Hello{SessionID: unknown}, who); ok {
+		t.Fatal("过期的会话仍能接回")
+	}
+
+	_, reply = greet(t, unknown, who.device, "", "")
+	if reply.Flags&proto.HelloResumed != 0 {
+		t.Fatal("过期的会话被接回")
+	}
+	if other := lookupSession(unknown, who); other == nil || other == h {
+		t.Fatal("应得到新会话")
+	} else {
+		other.finish()
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// reverseOpenTimeout 反向转发流等待客户端拨号结果的时长
+const reverseOpenTimeout = 10 * time.Second
+
+// handleListen 按客户端的请求监听 TCP 端口，监听地址受访问控制限制，见 listenTCP
+// 同一监听ID 已有监听时先关闭旧的（客户端重连后重新请求）
+func (h *BluetoothMuxHandler) handleListen(lid uint32, args []byte) {
+	host, port, _, ok := proto.ParseAddr(args)
+	if !ok {
+		fmt.Printf("无效的监听请求: %x\n", args)
+		h.sendControl(lid, proto.CmdListenReply, proto.OpenFailure)
+		return
+	}
+	if old, ok := h.listeners.LoadAndDelete(lid); ok {
+		old.(net.Listener).Close()
+	}
+	ln, err := h.listenTCP(host, port)
+	if err != nil {
+		fmt.Printf("反向转发监听 %s 失败: %v\n", net.JoinHostPort(host, strconv.Itoa(int(port))), err)
+		h.sendControl(lid, proto.CmdListenReply, proto.DialErrorCode(err))
+		return
+	}
+	h.listeners.Store(lid, ln)
+	select {
+	case <-h.ended:
+		// 会话已在清理，不会再有人关闭它
+		h.listeners.Delete(lid)
+		ln.Close()
+		return
+	default:
+	}
+	h.sendControl(lid, proto.CmdListenReply, proto.OpenSuccess)
+	fmt.Printf("反向转发 %d 监听在 %s\n", lid, ln.Addr())
+	go h.acceptLoop(lid, ln)
+}
+
+// handleUnlisten 停止监听，已经建立的连接不受影响
+func (h *BluetoothMuxHandler) handleUnlisten(lid uint32) {
+	if ln, ok := h.listeners.LoadAndDelete(lid); ok {
+		ln.(net.Listener).Close()
+		fmt.Printf("反向转发 %d 已停止监听\n", lid)
+	}
+}
+
+func (h *BluetoothMuxHandler) acceptLoop(lid uint32, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("反向转发 %d 接受连接失败: %v\n", lid, err)
+				h.listeners.CompareAndDelete(lid, ln)
+				ln.Close()
+			}
+			return
+		}
+		go h.openReverse(lid, conn)
+	}
+}
+
+// openReverse 为接受的连接向客户端打开一个流，客户端拨通本地目标后才开始转发
+func (h *BluetoothMuxHandler) openReverse(lid uint32, conn net.Conn) {
+	s := newMuxStream(conn, h.has(proto.FeatFlowControl))
+	s.opened = make(chan byte, 1)
+	id, ok := h.allocReverseID(s)
+	if !ok {
+		fmt.Printf("反向转发流ID 已用完，拒绝 %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	peer := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	accept := func(w proto.Wire) []byte {
+		args := proto.AppendAddr(w.AppendID(nil, lid), peer.Addr().Unmap().String(), peer.Port())
+		return w.ControlFrame(id, proto.CmdAccept, args...)
+	}
+	if err := h.sendFrame(0, accept); err != nil {
+		h.removeStream(id, s)
+		return
+	}
+	timer := time.NewTimer(reverseOpenTimeout)
+	defer timer.Stop()
+	select {
+	case code := <-s.opened:
+		if code != proto.OpenSuccess {
+			fmt.Printf("反向转发 %s 被客户端拒绝: %s\n", conn.RemoteAddr(), proto.OpenCodeText(code))
+			h.removeStream(id, s)
+			return
+		}
+	case <-timer.C:
+		if h.removeStream(id, s) {
+			fmt.Printf("反向转发流 %d 等待客户端回复超时\n", id)
+			h.sendControl(id, proto.CmdRst)
+		}
+		return
+	case <-h.ended:
+		return
+	}
+	fmt.Printf("反向转发流 %d 已建立: %s\n", id, conn.RemoteAddr())
+	go h.startForwardBridge(id, s)
+	go h.startReverseBridge(id, s)
+}
+
+// allocReverseID 在服务端的ID 空间中分配一个未使用的流ID 并登记流
+func (h *BluetoothMuxHandler) allocReverseID(s *muxStream) (uint32, bool) {
+	h.reverseMu.Lock()
+	defer h.reverseMu.Unlock()
+	w := h.wire()
+	base, limit := w.ServerStreamBase(), w.IDLimit()
+	for i := base; i < limit; i++ {
+		h.lastReverseID++
+		if h.lastReverseID < base || h.lastReverseID >= limit {
+			h.lastReverseID = base
+		}
+		if _, loaded := h.streamMap.LoadOrStore(h.lastReverseID, s); !loaded {
+			return h.lastReverseID, true
+		}
+	}
+	return 0, false
+}
+
+// closeListeners 关闭所有反向转发监听
+func (h *BluetoothMuxHandler) closeListeners() {
+	h.listeners.Range(func(key, value interface{}) bool {
+		value.(net.Listener).Close()
+		h.listeners.Delete(key)
+		return true
+	})
+}
@@ -1,208 +1,841 @@
 package server
 
 import (
+	"dosgo/btProxy/comm/framing"
+	"dosgo/btProxy/comm/proto"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // BluetoothMuxHandler 对应 Java 版的 BluetoothMuxHandler
 type BluetoothMuxHandler struct {
 	btConn io.ReadWriteCloser
-	// 用于管理逻辑流 ID (端口) 与本地 Socket 的映射
+	// 用于管理逻辑流 ID (端口) 与本地 Socket 的映射，值为 *muxStream
 	streamMap sync.Map
 	// 控制并发写入的互斥锁
 	writeMutex sync.Mutex
 	// 关闭信号
 	closeChan chan struct{}
+	// 握手协商出的特性位，客户端没有握手时为 0，按旧版帧格式工作
+	features atomic.Uint32
+	// 是否已经收到过第一帧，只在读协程中访问
+	greeted bool
+	// 本连接的读协程退出后关闭
+	done chan struct{}
+	// 会话结束、所有流清理完毕后关闭
+	ended   chan struct{}
+	endOnce sync.Once
+
+	// 会话恢复状态，均由 writeMutex 保护
+	sessionID    uint64              // 客户端在握手中给出的会话ID，0 表示不可恢复
+	owner        peerIdentity        // 创建会话的客户端身份，只有同一身份能接回
+	gen          atomic.Uint64       // 当前链路的代数，每接回一条新链路加一
+	detached     bool                // 链路已断开，等待客户端重连
+	resuming     bool                // 已接回新链路，等待客户端的恢复报告
+	finished     bool                // 会话已结束
+	linkCond     *sync.Cond          // 等待链路恢复
+	graceTimer   *time.Timer         // 断开后保留会话的计时器
+	peerMaxFrame atomic.Uint32       // 客户端能接收的最大帧负载
+	resumeBuf    []proto.ResumeEntry // 拼接中的恢复报告，只在读协程中访问
+	discarding   bool                // 收到损坏的帧后丢弃数据帧和 FIN，直到客户端重新握手，只在读协程中访问
+
+	keepaliveInterval time.Duration // 心跳间隔，<= 0 关闭
+	keepaliveMisses   int           // 连续多少个周期收不到数据视为链路已死
+	lastRecv          atomic.Int64  // 最近一次收到任意帧的时间，UnixNano
+	rtt               atomic.Int64  // 最近一次心跳往返时延
+	device            string        // 客户端设备的标识，访问控制按它匹配设备规则
+	keyID             string        // 链路认证的密钥 ID
+	tlsName           string        // 客户端公钥在 TLS 指纹文件中的名字
+
+	// 反向转发：客户端请求的监听，监听ID -> net.Listener
+	listeners     sync.Map
+	reverseMu     sync.Mutex
+	lastReverseID uint32 // 最近分配的服务端流ID，由 reverseMu 保护
+}
+
+// 心跳默认参数，与客户端一致
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultKeepaliveMisses   = 3
+)
+
+// maxFramePayload 服务端能接收的最大帧负载，握手时告知客户端
+// v1 帧格式的客户端还受 2 字节长度字段限制，最大 0xFFFF
+const maxFramePayload = 256 * 1024
+
+// maxWritePayload 发往客户端的单个数据帧的最大负载，与客户端一致
+// 客户端能接收更大的帧，但帧越小，插入其他流和出错后重传的粒度越细
+const maxWritePayload = 8 * 1024
+
+// legacyRecvLimit 旧版本客户端不遵守流控时每个流最多缓存的数据量
+const legacyRecvLimit = 16 * 1024 * 1024
+
+// maxEarlyData 拨号完成前每个流最多缓存的客户端数据，旧版本客户端不等拨号结果就会发数据
+const maxEarlyData = proto.InitialWindow
+
+// muxStream 记录一个逻辑流对应的本地 Socket、流控状态及其半关闭状态
+type muxStream struct {
+	conn    net.Conn          // DNS 解析流没有本地 Socket，为 nil；TCP 流拨号完成前为 nil，由 mu 保护
+	recv    *proto.RecvBuffer // 客户端发来、等待写入 Socket 的数据
+	sendWin *proto.Window     // 客户端给出的发送额度
+	mu      sync.Mutex
+	finSent bool        // 本地 Socket 已读到 EOF，已向客户端发送 FIN
+	finRecv bool        // 已收到客户端 FIN 并写完缓冲，本地 Socket 已 CloseWrite
+	closed  bool        // 已从路由表移除
+	dialing atomic.Bool // 正在拨号，收到的数据先缓存在 recv 中
+
+	// 会话恢复用的序号：字节偏移即序号
+	replay      proto.Replay  // 已写出、客户端尚未确认消费的数据
+	received    atomic.Uint64 // 已收到的客户端数据总字节数
+	granted     atomic.Uint64 // 已授予客户端的额度总数，只统计真正写出的 WINDOW_UPDATE
+	peerGranted atomic.Uint64 // 客户端授予本端的额度总数
+	finSeen     atomic.Bool   // 已收到客户端 FIN
+
+	opened chan byte // 反向转发流等待客户端的打开结果，其他流为 nil
+
+	deflate *proto.Compressor // 客户端在打开帧中请求了压缩，未压缩的流为 nil
+}
+
+func newMuxStream(conn net.Conn, flowControl bool) *muxStream {
+	if !flowControl {
+		// 旧版本客户端没有流控，发送不设限
+		return &muxStream{
+			conn:    conn,
+			recv:    proto.NewRecvBuffer(legacyRecvLimit),
+			sendWin: proto.NewWindow(math.MaxInt),
+		}
+	}
+	s := &muxStream{
+		conn:    conn,
+		recv:    proto.NewRecvBuffer(proto.InitialWindow),
+		sendWin: proto.NewWindow(proto.InitialWindow),
+	}
+	s.granted.Store(proto.InitialWindow)
+	s.peerGranted.Store(proto.InitialWindow)
+	return s
 }
 
 // NewBluetoothMuxHandler 创建新的 MuxHandler
 func NewBluetoothMuxHandler(btConn io.ReadWriteCloser) *BluetoothMuxHandler {
-	return &BluetoothMuxHandler{
-		btConn:    btConn,
-		closeChan: make(chan struct{}),
+	h := &BluetoothMuxHandler{
+		btConn:            btConn,
+		closeChan:         make(chan struct{}),
+		done:              make(chan struct{}),
+		ended:             make(chan struct{}),
+		keepaliveInterval: DefaultKeepaliveInterval,
+		keepaliveMisses:   DefaultKeepaliveMisses,
 	}
+	h.linkCond = sync.NewCond(&h.writeMutex)
+	return h
+}
+
+// SetKeepalive 设置心跳间隔和允许连续丢失的次数，需在 Start 之前调用，interval <= 0 关闭心跳
+func (h *BluetoothMuxHandler) SetKeepalive(interval time.Duration, misses int) {
+	if misses <= 0 {
+		misses = DefaultKeepaliveMisses
+	}
+	h.keepaliveInterval = interval
+	h.keepaliveMisses = misses
+}
+
+// SetDevice 设置客户端设备的标识（蓝牙 MAC 或链路对端的 IP），需在 Start 之前调用
+func (h *BluetoothMuxHandler) SetDevice(device string) {
+	h.device = device
+}
+
+// SetPeer 设置链路认证得到的客户端身份：密钥 ID 和 TLS 客户端的名字，未开启的一项传空，需在 Start 之前调用
+// 可恢复的会话与设备和这两项绑定，身份不同的链路不能接回别人的会话
+func (h *BluetoothMuxHandler) SetPeer(keyID, tlsName string) {
+	h.keyID = keyID
+	h.tlsName = tlsName
+}
+
+// RTT 返回最近一次心跳测得的往返时延
+func (h *BluetoothMuxHandler) RTT() time.Duration {
+	return time.Duration(h.rtt.Load())
+}
+
+// Done 在本连接的读协程退出（蓝牙断开或心跳超时）后关闭
+// 可恢复的会话此时仍会保留一段时间，等待客户端从新的连接接回
+func (h *BluetoothMuxHandler) Done() <-chan struct{} {
+	return h.done
 }
 
 // Start 启动主循环，解析蓝牙发来的封装包
 func (h *BluetoothMuxHandler) Start() {
+	h.lastRecv.Store(time.Now().UnixNano())
+	if h.keepaliveInterval > 0 {
+		go h.keepaliveLoop()
+	}
 	go func() {
-		defer h.cleanup()
+		defer close(h.done)
+		// 握手发现是重连时，这条连接改由原有会话读取
+		owner, gen := h, h.gen.Load()
+		for owner != nil {
+			owner, gen = owner.readLink(h.btConn, gen)
+		}
+	}()
+}
 
-		header := make([]byte, 4)
-		for {
-			select {
-			case <-h.closeChan:
-				return
-			default:
-				// 1. 读取 4 字节头部
-				if _, err := io.ReadFull(h.btConn, header); err != nil {
-					if err != io.EOF {
-						fmt.Printf("读取头部错误: %v\n", err)
-					}
-					return
+// readLink 读取一条蓝牙链路直到出错
+// 握手时发现这条链路应交给某个会话（包括自己）接管时，返回该会话和新的链路代数
+func (h *BluetoothMuxHandler) readLink(conn io.ReadWriteCloser, gen uint64) (*BluetoothMuxHandler, uint64) {
+	header := make([]byte, 4)
+	for {
+		select {
+		case <-h.closeChan:
+			h.finish()
+			return nil, 0
+		default:
+			// 1. 读取头部，新链路上的第一帧是握手，两种帧格式都能识别
+			id, length, err := h.wire().ReadHeader(conn, header)
+			if err == nil && length > maxFramePayload {
+				err = proto.ErrFrameTooLarge
+			}
+			if err != nil {
+				if errors.Is(err, framing.ErrCorruptFrame) {
+					h.corrupted()
+					continue
+				}
+				if err != io.EOF {
+					fmt.Printf("读取头部错误: %v\n", err)
 				}
+				if err == proto.ErrFrameTooLarge {
+					conn.Close()
+				}
+				h.linkLost(gen)
+				return nil, 0
+			}
 
-				// 解析头部
-				id := binary.BigEndian.Uint16(header[0:2])
-				length := binary.BigEndian.Uint16(header[2:4])
-				// 2. 读取 Payload 数据
-				payload := make([]byte, length)
-				if length > 0 {
-					if _, err := io.ReadFull(h.btConn, payload); err != nil {
-						fmt.Printf("读取payload错误: %v\n", err)
-						return
+			// 2. 读取 Payload 数据
+			payload := make([]byte, length)
+			if length > 0 {
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					if errors.Is(err, framing.ErrCorruptFrame) {
+						h.corrupted()
+						continue
 					}
+					fmt.Printf("读取payload错误: %v\n", err)
+					h.linkLost(gen)
+					return nil, 0
 				}
+			}
+			if h.gen.Load() != gen {
+				// 这条链路已被客户端的新连接取代
+				return nil, 0
+			}
+
+			h.lastRecv.Store(time.Now().UnixNano())
 
-				// 3. 分发数据
-				h.handleStreamData(uint16(id), payload)
+			// 3. 分发数据
+			if id == proto.HelloID {
+				if owner, ownerGen := h.handleHello(conn, payload); owner != nil {
+					return owner, ownerGen
+				}
+				continue
+			}
+			if !h.greeted {
+				h.greeted = true
+				fmt.Printf("警告: 客户端未发送握手，可能是旧版本，按旧版帧格式处理\n")
 			}
+			if h.discarding && discardable(h.wire(), id, payload) {
+				continue
+			}
+			h.handleStreamData(id, payload)
 		}
-	}()
+	}
+}
+
+// handleHello 处理客户端握手并回复本端的版本和特性
+// 客户端带着已有会话的ID 重连时，返回接管这条链路的会话
+func (h *BluetoothMuxHandler) handleHello(conn io.ReadWriteCloser, data []byte) (*BluetoothMuxHandler, uint64) {
+	peer, ok := proto.ParseHello(data)
+	if !ok {
+		fmt.Printf("无效的握手帧: %x\n", data)
+		return nil, 0
+	}
+	h.greeted = true
+	h.discarding = false
+	features := negotiate(peer)
+	if peer.Version != proto.Version {
+		fmt.Printf("警告: 协议版本不一致，本端 %d，客户端 %d，按双方共同支持的特性工作\n", proto.Version, peer.Version)
+	}
+	if features&proto.FeatResume != 0 {
+		if owner := lookupSession(peer.SessionID, h.identity()); owner != nil {
+			if gen, ok := owner.attach(conn, peer, h.identity()); ok {
+				if owner != h {
+					// 本处理器只是新连接的空壳，会话状态都在原处理器里
+					h.finish()
+				}
+				return owner, gen
+			}
+		}
+		h.register(peer.SessionID)
+	}
+	fmt.Printf("握手完成: 客户端版本 %d, 特性 %#x, 最大帧 %d, 帧格式 %v\n", peer.Version, features, peer.MaxFrame, proto.WireFor(features))
+	reply := proto.Hello{Version: proto.Version, Features: proto.Features, MaxFrame: maxFramePayload, SessionID: peer.SessionID}
+	// 回复之后的帧按新格式写出，特性和回复在同一把锁内更新，其他协程不会插在中间
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	h.features.Store(features)
+	h.peerMaxFrame.Store(peer.MaxFrame)
+	err := h.waitLinkLocked()
+	if err == nil {
+		err = h.writeLocked(proto.HelloID, reply.Marshal())
+	}
+	if err != nil {
+		fmt.Printf("发送握手失败: %v\n", err)
+	}
+	return nil, 0
+}
+
+// wire 返回当前协商出的帧格式
+func (h *BluetoothMuxHandler) wire() proto.Wire {
+	return proto.WireFor(h.features.Load())
+}
+
+// has 判断握手是否协商出了某个特性
+func (h *BluetoothMuxHandler) has(feature uint32) bool {
+	return h.features.Load()&feature != 0
 }
 
 // handleStreamData 处理流数据
-func (h *BluetoothMuxHandler) handleStreamData(id uint16, data []byte) {
+func (h *BluetoothMuxHandler) handleStreamData(id uint32, data []byte) {
 	// 控制命令
 	if id == 0 {
-		if len(data) < 8 { // 需要至少 8 字节 (id(2) + ip(4) + port(2))
+		w := h.wire()
+		if w.IsControl(data) {
+			h.handleControl(w, data)
+			return
+		}
+		n := w.IDSize()
+		if len(data) < n+1 {
 			fmt.Printf("控制命令数据长度不足: %d\n", len(data))
 			return
 		}
 
 		// 解析控制命令
-		realID := binary.BigEndian.Uint16(data[0:2])
-		// 2. 解析 Flag (1字节)
-		flag := data[2]
-
-		var host string
-		var portOffset int
-
-		// 3. 根据 Flag 分支解析地址
-		switch flag {
-		case 0x01: // IPv4 (4字节)
-			host = net.IP(data[3:7]).String()
-			portOffset = 7
-		case 0x02: // IPv6 (16字节)
-			host = net.IP(data[3:19]).String()
-			portOffset = 19
-		case 0x03: // 域名 (变长)
-			// 注意：Java端用了 data.length-5 计算长度
-			// 这里我们直接截取 Flag 之后、Port 之前的所有字节作为域名
-			domainLen := len(data) - 5
-			host = string(data[3 : 3+domainLen])
-			portOffset = 3 + domainLen
-		default:
-			fmt.Printf("未知的地址类型标识: %d\n", flag)
+		realID := w.ID(data)
+		if realID == 0 || realID >= w.IDLimit() {
+			fmt.Printf("无效的流ID: %d\n", realID)
+			return
+		}
+		if h.has(proto.FeatReverse) && realID >= w.ServerStreamBase() {
+			// 这一段ID 由服务端分配给反向转发的流，客户端不能使用
+			fmt.Printf("客户端打开的流ID %d 属于服务端的ID 空间\n", realID)
+			h.refuseOpen(realID)
+			return
+		}
+		open, err := parseOpen(w, data)
+		if err != nil {
+			fmt.Printf("流 %d 的打开帧无效: %v\n", realID, err)
+			h.refuseOpen(realID)
 			return
 		}
-		port := binary.BigEndian.Uint16(data[portOffset : portOffset+2])
+		host, port := open.host, open.port
 
 		// 5. 构建标准地址并拨号
 		// 使用 net.JoinHostPort 自动处理 IPv6 的中括号问题
 		addr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
-
-		// 建立 TCP 连接
-		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
-		if err != nil {
-			fmt.Printf("建立TCP连接失败: %v\n", err)
+		if open.dns {
+			h.openDNS(realID)
+			return
+		}
+		if open.datagram {
+			h.openDatagram(realID, addr)
 			return
 		}
-		// 存入路由表
-		h.streamMap.Store(realID, conn)
 
-		// 启动反向桥接
-		go h.startReverseBridge(realID, conn)
+		// 先存入路由表再异步拨号，拨号期间收到的数据缓存在流的接收缓冲中，不阻塞读协程
+		s := newMuxStream(nil, h.has(proto.FeatFlowControl))
+		if open.compress {
+			s.deflate = new(proto.Compressor)
+		}
+		s.dialing.Store(true)
+		if !h.storeOpened(realID, s) {
+			return
+		}
+		go h.dialStream(realID, s, host, port)
 		return
 	}
 
 	// 数据帧
-	if value, exists := h.streamMap.Load(id); exists {
-		if conn, ok := value.(net.Conn); ok && conn != nil {
-			// 写入数据到对应的 Socket
-			if _, err := conn.Write(data); err != nil {
-				fmt.Printf("写入Socket失败: %v\n", err)
-				h.streamMap.Delete(id)
-				conn.Close()
+	value, exists := h.streamMap.Load(id)
+	if !exists {
+		// 流已不存在，通知客户端关闭
+		h.sendControl(id, proto.CmdRst)
+		return
+	}
+	s := value.(*muxStream)
+	if s.dialing.Load() && s.received.Load()+uint64(len(data)) > maxEarlyData {
+		fmt.Printf("流 %d 拨号期间收到的数据超出上限，重置\n", id)
+		if h.removeStream(id, s) {
+			h.sendControl(id, proto.CmdRst)
+		}
+		return
+	}
+	// 只放进缓冲，由 startForwardBridge 写入 Socket，避免慢速 Socket 阻塞整条蓝牙链路
+	if !s.recv.Push(data) {
+		fmt.Printf("流 %d 超出接收窗口，重置\n", id)
+		if h.removeStream(id, s) {
+			h.sendControl(id, proto.CmdRst)
+		}
+		return
+	}
+	s.received.Add(uint64(len(data)))
+}
+
+// refuseOpen 拒绝客户端的打开请求，协商了打开回复时回复 OpenFailure，否则重置流
+func (h *BluetoothMuxHandler) refuseOpen(id uint32) {
+	if h.has(proto.FeatOpenReply) {
+		h.sendControl(id, proto.CmdOpenReply, proto.OpenFailure)
+	} else {
+		h.sendControl(id, proto.CmdRst)
+	}
+}
+
+// storeOpened 登记客户端新打开的流，ID 仍被旧流占用时拒绝打开，不能替换掉还在转发的旧流
+func (h *BluetoothMuxHandler) storeOpened(id uint32, s *muxStream) bool {
+	if _, loaded := h.streamMap.LoadOrStore(id, s); loaded {
+		fmt.Printf("流ID %d 已在使用，拒绝重复打开\n", id)
+		h.refuseOpen(id)
+		return false
+	}
+	return true
+}
+
+// openRequest 打开帧解析出的目的地址和标志
+type openRequest struct {
+	host     string
+	port     uint16
+	datagram bool
+	dns      bool
+	compress bool
+}
+
+// 各地址类型的打开帧在流ID 之后的最短长度：[地址类型(1)][地址][端口(2)]
+const (
+	openIPv4Len   = 1 + 4 + 2
+	openIPv6Len   = 1 + 16 + 2
+	openDomainLen = 1 + 1 + 2 // 域名至少 1 字节
+)
+
+// parseOpen 解析打开帧：[流ID][地址类型(1)][地址][端口(2)]，域名占据地址类型与端口之间的全部字节
+// 长度不足或地址类型未知时返回错误，调用方保证 len(data) > w.IDSize()
+func parseOpen(w proto.Wire, data []byte) (openRequest, error) {
+	data = data[w.IDSize():]
+	flag := data[0]
+	open := openRequest{
+		datagram: flag&proto.OpenDatagram != 0,
+		dns:      flag&proto.OpenDNS != 0,
+		compress: flag&proto.OpenCompress != 0,
+	}
+	flag &^= proto.OpenDatagram | proto.OpenDNS | proto.OpenCompress
+
+	var min int
+	switch flag {
+	case proto.AddrIPv4:
+		min = openIPv4Len
+	case proto.AddrIPv6:
+		min = openIPv6Len
+	case proto.AddrDomain:
+		min = openDomainLen
+	default:
+		return open, fmt.Errorf("未知的地址类型标识: %d", flag)
+	}
+	if len(data) < min {
+		return open, fmt.Errorf("打开帧长度不足: %d", len(data))
+	}
+	switch flag {
+	case proto.AddrIPv4:
+		open.host = net.IP(data[1:5]).String()
+		open.port = binary.BigEndian.Uint16(data[5:7])
+	case proto.AddrIPv6:
+		open.host = net.IP(data[1:17]).String()
+		open.port = binary.BigEndian.Uint16(data[17:19])
+	default:
+		open.host = string(data[1 : len(data)-2])
+		open.port = binary.BigEndian.Uint16(data[len(data)-2:])
+	}
+	return open, nil
+}
+
+// dialStream 拨号目标地址，成功后回复客户端并启动桥接，缓冲中的早到数据按顺序写入 Socket；
+// 失败时回复错误码并移除流，缓冲的数据随之丢弃
+func (h *BluetoothMuxHandler) dialStream(id uint32, s *muxStream, host string, port uint16) {
+	conn, err := h.dialTCP(host, port)
+	if err != nil {
+		fmt.Printf("建立TCP连接失败: %v\n", err)
+		if h.removeStream(id, s) {
+			if h.has(proto.FeatOpenReply) {
+				h.sendControl(id, proto.CmdOpenReply, proto.DialErrorCode(err))
+			} else {
+				// 旧版本客户端不等待拨号结果，可能已经在发数据
+				h.sendControl(id, proto.CmdRst)
 			}
 		}
+		return
+	}
+	if !s.attach(conn) {
+		// 拨号期间流已被客户端重置或会话已结束
+		conn.Close()
+		return
 	}
+	// 先回复成功再启动桥接，保证结果帧先于数据帧到达
+	h.sendControl(id, proto.CmdOpenReply, proto.OpenSuccess)
+
+	// 启动正向与反向桥接
+	go h.startForwardBridge(id, s)
+	go h.startReverseBridge(id, s)
 }
 
-// startReverseBridge 反向桥接：读取本地 Socket 数据并打上 ID 头部发回蓝牙
-func (h *BluetoothMuxHandler) startReverseBridge(id uint16, conn net.Conn) {
-	defer func() {
-		h.streamMap.Delete(id)
+// keepaliveLoop 定期 PING 客户端，长时间收不到任何数据时关闭蓝牙连接
+func (h *BluetoothMuxHandler) keepaliveLoop() {
+	ticker := time.NewTicker(h.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.closeChan:
+			return
+		case <-h.ended:
+			return
+		case <-ticker.C:
+		}
+		// 旧版本客户端不会回复 PONG
+		if !h.has(proto.FeatKeepalive) {
+			continue
+		}
+		h.writeMutex.Lock()
+		conn, detached := h.btConn, h.detached
+		h.writeMutex.Unlock()
+		if detached {
+			continue
+		}
+		idle := time.Since(time.Unix(0, h.lastRecv.Load()))
+		if idle > h.keepaliveInterval*time.Duration(h.keepaliveMisses) {
+			fmt.Printf("警告: %v 未收到客户端任何数据，关闭蓝牙连接\n", idle.Round(time.Second))
+			// 关闭后读协程报错退出，不可恢复的会话随之清理所有流
+			conn.Close()
+			h.lastRecv.Store(time.Now().UnixNano())
+			continue
+		}
+		sent := time.Now().UnixNano()
+		h.sendFrame(0, func(w proto.Wire) []byte { return w.PingFrame(sent) })
+	}
+}
+
+// handleControl 处理客户端发来的 FIN/RST/窗口更新/心跳/反向转发请求
+func (h *BluetoothMuxHandler) handleControl(w proto.Wire, data []byte) {
+	id, cmd, args, _ := w.ParseControl(data)
+	switch cmd {
+	case proto.CmdPing:
+		h.sendControl(0, proto.CmdPong, args...)
+		return
+	case proto.CmdPong:
+		if sent, ok := proto.ParsePong(args); ok {
+			h.rtt.Store(time.Now().UnixNano() - sent)
+		}
+		return
+	case proto.CmdResume:
+		h.handleResume(w, args)
+		return
+	case proto.CmdListen:
+		h.handleListen(id, args)
+		return
+	case proto.CmdUnlisten:
+		h.handleUnlisten(id)
+		return
+	}
+	value, exists := h.streamMap.Load(id)
+	if !exists {
+		return
+	}
+	s := value.(*muxStream)
+	switch cmd {
+	case proto.CmdFin:
+		// 缓冲中的数据写完后由 startForwardBridge 半关闭 Socket
+		s.finSeen.Store(true)
+		s.recv.CloseWrite()
+	case proto.CmdWindowUpdate:
+		if delta, ok := proto.ParseWindowUpdate(args); ok {
+			s.sendWin.Add(delta)
+			// 客户端已消费的数据不会再需要重传
+			s.replay.Ack(s.peerGranted.Add(uint64(delta)) - proto.InitialWindow)
+		}
+	case proto.CmdRst:
+		h.removeStream(id, s)
+	case proto.CmdOpenReply:
+		// 客户端对反向转发流的拨号结果
+		if s.opened != nil {
+			code := proto.OpenFailure
+			if len(args) > 0 {
+				code = args[0]
+			}
+			select {
+			case s.opened <- code:
+			default:
+			}
+		}
+	default:
+		fmt.Printf("未知的控制命令: %d\n", cmd)
+	}
+}
+
+// removeStream 从路由表移除流并关闭 Socket，返回 false 表示已被其他路径清理
+func (h *BluetoothMuxHandler) removeStream(id uint32, s *muxStream) bool {
+	if !h.streamMap.CompareAndDelete(id, s) {
+		return false
+	}
+	s.close()
+	return true
+}
+
+// close 关闭 Socket 并唤醒所有阻塞在缓冲和额度上的协程
+func (s *muxStream) close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
 		conn.Close()
-	}()
+	}
+	s.recv.Reset(net.ErrClosed)
+	s.sendWin.Close()
+	if s.deflate != nil {
+		s.deflate.Close()
+	}
+}
+
+// attach 拨号成功后设置 Socket，流已被关闭时返回 false
+func (s *muxStream) attach(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conn = conn
+	s.dialing.Store(false)
+	return true
+}
+
+// startForwardBridge 正向桥接：把客户端发来的数据写入本地 Socket，写完后归还发送额度
+// 压缩流的额度按压缩后的字节归还
+func (h *BluetoothMuxHandler) startForwardBridge(id uint32, s *muxStream) {
+	buffer := make([]byte, 1024*16)
+	unacked := 0
+	var src io.Reader = s.recv
+	var wire *countingReader
+	if s.deflate != nil {
+		wire = &countingReader{r: s.recv}
+		src = proto.NewDecompressor(wire)
+	}
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, werr := s.conn.Write(buffer[:n]); werr != nil {
+				if h.removeStream(id, s) {
+					fmt.Printf("写入Socket失败: %v\n", werr)
+					h.sendControl(id, proto.CmdRst)
+				}
+				return
+			}
+		}
+		if wire != nil {
+			n = wire.take()
+		}
+		unacked += n
+		if unacked >= proto.InitialWindow/2 && h.has(proto.FeatFlowControl) {
+			h.sendWindowUpdate(id, s, unacked)
+			unacked = 0
+		}
+		if err != nil && err != io.EOF && wire != nil {
+			// 解压失败，数据已经无法还原
+			if h.removeStream(id, s) {
+				fmt.Printf("流 %d 解压失败: %v\n", id, err)
+				h.sendControl(id, proto.CmdRst)
+			}
+			return
+		}
+		if err == io.EOF {
+			// 客户端半关闭，把 FIN 传递给目标服务器
+			if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			s.mu.Lock()
+			s.finRecv = true
+			done := s.finSent
+			s.mu.Unlock()
+			if done {
+				h.removeStream(id, s)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// countingReader 统计从接收缓冲取走的字节数，解压后的数据量与之不同，额度按取走的计算
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// take 返回上次调用以来取走的字节数
+func (c *countingReader) take() int {
+	n := c.n
+	c.n = 0
+	return n
+}
+
+// sendControl 发送控制命令，客户端不支持的命令直接省略
+func (h *BluetoothMuxHandler) sendControl(id uint32, cmd byte, args ...byte) error {
+	if !h.has(proto.CommandFeature(cmd)) {
+		return nil
+	}
+	return h.sendFrame(0, func(w proto.Wire) []byte { return w.ControlFrame(id, cmd, args...) })
+}
+
+// startReverseBridge 反向桥接：读取本地 Socket 数据并打上 ID 头部发回蓝牙
+func (h *BluetoothMuxHandler) startReverseBridge(id uint32, s *muxStream) {
+	conn := s.conn
 	buffer := make([]byte, 1024*4)
 	for {
 		select {
 		case <-h.closeChan:
 			fmt.Printf("closeChan....\r\n")
+			h.removeStream(id, s)
 			return
 		default:
 			// 设置读取超时，避免阻塞无法退出
 			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
 
 			n, err := conn.Read(buffer)
+			data := buffer[:n]
+			if n > 0 && s.deflate != nil {
+				data = s.deflate.Compress(data)
+			}
+			for off := 0; off < len(data); {
+				// 额度用完时阻塞在这里，不再读取 Socket，由 TCP 把背压传给目标服务器
+				k := s.sendWin.Acquire(min(len(data)-off, h.frameLimit()))
+				if k == 0 {
+					return
+				}
+				// 发送数据帧
+				if err := h.sendData(id, s, data[off:off+k]); err != nil {
+					fmt.Printf("发送帧失败: %v\n", err)
+					h.removeStream(id, s)
+					return
+				}
+				off += k
+			}
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					// 超时，继续循环
 					continue
 				}
-				// 其他错误，退出
-				if err != io.EOF {
+				if err == io.EOF {
+					// 目标服务器半关闭，转发 FIN，另一方向继续保持
+					s.mu.Lock()
+					s.finSent = true
+					done := s.finRecv
+					s.mu.Unlock()
+					h.sendControl(id, proto.CmdFin)
+					if done {
+						h.removeStream(id, s)
+					}
+					return
+				}
+				// 其他错误：若不是被 RST 主动关闭的，通知客户端重置
+				if h.removeStream(id, s) {
 					fmt.Printf("读取Socket错误: %v\n", err)
+					h.sendControl(id, proto.CmdRst)
 				}
 				return
 			}
-			if n > 0 {
-				// 发送数据帧
-				if err := h.sendFrame(id, buffer[:n]); err != nil {
-					fmt.Printf("发送帧失败: %v\n", err)
-					return
-				}
-			}
 		}
 	}
 }
 
-// sendFrame 封包发送：[ID(2)][Len(2)][Data...]
+// sendFrame 封包发送，负载在持锁后按当前帧格式构建
 // 使用互斥锁保证物理写入的原子性，防止多线程写入导致包头交织
-func (h *BluetoothMuxHandler) sendFrame(id uint16, data []byte) error {
+// 可恢复的会话在链路断开期间阻塞，直到客户端重连或会话超时
+func (h *BluetoothMuxHandler) sendFrame(id uint32, build func(w proto.Wire) []byte) error {
 	h.writeMutex.Lock()
 	defer h.writeMutex.Unlock()
-
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint16(header[0:2], id)
-	binary.BigEndian.PutUint16(header[2:4], uint16(len(data)))
-
-	// 写入头部
-	if _, err := h.btConn.Write(header); err != nil {
+	if err := h.waitLinkLocked(); err != nil {
 		return err
 	}
+	return h.writeLocked(id, build(h.wire()))
+}
 
-	// 写入数据
-	if len(data) > 0 {
-		if _, err := h.btConn.Write(data); err != nil {
+// sendData 发送数据帧并记入重传缓冲，超过客户端最大帧的数据拆成多帧连续写出
+func (h *BluetoothMuxHandler) sendData(id uint32, s *muxStream, data []byte) error {
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	if err := h.waitLinkLocked(); err != nil {
+		return err
+	}
+	if h.resumable() {
+		s.replay.Append(data)
+	}
+	for limit := h.frameLimit(); len(data) > limit; data = data[limit:] {
+		if err := h.writeLocked(id, data[:limit]); err != nil {
 			return err
 		}
 	}
+	return h.writeLocked(id, data)
+}
+
+// sendWindowUpdate 归还客户端额度，写出时才计入 granted，保证恢复报告与实际发出的一致
+func (h *BluetoothMuxHandler) sendWindowUpdate(id uint32, s *muxStream, delta int) error {
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	if err := h.waitLinkLocked(); err != nil {
+		return err
+	}
+	s.granted.Add(uint64(delta))
+	return h.writeLocked(0, h.wire().WindowUpdateFrame(id, delta))
+}
 
-	return nil
+// writeLocked 写出一帧，调用方需持有 writeMutex
+// 可恢复的会话写入失败时只断开链路，丢失的帧在恢复时由对端报告补齐
+// 负载超出帧格式的上限时返回错误而不是截断长度字段
+func (h *BluetoothMuxHandler) writeLocked(id uint32, data []byte) error {
+	// 包头和数据一次写出，分帧层会把每次写入当作一帧
+	frame, err := h.wire().AppendHeader(make([]byte, 0, 8+len(data)), id, len(data))
+	if err != nil {
+		return err
+	}
+	frame = append(frame, data...)
+	_, err = h.btConn.Write(frame)
+	if err != nil && h.resumable() {
+		h.btConn.Close()
+		return nil
+	}
+	return err
 }
 
 // cleanup 清理资源
 func (h *BluetoothMuxHandler) cleanup() {
+	h.closeListeners()
 	h.streamMap.Range(func(key, value interface{}) bool {
-		if conn, ok := value.(net.Conn); ok {
-			conn.Close()
+		if s, ok := value.(*muxStream); ok {
+			s.close()
 		}
 		h.streamMap.Delete(key)
 		return true
@@ -212,7 +845,7 @@ func (h *BluetoothMuxHandler) cleanup() {
 // Close 关闭处理器
 func (h *BluetoothMuxHandler) Close() {
 	close(h.closeChan)
-	h.cleanup()
+	h.finish()
 }
 
 // 辅助函数：创建控制命令帧
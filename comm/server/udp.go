@@ -0,0 +1,294 @@
+package server
+
+import (
+	"dosgo/btProxy/comm/proto"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPIdleTimeout UDP 关联在两个方向都没有数据多久后关闭
+var UDPIdleTimeout = 2 * time.Minute
+
+// udpAssocMaxPeers 一个 UDP 关联最多记住的目的地址数，满了淘汰最久没有发往的地址
+const udpAssocMaxPeers = 4096
+
+// udpAssoc 一个数据报流对应的 UDP 套接字及其 NAT 状态
+// 目的地址和整个关联一样，超过 UDPIdleTimeout 没有再发往就失效，长期使用的关联不会无限增长
+type udpAssoc struct {
+	conn       *net.UDPConn
+	lastActive atomic.Int64 // 最近一次收发数据的时间，UnixNano
+	mu         sync.Mutex
+	// 客户端发往过的地址及最近一次发往的时间，只有这些地址的回包才转给客户端
+	peers map[netip.AddrPort]time.Time
+	// 目的地址的解析结果，只在正向桥接协程中访问
+	resolved  map[string]udpTarget
+	lastPrune time.Time
+}
+
+// udpTarget 客户端请求的目的地址的解析结果
+type udpTarget struct {
+	to   netip.AddrPort // 被访问控制拒绝的地址为零值
+	last time.Time      // 最近一次发往的时间
+}
+
+func newUDPAssoc(conn *net.UDPConn) *udpAssoc {
+	a := &udpAssoc{
+		conn:      conn,
+		peers:     make(map[netip.AddrPort]time.Time),
+		resolved:  make(map[string]udpTarget),
+		lastPrune: time.Now(),
+	}
+	a.touch()
+	return a
+}
+
+func (a *udpAssoc) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// lookup 返回目的地址 key 已缓存的解析结果
+func (a *udpAssoc) lookup(key string, now time.Time) (netip.AddrPort, bool) {
+	a.prune(now)
+	t, ok := a.resolved[key]
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	a.remember(key, t.to, now)
+	return t.to, true
+}
+
+// remember 记录发往 key 的数据报，to 为零值表示该地址被拒绝，之后发往它的数据报直接丢弃
+func (a *udpAssoc) remember(key string, to netip.AddrPort, now time.Time) {
+	if _, ok := a.resolved[key]; !ok && len(a.resolved) >= udpAssocMaxPeers {
+		a.evictOldest()
+	}
+	a.resolved[key] = udpTarget{to: to, last: now}
+	if to.IsValid() {
+		a.mu.Lock()
+		a.peers[to] = now
+		a.mu.Unlock()
+	}
+}
+
+// evictOldest 淘汰最久没有发往的目的地址，没有其他域名还指向它时回包也不再接收
+func (a *udpAssoc) evictOldest() {
+	var oldest string
+	var t udpTarget
+	for key, r := range a.resolved {
+		if oldest == "" || r.last.Before(t.last) {
+			oldest, t = key, r
+		}
+	}
+	delete(a.resolved, oldest)
+	a.mu.Lock()
+	if last, ok := a.peers[t.to]; ok && !last.After(t.last) {
+		delete(a.peers, t.to)
+	}
+	a.mu.Unlock()
+}
+
+// prune 每隔半个空闲超时删除过期的目的地址
+func (a *udpAssoc) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < UDPIdleTimeout/2 {
+		return
+	}
+	a.lastPrune = now
+	for key, t := range a.resolved {
+		if now.Sub(t.last) > UDPIdleTimeout {
+			delete(a.resolved, key)
+		}
+	}
+	a.mu.Lock()
+	for to, last := range a.peers {
+		if now.Sub(last) > UDPIdleTimeout {
+			delete(a.peers, to)
+		}
+	}
+	a.mu.Unlock()
+}
+
+// isPeer 判断 from 的回包能否转给客户端：客户端在空闲超时内发往过该地址
+func (a *udpAssoc) isPeer(from netip.AddrPort, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last, ok := a.peers[from]
+	return ok && now.Sub(last) <= UDPIdleTimeout
+}
+
+// openDatagram 为数据报流创建一个 UDP 套接字，每条消息自带目的地址，打开帧中的地址只用于日志
+func (h *BluetoothMuxHandler) openDatagram(id uint32, addr string) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		fmt.Printf("创建UDP套接字失败: %v\n", err)
+		h.sendControl(id, proto.CmdOpenReply, proto.OpenFailure)
+		return
+	}
+	a := newUDPAssoc(conn)
+	s := newMuxStream(conn, h.has(proto.FeatFlowControl))
+	if !h.storeOpened(id, s) {
+		conn.Close()
+		return
+	}
+	h.sendControl(id, proto.CmdOpenReply, proto.OpenSuccess)
+	fmt.Printf("UDP 关联 %d 已建立: %s (请求 %s)\n", id, conn.LocalAddr(), addr)
+
+	dc := proto.NewDatagramConn(&streamConn{ackReader{h: h, id: id, s: s}}, conn.LocalAddr())
+	go h.startDatagramForward(id, s, a, dc)
+	go h.startDatagramReverse(id, s, a, dc)
+}
+
+// ackReader 从接收缓冲读取客户端数据，读满半个窗口后归还额度
+type ackReader struct {
+	h       *BluetoothMuxHandler
+	id      uint32
+	s       *muxStream
+	unacked int
+}
+
+func (r *ackReader) Read(p []byte) (int, error) {
+	n, err := r.s.recv.Read(p)
+	r.unacked += n
+	if r.unacked >= proto.InitialWindow/2 && r.h.has(proto.FeatFlowControl) {
+		r.h.sendWindowUpdate(r.id, r.s, r.unacked)
+		r.unacked = 0
+	}
+	return n, err
+}
+
+// streamConn 把服务端的一个流包装成 io.ReadWriteCloser，供 proto.DatagramConn 使用
+type streamConn struct {
+	ackReader
+}
+
+// Write 把一条消息作为一个数据帧发给客户端，见 sendDatagram
+func (c *streamConn) Write(p []byte) (int, error) {
+	if err := c.h.sendDatagram(c.id, c.s, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sendDatagram 把一条数据报消息整帧发出，超过客户端的最大帧时返回 proto.ErrDatagramTooLarge
+// 发送额度不够整条消息时像 UDP 一样丢弃，不等待客户端归还额度
+func (h *BluetoothMuxHandler) sendDatagram(id uint32, s *muxStream, msg []byte) error {
+	if len(msg) > h.messageLimit() {
+		return proto.ErrDatagramTooLarge
+	}
+	ok, err := s.sendWin.TryAcquire(len(msg))
+	if err != nil {
+		return net.ErrClosed
+	}
+	if !ok {
+		return nil
+	}
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	if err := h.waitLinkLocked(); err != nil {
+		return err
+	}
+	if h.resumable() {
+		s.replay.Append(msg)
+	}
+	return h.writeLocked(id, msg)
+}
+
+// Close 移除流并通知客户端重置
+func (c *streamConn) Close() error {
+	if c.h.removeStream(c.id, c.s) {
+		c.h.sendControl(c.id, proto.CmdRst)
+	}
+	return nil
+}
+
+// startDatagramForward 把客户端发来的数据报发往各自的目的地址
+func (h *BluetoothMuxHandler) startDatagramForward(id uint32, s *muxStream, a *udpAssoc, dc *proto.DatagramConn) {
+	buffer := make([]byte, proto.MaxDatagram)
+	for {
+		n, addr, err := dc.ReadFrom(buffer)
+		if err != nil {
+			if err == io.EOF {
+				// 客户端结束了关联
+				if h.removeStream(id, s) {
+					fmt.Printf("UDP 关联 %d 已关闭\n", id)
+				}
+			} else if h.removeStream(id, s) {
+				fmt.Printf("UDP 关联 %d 数据错误: %v\n", id, err)
+				h.sendControl(id, proto.CmdRst)
+			}
+			return
+		}
+		key := addr.String()
+		now := time.Now()
+		to, ok := a.lookup(key, now)
+		if !ok {
+			host, portStr, _ := net.SplitHostPort(key)
+			port, _ := strconv.Atoi(portStr)
+			to, err = h.resolveUDP(host, uint16(port))
+			if err != nil && err != proto.ErrDenied {
+				fmt.Printf("UDP 目的地址解析失败: %v\n", err)
+				continue
+			}
+			// 被拒绝的地址也记下来，之后发往它的数据报直接丢弃
+			a.remember(key, to, now)
+		}
+		if !to.IsValid() {
+			continue
+		}
+		a.touch()
+		if _, err := a.conn.WriteToUDPAddrPort(buffer[:n], to); err != nil {
+			fmt.Printf("UDP 发送到 %s 失败: %v\n", to, err)
+		}
+	}
+}
+
+// startDatagramReverse 把目的地址的回包连同来源地址发回客户端，空闲超时后关闭关联
+func (h *BluetoothMuxHandler) startDatagramReverse(id uint32, s *muxStream, a *udpAssoc, dc *proto.DatagramConn) {
+	buffer := make([]byte, 64*1024)
+	for {
+		select {
+		case <-h.closeChan:
+			h.removeStream(id, s)
+			return
+		default:
+		}
+		a.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := a.conn.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if time.Since(time.Unix(0, a.lastActive.Load())) > UDPIdleTimeout {
+					if h.removeStream(id, s) {
+						fmt.Printf("UDP 关联 %d 空闲超时，关闭\n", id)
+						h.sendControl(id, proto.CmdRst)
+					}
+					return
+				}
+				continue
+			}
+			if h.removeStream(id, s) {
+				fmt.Printf("读取UDP错误: %v\n", err)
+				h.sendControl(id, proto.CmdRst)
+			}
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if !a.isPeer(from, time.Now()) {
+			// 不是客户端发往过的地址，按 NAT 的规则丢弃
+			continue
+		}
+		a.touch()
+		// 超过客户端最大帧的回包丢弃，不拆成多帧
+		if _, err := dc.WriteTo(buffer[:n], net.UDPAddrFromAddrPort(from)); err != nil {
+			if err == proto.ErrDatagramTooLarge {
+				continue
+			}
+			h.removeStream(id, s)
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestUDPAssocBounded 发往大量地址的关联最多记住 udpAssocMaxPeers 个，淘汰最久没有发往的地址
+func TestUDPAssocBounded(t *testing.T) {
+	a := newUDPAssoc(nil)
+	now := time.Now()
+	addr := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, byte(i >> 8), byte(i)}), 53)
+	}
+	for i := 0; i < udpAssocMaxPeers+100; i++ {
+		now = now.Add(time.Millisecond)
+		a.remember(addr(i).String(), addr(i), now)
+		// 第一个地址一直在用，不会被淘汰
+		if _, ok := a.lookup(addr(0).String(), now); !ok {
+			t.Fatalf("第 %d 个地址之后常用的地址被淘汰", i)
+		}
+	}
+	if len(a.resolved) > udpAssocMaxPeers || len(a.peers) > udpAssocMaxPeers {
+		t.Fatalf("关联记住了 %d 个解析结果、%d 个回包地址，上限 %d", len(a.resolved), len(a.peers), udpAssocMaxPeers)
+	}
+	if a.isPeer(addr(1), now) {
+		t.Error("淘汰的地址的回包仍然转给客户端")
+	}
+	if !a.isPeer(addr(udpAssocMaxPeers+99), now) || !a.isPeer(addr(0), now) {
+		t.Error("最近发往的地址的回包被丢弃")
+	}
+}
+
+// TestUDPAssocExpires 超过空闲超时没有再发往的地址失效并被删除，仍在使用的地址保留
+func TestUDPAssocExpires(t *testing.T) {
+	a := newUDPAssoc(nil)
+	now := time.Now()
+	var peers []netip.AddrPort
+	for i := 0; i < 100; i++ {
+		to := netip.AddrPortFrom(netip.MustParseAddr("203.0.113.1"), uint16(1000+i))
+		peers = append(peers, to)
+		a.remember(fmt.Sprintf("peer%d.example.com:%d", i, to.Port()), to, now)
+	}
+	a.remember("denied.example.com:53", netip.AddrPort{}, now)
+
+	// 只有第一个地址在空闲超时内又发过数据
+	now = now.Add(UDPIdleTimeout / 2)
+	a.lookup("peer0.example.com:1000", now)
+	now = now.Add(UDPIdleTimeout/2 + time.Second)
+	if a.isPeer(peers[1], now) {
+		t.Error("过期的地址的回包仍然转给客户端")
+	}
+	if !a.isPeer(peers[0], now) {
+		t.Error("仍在使用的地址的回包被丢弃")
+	}
+	if _, ok := a.lookup("peer1.example.com:1001", now); ok {
+		t.Error("过期的解析结果仍然有效")
+	}
+	if len(a.resolved) != 1 || len(a.peers) != 1 {
+		t.Fatalf("过期后还剩 %d 个解析结果、%d 个回包地址", len(a.resolved), len(a.peers))
+	}
+}
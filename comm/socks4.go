@@ -0,0 +1,72 @@
+package comm
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// SOCKS4 回复码
+const (
+	socks4Granted  byte = 0x5A
+	socks4Rejected byte = 0x5B
+)
+
+// handleSocks4Connection 处理 SOCKS4/4a 的 CONNECT 请求
+// 客户端发送: [VN(04), CD, DSTPORT(2), DSTIP(4), USERID, 0]，
+// 4a 的 DSTIP 为 0.0.0.x (x != 0)，USERID 之后再跟 [域名, 0]，域名交给服务端解析
+func handleSocks4Connection(conn net.Conn, mux *MuxManager, users []ProxyUser) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return
+	}
+	// 超过缓冲区大小的 USERID 和域名视为非法请求
+	if _, err := br.ReadSlice(0); err != nil { // USERID
+		return
+	}
+	port := binary.BigEndian.Uint16(head[2:4])
+	host := net.IP(head[4:8]).String()
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		domain, err := br.ReadSlice(0)
+		if err != nil || len(domain) < 2 {
+			return
+		}
+		host = string(domain[:len(domain)-1])
+	}
+	fullTarget := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	reply := func(code byte) {
+		conn.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	}
+	if head[1] != socksConnect {
+		log.Printf("SOCKS4 不支持的命令: %#x", head[1])
+		reply(socks4Rejected)
+		return
+	}
+	if len(users) > 0 {
+		// SOCKS4 没有密码，配置了用户时一律拒绝
+		log.Printf("SOCKS4 客户端 %s 无法认证，拒绝", conn.RemoteAddr())
+		reply(socks4Rejected)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	stream, err := mux.OpenStreamContext(ctx, fullTarget)
+	cancel()
+	if err != nil {
+		log.Printf("SOCKS4 打开流失败: %v", err)
+		reply(socks4Rejected)
+		return
+	}
+	defer stream.Close()
+	reply(socks4Granted)
+
+	// 客户端可能在收到回复前就发出了数据，已被 br 读走的部分要先转发
+	relay(&bufferedConn{Conn: conn, r: br}, stream)
+	log.Printf("SOCKS4 代理流关闭: %s -> %s", conn.RemoteAddr(), fullTarget)
+}
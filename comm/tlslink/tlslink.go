@@ -0,0 +1,319 @@
+// Package tlslink 在物理链路上建立 TLS 1.3 会话，给 RFCOMM、串口等链路加上端到端加密。
+// 双方各有一个 Ed25519 密钥，用它生成的自签名证书握手，不走 CA，
+// 而是用对端公钥的指纹（SubjectPublicKeyInfo 的 SHA-256）互相校验，事先交换指纹即可。
+//
+// 加密层位于分帧层之上、认证和 Mux 之下：物理链路 → 分帧 → TLS → 认证 → Mux，两端顺序相同。
+// 每次链路重连都重新握手，Mux 会话的恢复不受影响。
+// 分帧层按 CRC 丢弃损坏的帧后，TLS 的记录序号就接不上了，这时返回 ErrRecordLost 让链路重连，
+// 由会话恢复补上丢失的数据。
+package tlslink
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"dosgo/btProxy/comm/framing"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPinMismatch 对端公钥指纹不在允许的列表里
+var ErrPinMismatch = errors.New("对端公钥指纹不匹配")
+
+// ErrRecordLost 下层的分帧层丢弃了损坏的帧，TLS 会话无法继续，需要重连
+var ErrRecordLost = errors.New("分帧层丢弃了加密记录，加密会话已失效")
+
+// HandshakeTimeout TLS 握手的时限，超时关闭连接
+const HandshakeTimeout = 15 * time.Second
+
+// Identity 本端的密钥和由它生成的自签名证书
+type Identity struct {
+	cert        tls.Certificate
+	Fingerprint string // 本端公钥指纹，交给对端配置
+}
+
+// GenerateKey 生成新的 Ed25519 私钥，返回 base64 文本
+func GenerateKey() string {
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+	return base64.StdEncoding.EncodeToString(seed)
+}
+
+// NewIdentity 从 GenerateKey 生成的私钥创建身份
+func NewIdentity(key string) (*Identity, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("无效的 TLS 私钥，应为 32 字节的 base64")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		cert:        tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf},
+		Fingerprint: Fingerprint(leaf),
+	}, nil
+}
+
+// LoadOrCreateIdentity 从文件读取私钥，文件不存在时生成一个新的并保存
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := GenerateKey()
+		if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return NewIdentity(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewIdentity(string(data))
+}
+
+// Fingerprint 证书公钥的指纹，十六进制的 SHA-256
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizePin 允许指纹中带冒号、空格和大写
+func normalizePin(pin string) string {
+	pin = strings.ToLower(strings.TrimSpace(pin))
+	return strings.NewReplacer(":", "", " ", "").Replace(pin)
+}
+
+// PinStore 按公钥指纹查找允许连接的对端，返回对端的名字
+type PinStore interface {
+	Lookup(fingerprint string) (name string, ok bool)
+}
+
+// Client 在 rw 上发起 TLS 握手，服务端公钥指纹必须等于 serverPin
+// 返回的连接替代 rw 使用，关闭它同时关闭 rw
+// TLS 1.3 中服务端在客户端发完握手后才校验客户端证书，被拒绝时要到第一次读取才返回错误
+func Client(rw io.ReadWriteCloser, id *Identity, serverPin string) (net.Conn, error) {
+	serverPin = normalizePin(serverPin)
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       []tls.Certificate{id.cert},
+		InsecureSkipVerify: true, // 不校验证书链，由 VerifyPeerCertificate 校验指纹
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			fp, err := peerFingerprint(raw)
+			if err != nil {
+				return err
+			}
+			if fp != serverPin {
+				return fmt.Errorf("%w: 服务端为 %s", ErrPinMismatch, fp)
+			}
+			return nil
+		},
+	}
+	conn := tls.Client(asConn(rw), conf)
+	if err := handshake(conn); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Server 等待客户端的 TLS 握手，客户端必须出示 peers 中登记过的公钥，返回连接和客户端的名字
+func Server(rw io.ReadWriteCloser, id *Identity, peers PinStore) (net.Conn, string, error) {
+	var name string
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{id.cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			fp, err := peerFingerprint(raw)
+			if err != nil {
+				return err
+			}
+			n, ok := peers.Lookup(fp)
+			if !ok {
+				return fmt.Errorf("%w: 客户端为 %s", ErrPinMismatch, fp)
+			}
+			name = n
+			return nil
+		},
+	}
+	conn := tls.Server(asConn(rw), conf)
+	if err := handshake(conn); err != nil {
+		return nil, name, err
+	}
+	return conn, name, nil
+}
+
+// handshake 限时握手，失败时关闭连接
+func handshake(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return fmt.Errorf("TLS 握手失败: %w", err)
+	}
+	return nil
+}
+
+func peerFingerprint(raw [][]byte) (string, error) {
+	if len(raw) == 0 {
+		return "", errors.New("对端没有出示证书")
+	}
+	cert, err := x509.ParseCertificate(raw[0])
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(cert), nil
+}
+
+// PinFile 从文本文件读取允许的对端，每行 "名字 指纹"，# 开头为注释
+// 文件修改后在下一次查找时重新加载，删掉一行即撤销对应的对端
+type PinFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	pins    map[string]string // 指纹 -> 名字
+}
+
+// NewPinFile 加载指纹文件，文件格式错误时返回错误
+func NewPinFile(path string) (*PinFile, error) {
+	p := &PinFile{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PinFile) Lookup(fingerprint string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.reload(); err != nil {
+		fmt.Printf("重新加载指纹文件失败，拒绝所有连接: %v\n", err)
+		p.pins = nil
+		return "", false
+	}
+	name, ok := p.pins[normalizePin(fingerprint)]
+	return name, ok
+}
+
+// Len 返回登记的对端个数
+func (p *PinFile) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pins)
+}
+
+// reload 文件有变化时重新读取，调用方持有 mu 或在构造期间调用
+func (p *PinFile) reload() error {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if p.pins != nil && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return nil
+	}
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pins := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s 第 %d 行格式错误，应为 \"名字 指纹\"", p.path, line)
+		}
+		pin := normalizePin(fields[1])
+		if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%s 第 %d 行: 无效的指纹 %q", p.path, line, fields[1])
+		}
+		pins[pin] = fields[0]
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	p.pins, p.modTime, p.size = pins, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// rwConn 把串口等没有地址和超时的 io.ReadWriteCloser 包装成 tls 需要的 net.Conn
+// 底层支持超时时转发给它
+type rwConn struct {
+	io.ReadWriteCloser
+}
+
+func asConn(rw io.ReadWriteCloser) net.Conn {
+	if c, ok := rw.(net.Conn); ok {
+		return c
+	}
+	return rwConn{rw}
+}
+
+// Read 把分帧层的 ErrCorruptFrame 换成 ErrRecordLost：
+// 上层看到的是 TLS 解密后的字节流，不能像 Mux 直接在分帧层之上时那样跳过损坏的帧继续读
+func (c rwConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if errors.Is(err, framing.ErrCorruptFrame) {
+		err = ErrRecordLost
+	}
+	return n, err
+}
+
+type linkAddr struct{}
+
+func (linkAddr) Network() string { return "link" }
+func (linkAddr) String() string  { return "link" }
+
+func (c rwConn) LocalAddr() net.Addr  { return linkAddr{} }
+func (c rwConn) RemoteAddr() net.Addr { return linkAddr{} }
+
+func (c rwConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c rwConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c rwConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package tlslink
+
+import (
+	"dosgo/btProxy/comm/framing"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pins 固定的指纹表
+type pins map[string]string
+
+func (p pins) Lookup(fp string) (string, bool) {
+	name, ok := p[normalizePin(fp)]
+	return name, ok
+}
+
+// throttled 按固定速率写出，模拟 RFCOMM 等慢速链路，并统计线上字节数
+type throttled struct {
+	net.Conn
+	bps   float64
+	next  time.Time
+	bytes atomic.Int64
+	// flip 大于 0 时，第 flip 次写入的中间一个字节被翻转
+	flip, writes int
+}
+
+func (t *throttled) Write(p []byte) (int, error) {
+	if t.bps > 0 {
+		now := time.Now()
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(float64(len(p)*8) / t.bps * float64(time.Second)))
+		time.Sleep(time.Until(t.next))
+	}
+	t.writes++
+	if t.writes == t.flip {
+		p = append([]byte(nil), p...)
+		p[len(p)/2] ^= 0x40
+	}
+	t.bytes.Add(int64(len(p)))
+	return t.Conn.Write(p)
+}
+
+// linkPair 建立一对经过分帧层的链路，encrypt 时再在其上完成 TLS 握手
+// 返回客户端、服务端的连接和客户端方向的物理链路
+func linkPair(t testing.TB, bps float64, encrypt bool) (io.ReadWriteCloser, io.ReadWriteCloser, *throttled) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	ta, tb := &throttled{Conn: a, bps: bps}, &throttled{Conn: b, bps: bps}
+	var client, srv io.ReadWriteCloser = framing.NewConn(ta), framing.NewConn(tb)
+	if !encrypt {
+		return client, srv, ta
+	}
+	cid, err := NewIdentity(GenerateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, _ := NewIdentity(GenerateKey())
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		conn, _, err := Server(srv, sid, pins{cid.Fingerprint: "pc"})
+		done <- result{conn, err}
+	}()
+	cconn, err := Client(client, cid, sid.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return cconn, r.conn, ta
+}
+
+// TestCorruptRecordDropsLink 分帧层丢弃了一条加密记录后，读取返回 ErrRecordLost 而不是可跳过的 ErrCorruptFrame
+func TestCorruptRecordDropsLink(t *testing.T) {
+	client, srv, phys := linkPair(t, 0, true)
+	defer client.Close()
+	defer srv.Close()
+	phys.flip = phys.writes + 2
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := client.Write([]byte("record")); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 64)
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, err = srv.Read(buf)
+	}
+	if !errors.Is(err, ErrRecordLost) {
+		t.Fatalf("期望 ErrRecordLost，得到 %v", err)
+	}
+	if errors.Is(err, framing.ErrCorruptFrame) {
+		t.Fatal("加密会话不能把损坏的帧当作可跳过")
+	}
+	if _, err := srv.Read(buf); !errors.Is(err, ErrRecordLost) {
+		t.Fatalf("加密会话失效后仍然可读: %v", err)
+	}
+}
+
+// BenchmarkTLSLink 在模拟的 2 Mbps 链路上比较分帧层之上加不加 TLS 的吞吐和线上开销
+// 运行 go test -bench TLSLink -benchtime 3x ./comm/tlslink/
+func BenchmarkTLSLink(b *testing.B) {
+	const bps = 2e6
+	cases := []struct {
+		name         string
+		total, chunk int
+	}{
+		{"bulk16K", 256 << 10, 16 << 10},
+		{"small64", 16 << 10, 64},
+	}
+	for _, encrypt := range []bool{false, true} {
+		for _, tc := range cases {
+			name := "plain/" + tc.name
+			if encrypt {
+				name = "tls/" + tc.name
+			}
+			b.Run(name, func(b *testing.B) {
+				b.SetBytes(int64(tc.total))
+				var wire, elapsed float64
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					client, srv, phys := linkPair(b, bps, encrypt)
+					base := phys.bytes.Load()
+					done := make(chan error)
+					go func() {
+						_, err := io.CopyN(io.Discard, srv, int64(tc.total))
+						done <- err
+					}()
+					b.StartTimer()
+					start := time.Now()
+					buf := make([]byte, tc.chunk)
+					for sent := 0; sent < tc.total; sent += tc.chunk {
+						if _, err := client.Write(buf); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err := <-done; err != nil {
+						b.Fatal(err)
+					}
+					elapsed += time.Since(start).Seconds()
+					wire += float64(phys.bytes.Load() - base)
+					b.StopTimer()
+					client.Close()
+					srv.Close()
+				}
+				payload := float64(tc.total * b.N)
+				b.ReportMetric(payload*8/elapsed/1000, "kbit/s")
+				b.ReportMetric(wire/payload, "wire/payload")
+			})
+		}
+	}
+}
+
+// BenchmarkTLSHandshake 统计一次握手在线上的字节数
+func BenchmarkTLSHandshake(b *testing.B) {
+	var wire int64
+	for i := 0; i < b.N; i++ {
+		client, srv, phys := linkPair(b, 0, true)
+		wire += phys.bytes.Load()
+		client.Close()
+		srv.Close()
+	}
+	b.ReportMetric(float64(wire)/float64(b.N), "client-bytes/op")
+}
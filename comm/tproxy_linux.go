@@ -0,0 +1,267 @@
+package comm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst IPv6 下取原始目的地址的选项，与 IPv4 的 SO_ORIGINAL_DST 同值
+const ip6tSoOriginalDst = 80
+
+// startRedirectProxy 接收 iptables REDIRECT 过来的 TCP 连接，按原始目的地址打开流，例如
+//
+//	iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner btproxy -j REDIRECT --to-ports 12345
+func startRedirectProxy(mux *MuxManager, tcpPort string, priority int) {
+	listener, err := net.Listen("tcp", tcpPort)
+	if err != nil {
+		log.Fatalf("TCP监听失败: %v", err)
+	}
+	log.Printf("透明代理 (REDIRECT) 启动在 %s", tcpPort)
+	stopChans.Store(tcpPort, listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		dst, err := originalDst(conn.(*net.TCPConn))
+		if err != nil {
+			log.Printf("获取 %s 的原始目的地址失败: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		if isSelf(dst, listener.Addr()) {
+			// 直接连到了代理端口，转发给自己会无限循环
+			conn.Close()
+			continue
+		}
+		log.Printf("透明代理: %s -> %s", conn.RemoteAddr(), dst)
+		go handleConnection(conn, mux, dst.String(), priority, false)
+	}
+}
+
+// originalDst 读取被 REDIRECT 前的目的地址，IPv4 和 IPv6 使用不同的选项
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+		if local.Addr().Unmap().Is4() {
+			// sockaddr_in 只有 16 字节，借用 IPv6Mreq 的 20 字节缓冲读取
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if sockErr == nil {
+				b := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[2:4]))
+			}
+			return
+		}
+		// sockaddr_in6 为 28 字节，借用 IPv6MTUInfo 的缓冲读取
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+		if sockErr == nil {
+			// Port 按网络字节序原样存放
+			port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), port)
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, sockErr
+}
+
+// isSelf 判断目的地址是否就是监听地址
+func isSelf(dst netip.AddrPort, listen net.Addr) bool {
+	l, err := netip.ParseAddrPort(listen.String())
+	if err != nil || l.Port() != dst.Port() {
+		return false
+	}
+	return l.Addr().IsUnspecified() && dst.Addr().IsLoopback() || l.Addr().Unmap() == dst.Addr()
+}
+
+// transparentControl 设置 IP_TRANSPARENT，允许接收和绑定非本机地址；UDP 同时要求内核附带原始目的地址
+// IPv6 双栈套接字也会收到 IPv4 的流量，两组选项都要设置
+func transparentControl(network, address string, c syscall.RawConn) error {
+	udp := strings.HasPrefix(network, "udp")
+	opts := [][2]int{{unix.SOL_SOCKET, unix.SO_REUSEADDR}, {unix.SOL_IP, unix.IP_TRANSPARENT}}
+	if udp {
+		opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+	}
+	if strings.HasSuffix(network, "6") {
+		opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+		if udp {
+			opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+		}
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, o := range opts {
+			if sockErr = unix.SetsockoptInt(int(fd), o[0], o[1], 1); sockErr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("设置透明代理选项失败（需要 CAP_NET_ADMIN）: %v", sockErr)
+	}
+	return nil
+}
+
+// startTProxy 在同一端口接收 iptables TPROXY 过来的 TCP 连接和 UDP 数据报，例如
+//
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//	iptables -t mangle -A PREROUTING -p udp -j TPROXY --on-port 12345 --tproxy-mark 1
+//	iptables -t mangle -A PREROUTING -p tcp -j TPROXY --on-port 12345 --tproxy-mark 1
+func startTProxy(mux *MuxManager, port string, priority int) {
+	lc := net.ListenConfig{Control: transparentControl}
+	listener, err := lc.Listen(context.Background(), "tcp", port)
+	if err != nil {
+		log.Fatalf("TPROXY TCP 监听失败: %v", err)
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", port)
+	if err != nil {
+		listener.Close()
+		log.Fatalf("TPROXY UDP 监听失败: %v", err)
+	}
+	udpConn := pc.(*net.UDPConn)
+	log.Printf("透明代理 (TPROXY) 启动在 %s", port)
+	// StopProxy 关闭 TCP 监听时一并关闭 UDP
+	stopChans.Store(port, &tproxyListener{Listener: listener, udp: udpConn})
+
+	go serveTProxyUDP(mux, udpConn, priority)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		// TPROXY 不改写目的地址，连接的本地地址就是原始目的地址
+		dst, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+		if isSelf(dst, listener.Addr()) {
+			conn.Close()
+			continue
+		}
+		log.Printf("透明代理: %s -> %s", conn.RemoteAddr(), dst)
+		go handleConnection(conn, mux, dst.String(), priority, false)
+	}
+}
+
+// tproxyListener 同时持有 TPROXY 的 TCP 监听和 UDP 套接字
+type tproxyListener struct {
+	net.Listener
+	udp *net.UDPConn
+}
+
+func (l *tproxyListener) Close() error {
+	l.udp.Close()
+	return l.Listener.Close()
+}
+
+// serveTProxyUDP 按 (来源, 原始目的地址) 把数据报分配到数据报流，
+// 回包从绑定在原始目的地址上的透明套接字发回，客户端看到的来源与它发往的地址一致
+func serveTProxyUDP(mux *MuxManager, conn *net.UDPConn, priority int) {
+	table := newUDPSessionTable(mux, priority)
+	defer table.Close()
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("TPROXY UDP 读取失败: %v", err)
+			}
+			return
+		}
+		dst, err := origDstFromOOB(oob[:oobn])
+		if err != nil {
+			log.Printf("TPROXY UDP 缺少原始目的地址: %v", err)
+			continue
+		}
+		if isSelf(dst, conn.LocalAddr()) {
+			continue
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		p := udpPacket{host: dst.Addr().String(), port: dst.Port(), data: append([]byte(nil), buf[:n]...)}
+		table.send(src.String()+"->"+dst.String(), p, func() (func(udpPacket), func()) {
+			return tproxyReplier(src, dst)
+		})
+	}
+}
+
+// tproxyReplier 返回把回包以 dst 为来源发给 src 的函数，发送套接字在第一次回包时创建
+func tproxyReplier(src, dst netip.AddrPort) (func(udpPacket), func()) {
+	var mu sync.Mutex
+	var reply *net.UDPConn
+	done := false // 会话已结束或绑定失败
+	send := func(p udpPacket) {
+		mu.Lock()
+		if reply == nil && !done {
+			network := "udp4"
+			if dst.Addr().Is6() {
+				network = "udp6"
+			}
+			lc := net.ListenConfig{Control: transparentControl}
+			pc, err := lc.ListenPacket(context.Background(), network, dst.String())
+			if err != nil {
+				log.Printf("TPROXY 绑定回包地址 %s 失败: %v", dst, err)
+				done = true
+			} else {
+				reply = pc.(*net.UDPConn)
+			}
+		}
+		c := reply
+		mu.Unlock()
+		if c != nil {
+			c.WriteToUDPAddrPort(p.data, src)
+		}
+	}
+	cleanup := func() {
+		mu.Lock()
+		done = true
+		if reply != nil {
+			reply.Close()
+		}
+		mu.Unlock()
+	}
+	return send, cleanup
+}
+
+// origDstFromOOB 从控制消息中取出 IP_ORIGDSTADDR / IPV6_ORIGDSTADDR
+func origDstFromOOB(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for i := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port)), nil
+		case *unix.SockaddrInet6:
+			return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), uint16(sa.Port)), nil
+		}
+	}
+	return netip.AddrPort{}, errors.New("控制消息中没有原始目的地址")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package comm
+
+import "log"
+
+func startRedirectProxy(mux *MuxManager, tcpPort string, priority int) {
+	log.Printf("透明代理 (REDIRECT) 仅支持 Linux，端口 %s 未启动", tcpPort)
+}
+
+func startTProxy(mux *MuxManager, port string, priority int) {
+	log.Printf("透明代理 (TPROXY) 仅支持 Linux，端口 %s 未启动", port)
+}
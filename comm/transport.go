@@ -0,0 +1,252 @@
+package comm
+
+import (
+	"dosgo/btProxy/comm/framing"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport 可断线重连的物理链路，MuxManager 直接在它上面读写
+type Transport interface {
+	io.ReadWriteCloser
+	// Dial 建立连接，已连接时直接返回
+	Dial() error
+	// Reconnect 主动断开当前连接，下一次读写时重新拨号
+	Reconnect()
+	// Name 链路地址，例如 rfcomm://94:d3:31:d3:04:f3
+	Name() string
+	Stats() TransportStats
+}
+
+// TransportStats 链路统计
+type TransportStats struct {
+	Connected    bool
+	Dials        uint64 // 成功拨号次数
+	DialFailures uint64
+	Drops        uint64 // 读写出错或主动断开的次数
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// defaultBaud 串口未指定波特率时的默认值
+const defaultBaud = 115200
+
+// linkWriteTimeout 单次写入的超时，底层支持 deadline 时生效
+const linkWriteTimeout = 5 * time.Second
+
+// NewTransport 按地址创建链路：
+//
+//	rfcomm://94:d3:31:d3:04:f3
+//	serial:///dev/ttyUSB0?baud=115200 或 serial://COM4?baud=9600
+//	tcp://127.0.0.1:9000
+//	unix:///tmp/btproxy.sock
+//
+// 不带协议头的地址视为蓝牙 MAC
+func NewTransport(addr string) (Transport, error) {
+	if !strings.Contains(addr, "://") {
+		if _, err := net.ParseMAC(addr); err != nil {
+			return nil, fmt.Errorf("无效的链路地址 %q", addr)
+		}
+		return NewConnectBT(addr), nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的链路地址 %q: %v", addr, err)
+	}
+	switch u.Scheme {
+	case "rfcomm", "bt":
+		if _, err := net.ParseMAC(u.Host); err != nil {
+			return nil, fmt.Errorf("无效的蓝牙地址 %q", u.Host)
+		}
+		return NewConnectBT(u.Host), nil
+	case "serial", "com":
+		name := u.Host + u.Path
+		if name == "" {
+			return nil, fmt.Errorf("串口地址缺少设备名: %q", addr)
+		}
+		baud := defaultBaud
+		if b := u.Query().Get("baud"); b != "" {
+			if baud, err = strconv.Atoi(b); err != nil || baud <= 0 {
+				return nil, fmt.Errorf("无效的波特率 %q", b)
+			}
+		}
+		return NewLink(addr, func() (io.ReadWriteCloser, error) {
+			return connectByCom(name, baud)
+		}), nil
+	case "tcp", "unix":
+		target := u.Host
+		if u.Scheme == "unix" {
+			target = u.Host + u.Path
+		}
+		if target == "" {
+			return nil, fmt.Errorf("链路地址缺少目标: %q", addr)
+		}
+		network := u.Scheme
+		return NewLink(addr, func() (io.ReadWriteCloser, error) {
+			return net.DialTimeout(network, target, 10*time.Second)
+		}), nil
+	default:
+		return nil, fmt.Errorf("不支持的链路类型 %q", u.Scheme)
+	}
+}
+
+// Link 在任意拨号函数之上实现 Transport：读写出错时丢弃连接，下一次读写时重新拨号
+type Link struct {
+	name      string
+	dial      func() (io.ReadWriteCloser, error)
+	handshake func(io.ReadWriteCloser) (io.ReadWriteCloser, error) // 每次拨号成功后、交给上层前执行，例如分帧、链路加密和认证
+	conn      io.ReadWriteCloser
+	mu        sync.Mutex // 保护 conn 的并发访问和重连过程
+
+	dials, dialFailures, drops, bytesRead, bytesWritten atomic.Uint64
+}
+
+// NewLink 创建链路，首次读写时才会拨号
+func NewLink(name string, dial func() (io.ReadWriteCloser, error)) *Link {
+	return &Link{name: name, dial: dial}
+}
+
+func (a *Link) Name() string {
+	return a.name
+}
+
+// SetHandshake 设置每次拨号成功后执行的握手，握手返回的连接替代原连接读写，
+// 失败时关闭连接，算作一次拨号失败。需在第一次读写之前调用
+func (a *Link) SetHandshake(fn func(io.ReadWriteCloser) (io.ReadWriteCloser, error)) {
+	a.handshake = fn
+}
+
+// Dial 建立连接，已连接时直接返回
+func (a *Link) Dial() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		return nil
+	}
+	conn, err := a.dial()
+	if err == nil && a.handshake != nil {
+		var wrapped io.ReadWriteCloser
+		if wrapped, err = a.handshake(conn); err != nil {
+			conn.Close()
+		} else {
+			conn = wrapped
+		}
+	}
+	if err != nil {
+		a.dialFailures.Add(1)
+		return err
+	}
+	a.dials.Add(1)
+	a.conn = conn
+	return nil
+}
+
+// 实现 io.Reader
+func (a *Link) Read(p []byte) (n int, err error) {
+	a.mu.Lock()
+	currConn := a.conn
+	a.mu.Unlock()
+	if currConn != nil {
+		n, err = currConn.Read(p)
+		a.bytesRead.Add(uint64(n))
+		if errors.Is(err, framing.ErrCorruptFrame) {
+			// 分帧层丢弃了损坏的帧，连接仍然可用，由 Mux 发起重传
+			return n, err
+		}
+		if err != nil {
+			log.Printf("%s 读取失败: %v, 准备重连...", a.name, err)
+			a.drop(currConn)
+		}
+		return n, err
+	}
+	a.redial()
+	return 0, errors.New("链路未连接，读取失败")
+}
+
+// 实现 io.Writer
+func (a *Link) Write(p []byte) (n int, err error) {
+	a.mu.Lock()
+	currConn := a.conn
+	a.mu.Unlock()
+	if currConn != nil {
+		if d, ok := currConn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			d.SetWriteDeadline(time.Now().Add(linkWriteTimeout))
+		}
+		n, err = currConn.Write(p)
+		a.bytesWritten.Add(uint64(n))
+		if err != nil {
+			log.Printf("%s 写入失败: %v, 准备重连...", a.name, err)
+			a.drop(currConn)
+		}
+		return n, err
+	}
+	a.redial()
+	return 0, errors.New("链路未连接，写入失败")
+}
+
+// drop 关闭出错的连接，若期间已经重连成功则保留新连接
+func (a *Link) drop(conn io.ReadWriteCloser) {
+	conn.Close()
+	a.mu.Lock()
+	if a.conn == conn {
+		a.conn = nil
+		a.drops.Add(1)
+	}
+	a.mu.Unlock()
+}
+
+// Reconnect 主动断开当前连接，下一次读写时重新连接
+// 用于心跳发现链路半死不活（手机走出范围、射频休眠）但读写尚未报错的情况
+func (a *Link) Reconnect() {
+	a.mu.Lock()
+	conn := a.conn
+	a.mu.Unlock()
+	if conn != nil {
+		log.Printf("主动断开链路: %s", a.name)
+		a.drop(conn)
+	}
+}
+
+// 内部重连方法
+func (a *Link) redial() error {
+	log.Printf("正在尝试连接: %s", a.name)
+	err := a.Dial()
+	if err != nil {
+		log.Printf("连接失败: %v", err)
+		return err
+	}
+	log.Printf("连接成功: %s", a.name)
+	return nil
+}
+
+func (a *Link) Stats() TransportStats {
+	a.mu.Lock()
+	connected := a.conn != nil
+	a.mu.Unlock()
+	return TransportStats{
+		Connected:    connected,
+		Dials:        a.dials.Load(),
+		DialFailures: a.dialFailures.Load(),
+		Drops:        a.drops.Load(),
+		BytesRead:    a.bytesRead.Load(),
+		BytesWritten: a.bytesWritten.Load(),
+	}
+}
+
+func (a *Link) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package comm
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// TunConfig TUN 模式配置：创建虚拟网卡接管整机路由，所有 TCP/UDP 经 Mux 流由手机发出
+type TunConfig struct {
+	// 网卡名，默认 btproxy0
+	Name string `json:"name,omitempty"`
+	// 网卡地址，默认 198.18.0.1/15
+	Address string `json:"address,omitempty"`
+	// IPv6 网卡地址，例如 fd00:b7::1/64，配置后同时接管 IPv6 流量
+	Address6 string `json:"address6,omitempty"`
+	// 默认 1500
+	MTU int `json:"mtu,omitempty"`
+	// 不经过 TUN 的目的网段（CIDR），保持原来的路由；
+	// 使用 tcp:// 等 IP 链路时必须把服务端地址排除在外，否则链路本身会被接管
+	Exclude []string `json:"exclude,omitempty"`
+	// DNS 劫持：发往任意地址 53 端口的 TCP/UDP 都改发到这里，例如 8.8.8.8 或 1.1.1.1:53，为空不劫持
+	DNS string `json:"dns,omitempty"`
+}
+
+const (
+	defaultTunName    = "btproxy0"
+	defaultTunAddress = "198.18.0.1/15"
+	defaultTunMTU     = 1500
+)
+
+// DeviceName 返回网卡名，也是 StopProxy 停止 TUN 模式时使用的键
+func (c TunConfig) DeviceName() string {
+	if c.Name == "" {
+		return defaultTunName
+	}
+	return c.Name
+}
+
+func (c TunConfig) withDefaults() TunConfig {
+	c.Name = c.DeviceName()
+	if c.Address == "" {
+		c.Address = defaultTunAddress
+	}
+	if c.MTU <= 0 {
+		c.MTU = defaultTunMTU
+	}
+	if c.DNS != "" {
+		if _, _, err := net.SplitHostPort(c.DNS); err != nil {
+			c.DNS = net.JoinHostPort(c.DNS, "53")
+		}
+	}
+	return c
+}
+
+// target 返回流实际要连接的地址，DNS 劫持时把 53 端口替换为配置的 DNS 服务器
+func (c TunConfig) target(dst netip.AddrPort) (host string, port uint16) {
+	if c.DNS != "" && dst.Port() == 53 {
+		h, p, _ := net.SplitHostPort(c.DNS)
+		n, _ := strconv.Atoi(p)
+		return h, uint16(n)
+	}
+	return dst.Addr().String(), dst.Port()
+}
@@ -0,0 +1,267 @@
+package comm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const tunNIC tcpip.NICID = 1
+
+// tunDevice 运行中的 TUN 网卡和 gVisor 协议栈
+type tunDevice struct {
+	cfg    TunConfig
+	mux    *MuxManager
+	fd     int
+	stack  *stack.Stack
+	udp    *udpSessionTable
+	routes [][]string // 添加的排除路由，关闭时删除；网卡上的路由随网卡一起消失
+	once   sync.Once
+}
+
+// StartTun 创建 TUN 网卡并把默认路由指向它，协议栈收到的 TCP 连接和 UDP 数据报都经 Mux 流转发。
+// 需要 root 或 CAP_NET_ADMIN，依赖 ip 命令配置地址和路由。
+// 启动成功后在后台运行，用 StopProxy(cfg.DeviceName()) 停止
+func StartTun(mux *MuxManager, cfg TunConfig) error {
+	cfg = cfg.withDefaults()
+	if _, err := netip.ParsePrefix(cfg.Address); err != nil {
+		return fmt.Errorf("TUN 地址 %q 无效: %v", cfg.Address, err)
+	}
+	if cfg.Address6 != "" {
+		if _, err := netip.ParsePrefix(cfg.Address6); err != nil {
+			return fmt.Errorf("TUN IPv6 地址 %q 无效: %v", cfg.Address6, err)
+		}
+	}
+	// 排除的网段要在接管默认路由之前查出原来的出口
+	var excludes [][]string
+	for _, cidr := range cfg.Exclude {
+		r, err := excludeRoute(cidr)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			excludes = append(excludes, r)
+		}
+	}
+
+	fd, err := tun.Open(cfg.Name)
+	if err != nil {
+		return fmt.Errorf("打开 TUN 网卡 %s 失败: %v", cfg.Name, err)
+	}
+	t := &tunDevice{cfg: cfg, mux: mux, fd: fd}
+	if err := t.setup(excludes); err != nil {
+		t.Close()
+		return err
+	}
+	stopChans.Store(cfg.Name, t)
+	log.Printf("TUN 模式启动: %s %s MTU %d", cfg.Name, cfg.Address, cfg.MTU)
+	return nil
+}
+
+// setup 配置网卡、启动协议栈，最后才修改路由，避免接管后有包无人处理
+func (t *tunDevice) setup(excludes [][]string) error {
+	cfg := t.cfg
+	if err := ipCmd("link", "set", "dev", cfg.Name, "mtu", strconv.Itoa(cfg.MTU), "up"); err != nil {
+		return err
+	}
+	if err := ipCmd("addr", "add", cfg.Address, "dev", cfg.Name); err != nil {
+		return err
+	}
+	if cfg.Address6 != "" {
+		if err := ipCmd("-6", "addr", "add", cfg.Address6, "dev", cfg.Name); err != nil {
+			return err
+		}
+	}
+	if err := t.startStack(); err != nil {
+		return err
+	}
+	for _, r := range excludes {
+		if err := ipCmd(append([]string{"route", "add"}, r...)...); err != nil {
+			return err
+		}
+		t.routes = append(t.routes, r)
+	}
+	// 用两条 /1 覆盖默认路由，不用删除原来的默认路由
+	routes := []string{"0.0.0.0/1", "128.0.0.0/1"}
+	if cfg.Address6 != "" {
+		routes = append(routes, "::/1", "8000::/1")
+	}
+	for _, r := range routes {
+		if err := ipCmd("route", "add", r, "dev", cfg.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startStack 在 TUN 上启动 gVisor 协议栈，接受任意目的地址的连接
+func (t *tunDevice) startStack() error {
+	ep, err := fdbased.New(&fdbased.Options{
+		FDs: []int{t.fd},
+		MTU: uint32(t.cfg.MTU),
+	})
+	if err != nil {
+		return fmt.Errorf("创建 TUN 链路失败: %v", err)
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	t.stack = s
+	if err := s.CreateNIC(tunNIC, ep); err != nil {
+		return fmt.Errorf("创建协议栈网卡失败: %v", err)
+	}
+	// 混杂模式接收目的地址不是自己的包，伪装模式允许以这些地址回包
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+
+	t.udp = newUDPSessionTable(t.mux, DefaultPriority)
+	tcpForwarder := tcp.NewForwarder(s, 0, 1024, t.handleTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, t.handleUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return nil
+}
+
+// handleTCP 先打开 Mux 流，成功后才完成握手，目标拒绝时客户端收到 RST
+func (t *tunDevice) handleTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	host, port := t.cfg.target(endpointAddr(id.LocalAddress, id.LocalPort))
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	stream, err := t.mux.OpenStreamContext(ctx, target)
+	cancel()
+	if err != nil {
+		log.Printf("TUN 连接 %s 失败: %v", target, err)
+		r.Complete(true)
+		return
+	}
+	defer stream.Close()
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	conn := gonet.NewTCPConn(&wq, ep)
+	defer conn.Close()
+	relay(conn, stream)
+}
+
+// handleUDP 每个 (来源, 目的) 对应一个数据报流，空闲超时后关闭端点
+func (t *tunDevice) handleUDP(r *udp.ForwarderRequest) bool {
+	id := r.ID()
+	src := endpointAddr(id.RemoteAddress, id.RemotePort)
+	dst := endpointAddr(id.LocalAddress, id.LocalPort)
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return false
+	}
+	conn := gonet.NewUDPConn(&wq, ep)
+	key := src.String() + "->" + dst.String()
+	host, port := t.cfg.target(dst)
+	open := func() (func(udpPacket), func()) {
+		// 端点已连接到来源，回包的来源地址总是原始目的地址
+		reply := func(p udpPacket) { conn.Write(p.data) }
+		return reply, func() { conn.Close() }
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, t.cfg.MTU)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			p := udpPacket{host: host, port: port, data: append([]byte(nil), buf[:n]...)}
+			t.udp.send(key, p, open)
+		}
+	}()
+	return true
+}
+
+func (t *tunDevice) Close() error {
+	t.once.Do(func() {
+		for _, r := range t.routes {
+			ipCmd(append([]string{"route", "del"}, r...)...)
+		}
+		if t.udp != nil {
+			t.udp.Close()
+		}
+		if t.stack != nil {
+			// RemoveNIC 会等待读取 TUN 的协程退出
+			t.stack.RemoveNIC(tunNIC)
+			t.stack.Close()
+		}
+		// 关闭后网卡和它上面的路由一起被删除
+		unix.Close(t.fd)
+		log.Printf("TUN 模式已停止: %s", t.cfg.Name)
+	})
+	return nil
+}
+
+func endpointAddr(addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return netip.AddrPortFrom(ip.Unmap(), port)
+}
+
+// excludeRoute 查出目的网段当前的出口，返回 ip route add 的参数；本机地址不需要路由，返回 nil
+func excludeRoute(cidr string) ([]string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		addr, err2 := netip.ParseAddr(cidr)
+		if err2 != nil {
+			return nil, fmt.Errorf("排除网段 %q 无效: %v", cidr, err)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	out, err := exec.Command("ip", "route", "get", prefix.Addr().String()).Output()
+	if err != nil {
+		return nil, fmt.Errorf("查询 %s 的路由失败: %v", cidr, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) > 0 && fields[0] == "local" {
+		return nil, nil
+	}
+	route := []string{prefix.Masked().String()}
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "via" || fields[i] == "dev" {
+			route = append(route, fields[i], fields[i+1])
+		}
+	}
+	return route, nil
+}
+
+// ipCmd 执行 ip 命令，出错时带上命令输出
+func ipCmd(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s 失败: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package comm
+
+import "errors"
+
+// StartTun TUN 模式目前只支持 Linux
+func StartTun(mux *MuxManager, cfg TunConfig) error {
+	return errors.New("TUN 模式仅支持 Linux")
+}
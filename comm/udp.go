@@ -0,0 +1,118 @@
+package comm
+
+import (
+	"bytes"
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// handleSocksUDP 处理 UDP ASSOCIATE：在本地开一个 UDP 端口收发客户端的数据报，
+// 经由一个数据报流交给服务端，TCP 控制连接断开时关联随之结束
+// user 非空时按其 Allow 规则过滤每个数据报的目的地址
+func handleSocksUDP(conn net.Conn, mux *MuxManager, target string, user *ProxyUser) {
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	stream, err := mux.OpenDatagramContext(ctx, target)
+	cancel()
+	if err != nil {
+		log.Printf("SOCKS5 打开数据报流失败: %v", err)
+		conn.Write([]byte{0x05, socksReply(err), 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer stream.Close()
+
+	// 与 TCP 控制连接使用同一个本地地址，客户端才能按回复中的地址找到中继端口
+	local := conn.LocalAddr().(*net.TCPAddr)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		log.Printf("SOCKS5 UDP 监听失败: %v", err)
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer udpConn.Close()
+	bind := udpConn.LocalAddr().(*net.UDPAddr)
+	conn.Write(appendSocksAddr([]byte{0x05, 0x00, 0x00}, bind.IP.String(), uint16(bind.Port)))
+	log.Printf("SOCKS5 UDP 关联: %s <-> %s", conn.RemoteAddr(), bind)
+
+	// 只接受控制连接所在主机的数据报；请求中给出了端口时即为客户端的发送地址，
+	// 否则以收到的第一个数据报为准
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	var client atomic.Pointer[net.UDPAddr]
+	if _, portStr, err := net.SplitHostPort(target); err == nil {
+		if port, _ := strconv.Atoi(portStr); port != 0 {
+			client.Store(&net.UDPAddr{IP: clientIP, Port: port})
+		}
+	}
+
+	// 流 → 本地 UDP
+	go func() {
+		defer conn.Close()
+		for {
+			host, port, data, err := proto.ReadDatagram(stream)
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, ErrStreamClosed) {
+					log.Printf("SOCKS5 UDP 流错误: %v", err)
+				}
+				return
+			}
+			to := client.Load()
+			if to == nil {
+				continue
+			}
+			packet := appendSocksAddr([]byte{0, 0, 0}, host, port)
+			udpConn.WriteToUDP(append(packet, data...), to)
+		}
+	}()
+
+	// 本地 UDP → 流
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(clientIP) {
+				continue
+			}
+			if to := client.Load(); to == nil {
+				client.Store(from)
+			} else if to.Port != from.Port {
+				continue
+			}
+			// [RSV(2), FRAG, ATYP, DST.ADDR, DST.PORT, DATA]
+			if n < 4 || buf[2] != 0 {
+				// 不支持分片，按 RFC 1928 直接丢弃
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			dest, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			if user != nil && !user.Allowed(dest) {
+				continue
+			}
+			host, portStr, _ := net.SplitHostPort(dest)
+			port, _ := strconv.Atoi(portStr)
+			data := buf[n-r.Len() : n]
+			if err := proto.WriteDatagram(stream, host, uint16(port), data); err != nil {
+				if err == proto.ErrDatagramTooLarge {
+					continue
+				}
+				log.Printf("SOCKS5 UDP 发送失败: %v", err)
+				return
+			}
+		}
+	}()
+
+	// 控制连接断开即结束关联
+	io.Copy(io.Discard, conn)
+	log.Printf("SOCKS5 UDP 关联结束: %s", conn.RemoteAddr())
+}
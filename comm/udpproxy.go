@@ -0,0 +1,50 @@
+package comm
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// startUDPPortProxy UDP 端口映射：本地端口收到的数据报按来源地址分配到各自的数据报流，
+// 由服务端发往 remoteAddr，回包再发回对应的来源
+func startUDPPortProxy(mux *MuxManager, udpPort string, remoteAddr string, priority int) {
+	host, portStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		log.Printf("UDP 映射 %s 的远程地址无效: %v", udpPort, err)
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xFFFF {
+		log.Printf("UDP 映射 %s 的远程端口无效: %s", udpPort, portStr)
+		return
+	}
+	pc, err := net.ListenPacket("udp", udpPort)
+	if err != nil {
+		log.Fatalf("UDP监听失败: %v", err)
+	}
+	conn := pc.(*net.UDPConn)
+	log.Printf("UDP服务器启动在 %s，转发到 %s", udpPort, remoteAddr)
+	stopChans.Store("udp"+udpPort, conn)
+
+	table := newUDPSessionTable(mux, priority)
+	defer table.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("UDP 映射 %s 读取失败: %v", udpPort, err)
+			}
+			return
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		p := udpPacket{host: host, port: uint16(port), data: append([]byte(nil), buf[:n]...)}
+		table.send(src.String(), p, func() (func(udpPacket), func()) {
+			log.Printf("%s UDP 会话: %s", udpPort, src)
+			return func(p udpPacket) { conn.WriteToUDPAddrPort(p.data, src) }, nil
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package comm
+
+import (
+	"context"
+	"dosgo/btProxy/comm/proto"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpSessionTimeout 本地 UDP 会话空闲多久后关闭对应的数据报流
+var udpSessionTimeout = 2 * time.Minute
+
+// udpSessionQueue 数据报流打开前每个会话最多排队的数据报数，超出的直接丢弃
+const udpSessionQueue = 64
+
+// udpPacket 一个数据报及其对端地址：发往流时是目的地址，从流收到时是来源地址
+type udpPacket struct {
+	host string
+	port uint16
+	data []byte
+}
+
+// udpSession 一个本地 UDP 来源对应的数据报流
+type udpSession struct {
+	out        chan udpPacket // 等待写入流的数据报
+	done       chan struct{}
+	once       sync.Once
+	lastActive atomic.Int64 // 最近一次收发数据的时间，UnixNano
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// udpSessionTable 按本地来源把 UDP 数据报分配到各自的数据报流，空闲超时后关闭
+type udpSessionTable struct {
+	mux      *MuxManager
+	priority int
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newUDPSessionTable(mux *MuxManager, priority int) *udpSessionTable {
+	t := &udpSessionTable{
+		mux:      mux,
+		priority: priority,
+		sessions: make(map[string]*udpSession),
+		closed:   make(chan struct{}),
+	}
+	go t.expireLoop()
+	return t
+}
+
+// send 把数据报交给 key 对应的会话，会话不存在时新建并异步打开数据报流
+// 新建会话时调用 open 取得回包的处理函数 reply 和会话结束时的清理函数 cleanup（可为 nil）
+// p.data 会被异步写入流，调用方不能再复用它
+func (t *udpSessionTable) send(key string, p udpPacket, open func() (reply func(udpPacket), cleanup func())) {
+	t.mu.Lock()
+	s, ok := t.sessions[key]
+	if !ok {
+		select {
+		case <-t.closed:
+			t.mu.Unlock()
+			return
+		default:
+		}
+		s = &udpSession{out: make(chan udpPacket, udpSessionQueue), done: make(chan struct{})}
+		s.touch()
+		t.sessions[key] = s
+		reply, cleanup := open()
+		go t.run(key, s, net.JoinHostPort(p.host, strconv.Itoa(int(p.port))), reply, cleanup)
+	}
+	t.mu.Unlock()
+	s.touch()
+	select {
+	case s.out <- p:
+	default:
+		// 流还没打开或发送太慢，按 UDP 的语义丢弃
+	}
+}
+
+// run 打开数据报流并在两个方向上转发，直到会话空闲超时或流被关闭
+func (t *udpSessionTable) run(key string, s *udpSession, target string, reply func(udpPacket), cleanup func()) {
+	defer func() {
+		s.close()
+		t.mu.Lock()
+		if t.sessions[key] == s {
+			delete(t.sessions, key)
+		}
+		t.mu.Unlock()
+		if cleanup != nil {
+			cleanup()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	stream, err := t.mux.OpenDatagramContext(ctx, target)
+	cancel()
+	if err != nil {
+		log.Printf("UDP 会话 %s 打开数据报流失败: %v", key, err)
+		return
+	}
+	defer stream.Close()
+	stream.SetPriority(t.priority)
+
+	go func() {
+		defer s.close()
+		for {
+			host, port, data, err := proto.ReadDatagram(stream)
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, ErrStreamClosed) && !errors.Is(err, ErrStreamReset) {
+					log.Printf("UDP 会话 %s 读取失败: %v", key, err)
+				}
+				return
+			}
+			s.touch()
+			reply(udpPacket{host, port, data})
+		}
+	}()
+	for {
+		select {
+		case p := <-s.out:
+			if err := proto.WriteDatagram(stream, p.host, p.port, p.data); err != nil {
+				if err == proto.ErrDatagramTooLarge {
+					continue
+				}
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expireLoop 定期关闭空闲的会话
+func (t *udpSessionTable) expireLoop() {
+	ticker := time.NewTicker(udpSessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+		t.mu.Lock()
+		for _, s := range t.sessions {
+			if time.Since(time.Unix(0, s.lastActive.Load())) > udpSessionTimeout {
+				s.close()
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Close 关闭所有会话
+func (t *udpSessionTable) Close() {
+	t.once.Do(func() { close(t.closed) })
+	t.mu.Lock()
+	for _, s := range t.sessions {
+		s.close()
+	}
+	t.mu.Unlock()
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"dosgo/btProxy/comm/framing"
+	"dosgo/btProxy/comm/peerauth"
 	"dosgo/btProxy/comm/server"
+	"dosgo/btProxy/comm/tlslink"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,6 +26,75 @@ const (
 	PROFILE_OBJ_PATH = "/com/dosgo/bluetooth/profile"
 )
 
+// framingMode 物理链路的分帧方式，需与客户端配置一致
+var framingMode = flag.String("framing", "", `物理链路分帧方式，"cobs" 开启 COBS 分帧和 CRC-32 校验`)
+
+// listenAddr 额外监听的地址，便于在没有蓝牙的机器上测试整条链路
+var listenAddr = flag.String("listen", "", "额外监听的链路地址，例如 tcp://0.0.0.0:9000 或 unix:///tmp/btproxy.sock")
+
+// dnsUpstream DNS 解析流使用的上游，为空使用本机的系统解析器
+var dnsUpstream = flag.String("dns", "", "DNS 上游，例如 udp://8.8.8.8:53、tcp://1.1.1.1 或 https://dns.google/dns-query，默认使用系统解析器")
+
+// aclFile 访问控制规则文件，格式见 server.ACL
+var aclFile = flag.String("acl", "", "访问控制规则文件（JSON），为空不限制出站访问，反向转发只能监听回环地址")
+
+// authKeys 链路认证的密钥文件，每行 "ID 密钥"，修改后立即生效
+var authKeys = flag.String("auth-keys", "", "链路认证密钥文件，设置后客户端必须先用其中的密钥认证")
+
+// addKey 为新客户端生成密钥，追加到 -auth-keys 文件后退出
+var addKey = flag.String("add-key", "", "为指定 ID 生成密钥并加入 -auth-keys 文件，打印密钥后退出")
+
+// auditLog 认证结果的审计日志文件，为空时写到标准错误
+var auditLog = flag.String("audit-log", "", "认证审计日志文件，默认输出到标准错误")
+
+// tlsKeyFile 链路加密的私钥文件，不存在时自动生成
+var tlsKeyFile = flag.String("tls-key", "", "链路加密私钥文件，设置后客户端必须建立 TLS 会话，文件不存在时自动生成")
+
+// tlsPeers 允许连接的客户端公钥指纹，每行 "名字 指纹"，修改后立即生效
+var tlsPeers = flag.String("tls-peers", "", "允许的客户端公钥指纹文件，与 -tls-key 一起使用")
+
+var (
+	tlsIdentity *tlslink.Identity
+	tlsPinFile  *tlslink.PinFile
+	keyStore    *peerauth.FileStore
+	audit       = log.New(os.Stderr, "[审计] ", log.LstdFlags)
+)
+
+// listenTransport 在 tcp:// 或 unix:// 地址上接受客户端，每个连接的处理方式与蓝牙连接相同
+func listenTransport(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	target := u.Host
+	switch u.Scheme {
+	case "tcp":
+	case "unix":
+		target = u.Host + u.Path
+		os.Remove(target)
+	default:
+		return fmt.Errorf("不支持的监听地址 %q", addr)
+	}
+	l, err := net.Listen(u.Scheme, target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("正在监听: %s\n", addr)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("接受连接失败: %v", err)
+				return
+			}
+			fmt.Printf("收到新连接，来自: %s\n", conn.RemoteAddr())
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			go handleBridge(conn, host)
+		}
+	}()
+	return nil
+}
+
 // BluetoothProfile 实现 org.bluez.Profile1 接口
 type BluetoothProfile struct{}
 
@@ -27,7 +103,7 @@ func (p *BluetoothProfile) NewConnection(device dbus.ObjectPath, fd dbus.UnixFD,
 	fmt.Printf("收到新连接，来自设备: %s\n", device)
 	conn := NewBluetoothConn(fd)
 	// 异步处理桥接逻辑，不要阻塞 D-Bus 回调线程
-	go handleBridge(conn)
+	go handleBridge(conn, deviceMAC(device))
 	return nil
 }
 
@@ -40,29 +116,146 @@ func (p *BluetoothProfile) Release() *dbus.Error {
 	return nil
 }
 
-func handleBridge(conn net.Conn) {
+// deviceMAC 从 BlueZ 的设备路径（/org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF）取出 MAC 地址
+func deviceMAC(device dbus.ObjectPath) string {
+	p := string(device)
+	if i := strings.LastIndex(p, "/dev_"); i >= 0 {
+		return strings.ReplaceAll(p[i+len("/dev_"):], "_", ":")
+	}
+	return p
+}
+
+// handleBridge device 为对端的标识（蓝牙 MAC 或 IP），用于访问控制的设备规则
+func handleBridge(conn net.Conn, device string) {
 	defer conn.Close()
 	fmt.Println("蓝牙桥接线程启动...")
 
-	handler := server.NewBluetoothMuxHandler(conn)
+	// 层次与客户端相同：物理链路 → 分帧 → TLS → 认证 → Mux
+	var link io.ReadWriteCloser = conn
+	if *framingMode == "cobs" {
+		link = framing.NewConn(conn)
+	}
+	var tlsName, keyID string
+	if tlsIdentity != nil {
+		tconn, name, err := tlslink.Server(link, tlsIdentity, tlsPinFile)
+		if err != nil {
+			audit.Printf("加密握手失败，关闭连接: 设备 %s: %v", device, err)
+			return
+		}
+		defer tconn.Close()
+		audit.Printf("加密握手成功: 设备 %s 客户端 %q", device, name)
+		link, tlsName = tconn, name
+	}
+	if keyStore != nil {
+		id, err := peerauth.Server(link, keyStore)
+		if err != nil {
+			audit.Printf("认证失败，关闭连接: 设备 %s 密钥 ID %q: %v", device, id, err)
+			return
+		}
+		audit.Printf("认证成功: 设备 %s 密钥 ID %q", device, id)
+		keyID = id
+	}
+
+	handler := server.NewBluetoothMuxHandler(link)
+	handler.SetDevice(device)
+	handler.SetPeer(keyID, tlsName)
 	handler.Start()
 
-	// 保持连接
-	select {}
+	// 保持连接，直到蓝牙断开或心跳超时
+	<-handler.Done()
+	fmt.Println("蓝牙桥接线程退出")
 }
 
 func main() {
+	flag.Parse()
+	if *addKey != "" {
+		if *authKeys == "" {
+			log.Fatal("-add-key 需要同时指定 -auth-keys")
+		}
+		key, err := peerauth.AddKey(*authKeys, *addKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("已添加密钥，在客户端配置中填写:\n  \"auth_id\": %q,\n  \"auth_key\": %q\n", *addKey, key)
+		return
+	}
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("打开审计日志失败: %v", err)
+		}
+		defer f.Close()
+		audit.SetOutput(f)
+	}
+	if *tlsKeyFile != "" {
+		if *tlsPeers == "" {
+			log.Fatal("-tls-key 需要同时指定 -tls-peers")
+		}
+		var err error
+		if tlsIdentity, err = tlslink.LoadOrCreateIdentity(*tlsKeyFile); err != nil {
+			log.Fatalf("加载链路加密私钥失败: %v", err)
+		}
+		if tlsPinFile, err = tlslink.NewPinFile(*tlsPeers); err != nil {
+			log.Fatalf("加载客户端指纹失败: %v", err)
+		}
+		fmt.Printf("已开启链路加密，%d 个客户端，服务端公钥指纹（填入客户端 tls_server_pin）: %s\n", tlsPinFile.Len(), tlsIdentity.Fingerprint)
+	}
+	if *authKeys != "" {
+		var err error
+		if keyStore, err = peerauth.NewFileStore(*authKeys); err != nil {
+			log.Fatalf("加载认证密钥失败: %v", err)
+		}
+		fmt.Printf("已开启链路认证，%d 个密钥: %s\n", len(keyStore.IDs()), *authKeys)
+	}
+	if err := server.SetDNSUpstream(*dnsUpstream); err != nil {
+		log.Fatal(err)
+	}
+	if *aclFile != "" {
+		acl, err := server.LoadACL(*aclFile)
+		if err != nil {
+			log.Fatalf("加载访问控制规则失败: %v", err)
+		}
+		server.SetACL(acl)
+		fmt.Printf("已加载访问控制规则: %s\n", *aclFile)
+	}
+	if *listenAddr != "" {
+		if err := listenTransport(*listenAddr); err != nil {
+			log.Fatalf("监听 %s 失败: %v", *listenAddr, err)
+		}
+	}
+	unregister, err := registerProfile()
+	if err != nil {
+		if *listenAddr == "" {
+			log.Fatal(err)
+		}
+		// 没有蓝牙的机器上只提供额外监听的地址
+		log.Printf("%v，仅监听 %s", err, *listenAddr)
+	}
+
+	// 4. 等待信号退出
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	if unregister != nil {
+		fmt.Println("正在注销服务...")
+		unregister()
+	}
+}
+
+// registerProfile 向 BlueZ 注册 SPP Profile，返回注销函数
+func registerProfile() (func(), error) {
 	// 1. 连接到系统总线 (System Bus)
 	conn, err := dbus.SystemBus()
 	if err != nil {
-		log.Fatalf("无法连接到 System Bus: %v", err)
+		return nil, fmt.Errorf("无法连接到 System Bus: %v", err)
 	}
-	defer conn.Close()
 	// 2. 导出 Profile 对象，供 BlueZ 回调
 	profile := &BluetoothProfile{}
 	err = conn.Export(profile, PROFILE_OBJ_PATH, "org.bluez.Profile1")
 	if err != nil {
-		log.Fatalf("导出对象失败: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("导出对象失败: %v", err)
 	}
 
 	// 3. 向 BlueZ ProfileManager1 注册该 Profile
@@ -76,18 +269,15 @@ func main() {
 	err = obj.Call("org.bluez.ProfileManager1.RegisterProfile", 0,
 		dbus.ObjectPath(PROFILE_OBJ_PATH), MY_UUID, options).Store()
 	if err != nil {
-		log.Fatalf("注册 Profile 失败: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("注册 Profile 失败: %v", err)
 	}
 
 	fmt.Printf("蓝牙服务已通过 D-Bus 注册，正在监听 UUID: %s\n", MY_UUID)
-
-	// 4. 等待信号退出
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
-
-	fmt.Println("正在注销服务...")
-	obj.Call("org.bluez.ProfileManager1.UnregisterProfile", 0, dbus.ObjectPath(PROFILE_OBJ_PATH))
+	return func() {
+		obj.Call("org.bluez.ProfileManager1.UnregisterProfile", 0, dbus.ObjectPath(PROFILE_OBJ_PATH))
+		conn.Close()
+	}, nil
 }
 
 // BluetoothConn 实现 net.Conn 接口的蓝牙连接